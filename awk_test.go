@@ -0,0 +1,155 @@
+package main_test
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+var awks = flag.String("awk", "", "comma separated awk implementations to run the tests with, like /usr/bin/gawk,/usr/bin/mawk,busybox awk (default to system one)")
+
+// awkImplementations returns the awk implementations set on the command line, "" being the system one.
+func awkImplementations() []string {
+	impls := splitList(*awks)
+	if len(impls) == 0 {
+		return []string{""}
+	}
+	return impls
+}
+
+// awkName identifies an awk implementation, like "mawk" for /usr/bin/mawk or "busybox-awk" for "busybox awk".
+func awkName(impl string) string {
+	var parts []string
+	for _, f := range strings.Fields(impl) {
+		parts = append(parts, filepath.Base(f))
+	}
+	return strings.Join(parts, "-")
+}
+
+// withAwks returns the test cases to run with each awk implementation set on the command line.
+// When there are several ones, test cases are named after the implementation.
+func withAwks(t *testing.T, testCases map[string]TestCase) map[string]TestCase {
+	t.Helper()
+
+	impls := awkImplementations()
+	for _, impl := range impls {
+		if impl == "" {
+			continue
+		}
+		if _, err := exec.LookPath(strings.Fields(impl)[0]); err != nil {
+			t.Fatalf("invalid awk implementation %q: %v", impl, err)
+		}
+	}
+	if len(impls) == 1 {
+		r := make(map[string]TestCase)
+		for name, tc := range testCases {
+			tc.awk = impls[0]
+			r[name] = tc
+		}
+		return r
+	}
+
+	r := make(map[string]TestCase)
+	for name, tc := range testCases {
+		for _, impl := range impls {
+			tc.awk = impl
+			r[name+"/"+awkName(impl)] = tc
+		}
+	}
+	return r
+}
+
+// awkEnv returns the environment variable selecting the awk implementation run by the awk mock.
+func (tc TestCase) awkEnv() string {
+	return "TEST_AWK_BIN=" + tc.awk
+}
+
+// awkOutputs are the contents generated by each awk implementation, per test name without the implementation.
+var awkOutputs = struct {
+	sync.Mutex
+	byTest map[string]map[string]string
+}{byTest: make(map[string]map[string]string)}
+
+// assertSameAwkOutputs records the content generated by the test with its awk implementation. Once all
+// implementations generated it, divergences are reported side by side.
+func (tc TestCase) assertSameAwkOutputs(t *testing.T, generatedF string) {
+	t.Helper()
+
+	impls := awkImplementations()
+	if len(impls) == 1 {
+		return
+	}
+
+	var generated string
+	if _, err := os.Stat(generatedF); err == nil {
+		generated = anonymizeTempDirNames(t, generatedF)
+	}
+
+	name := awkName(tc.awk)
+	key := strings.TrimSuffix(t.Name(), "/"+name)
+	awkOutputs.Lock()
+	outputs := awkOutputs.byTest[key]
+	if outputs == nil {
+		outputs = make(map[string]string)
+		awkOutputs.byTest[key] = outputs
+	}
+	outputs[name] = generated
+	complete := len(outputs) == len(impls)
+	awkOutputs.Unlock()
+
+	if !complete {
+		return
+	}
+	if diff := sideBySide(outputs); diff != "" {
+		t.Errorf("awk implementations generated different contents:\n%s", diff)
+	}
+}
+
+// sideBySide returns the lines which are not the same in all contents, with the one of each content next to each
+// other. It is empty if all contents are the same.
+func sideBySide(contents map[string]string) string {
+	var names []string
+	lines := make(map[string][]string)
+	var maxLines, maxName int
+	for name, c := range contents {
+		names = append(names, name)
+		lines[name] = strings.Split(strings.TrimSuffix(c, "\n"), "\n")
+		if len(lines[name]) > maxLines {
+			maxLines = len(lines[name])
+		}
+		if len(name) > maxName {
+			maxName = len(name)
+		}
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for i := 0; i < maxLines; i++ {
+		values := make(map[string]string)
+		same := true
+		for _, name := range names {
+			v := "<no line>"
+			if i < len(lines[name]) {
+				v = lines[name][i]
+			}
+			values[name] = v
+			if v != values[names[0]] {
+				same = false
+			}
+		}
+		if same {
+			continue
+		}
+		fmt.Fprintf(&b, "line %d:\n", i+1)
+		for _, name := range names {
+			fmt.Fprintf(&b, "  %-*s | %s\n", maxName, name, values[name])
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,719 @@
+package main_test
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"syscall"
+	"time"
+
+	zfs "github.com/bicomsystems/go-libzfs"
+	"github.com/ubuntu/grubmenugen-zfs-tests/internal/fakezfs"
+)
+
+var kernelZFS = flag.Bool("kernel-zfs", false, "create pools with the zfs kernel module instead of the userspace fake backend (requires root)")
+
+// systemBackend creates the pools, datasets and partitions described by FakeDevices.
+type systemBackend interface {
+	// createPool creates and imports a pool on vdev, with altroot as its alternate root.
+	createPool(name string, vdev zfs.VDevTree, altroot string, opts poolOptions) error
+	exportPool(name string) error
+	createDataset(name string) error
+	// createEncryptedDataset creates a dataset which is the root of its own encryption key, stored in keyFile,
+	// and loads its key. keylocation is set once the dataset is created.
+	createEncryptedDataset(name, encryption, keyformat, keylocation, keyFile string) error
+	// unloadKey unloads the key of an encryption root, whose datasets must be unmounted.
+	unloadKey(dataset string) error
+	snapshot(name string) error
+	// clone creates the dataset name from snapshot, which becomes its origin.
+	clone(snapshot, name string) error
+	// promote swaps a clone with its origin filesystem, taking over the snapshots up to its origin.
+	promote(name string) error
+	bookmark(snapshot, name string) error
+	setProperty(dataset, prop, value string) error
+	setUserProperty(dataset, prop, value string) error
+	property(dataset, prop string) (string, error)
+	// setCreation sets the creation date of a snapshot, as reported to 10_linux_zfs.
+	setCreation(snapshot string, t time.Time) error
+	// mount mounts a dataset on its mountpoint, or on legacyPath if its mountpoint is legacy, and returns the path
+	// where its content should be written.
+	mount(dataset, legacyPath string) (string, error)
+	// unmount unmounts a dataset and removes mountPath, if not empty.
+	unmount(dataset, mountPath string) error
+	// setPoolState sets a state of pool which can't be derived from its vdevs, like fakezfs.PoolForeign.
+	setPoolState(pool, state string) error
+	// corrupt damages devicePath of the exported pool as described by mode, like fakezfs.CorruptLabels, with
+	// bytes generated from seed.
+	corrupt(pool, devicePath, mode string, seed int64) error
+	// createPartition formats devicePath with fstype and returns the path where its content should be written
+	// and a teardown function to call once the content is written.
+	createPartition(devicePath, fstype, mountPath string) (string, func(), error)
+	// commit is called once all devices are created, before running grub-mkconfig.
+	commit() error
+	importedPools() ([]string, error)
+	// cleanup exports and destroys all pools for the next test to start in a preserved state.
+	cleanup()
+	// env returns environment variables for the mocks to target this backend.
+	env() []string
+	// mocks returns additional mocks this backend needs in PATH.
+	mocks() []string
+}
+
+// poolOptions are the features and properties a pool is created with.
+type poolOptions struct {
+	// features are the only features enabled on the pool. All of them are enabled when nil.
+	features []string
+	props    map[string]string
+	// fsProps are the properties of the root dataset of the pool, including user ones.
+	fsProps map[string]string
+}
+
+// newSystemBackend returns the backend selected on the command line, storing its state in testDir.
+func newSystemBackend(testDir string) systemBackend {
+	if *kernelZFS {
+		return kernelBackend{}
+	}
+	return &userspaceBackend{dir: fakeZFSStateDir(testDir)}
+}
+
+// fakeZFSStateDir returns the directory of the userspace fake zfs backend state for a test.
+func fakeZFSStateDir(testDir string) string {
+	return filepath.Join(testDir, "fakezfs")
+}
+
+// kernelBackend drives the zfs kernel module through libzfs.
+type kernelBackend struct{}
+
+// vdevTypeSpecial groups the top level vdev of the special allocation class, like zfs.VDevTypeLog does for logs.
+const vdevTypeSpecial zfs.VDevType = "special"
+
+// kernelPoolProps maps pool property names to their libzfs identifier.
+var kernelPoolProps = map[string]zfs.Prop{
+	"ashift":     zfs.PoolPropAshift,
+	"autoexpand": zfs.PoolPropAutoexpand,
+	"autotrim":   zfs.PoolPropAutotrim,
+	"bootfs":     zfs.PoolPropBootfs,
+	"cachefile":  zfs.PoolPropCachefile,
+	"comment":    zfs.PoolPropComment,
+	"failmode":   zfs.PoolPropFailuremode,
+}
+
+func (kernelBackend) createPool(name string, vdev zfs.VDevTree, altroot string, opts poolOptions) error {
+	// libzfs bindings enable a fixed set of features on top of the requested ones
+	libzfs := opts.features == nil
+	for _, dev := range vdev.Devices {
+		if dev.Type == zfs.VDevTypeLog || dev.Type == vdevTypeSpecial {
+			libzfs = false
+		}
+	}
+	props := make(map[zfs.Prop]string)
+	for k, v := range opts.props {
+		p, ok := kernelPoolProps[k]
+		if !ok {
+			libzfs = false
+		}
+		props[p] = v
+	}
+	fsprops := make(map[zfs.Prop]string)
+	for k, v := range opts.fsProps {
+		p, ok := kernelDatasetProps[k]
+		if !ok {
+			libzfs = false
+		}
+		fsprops[p] = v
+	}
+	if !libzfs {
+		return zpoolCreate(name, vdev, altroot, opts)
+	}
+
+	features := make(map[string]string)
+	props[zfs.PoolPropAltroot] = altroot
+
+	pool, err := zfs.PoolCreate(name, vdev, features, props, fsprops)
+	if err != nil {
+		return err
+	}
+	pool.Close()
+	return nil
+}
+
+// zpoolCreate uses the zpool command for pools libzfs bindings can't create: they nest log vdevs instead of flagging
+// them, don't know about special ones, can't restrict features and only handle some properties.
+func zpoolCreate(name string, vdev zfs.VDevTree, altroot string, opts poolOptions) error {
+	args := []string{"create", "-f", "-o", "altroot=" + altroot}
+	if opts.features != nil {
+		args = append(args, "-d")
+	}
+	for _, f := range opts.features {
+		args = append(args, "-o", "feature@"+f+"=enabled")
+	}
+	for _, k := range sortedKeys(opts.props) {
+		args = append(args, "-o", k+"="+opts.props[k])
+	}
+	for _, k := range sortedKeys(opts.fsProps) {
+		args = append(args, "-O", k+"="+opts.fsProps[k])
+	}
+	args = append(args, name)
+	for _, dev := range vdev.Devices {
+		if dev.Type == zfs.VDevTypeLog || dev.Type == vdevTypeSpecial {
+			args = append(args, string(dev.Type))
+			dev = dev.Devices[0]
+		}
+		args = append(args, vdevSpec(dev)...)
+	}
+	if len(vdev.L2Cache) > 0 {
+		args = append(args, "cache")
+		for _, dev := range vdev.L2Cache {
+			args = append(args, dev.Path)
+		}
+	}
+	if out, err := exec.Command("/sbin/zpool", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, out)
+	}
+	return nil
+}
+
+// sortedKeys returns the keys of m in lexical order.
+func sortedKeys(m map[string]string) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// vdevSpec returns the zpool create arguments of a top level vdev.
+func vdevSpec(dev zfs.VDevTree) []string {
+	var spec []string
+	switch dev.Type {
+	case zfs.VDevTypeMirror:
+		spec = append(spec, zfs.VDevTypeMirror)
+	case zfs.VDevTypeRaidz:
+		spec = append(spec, fmt.Sprintf("%s%d", zfs.VDevTypeRaidz, dev.Parity))
+	default:
+		return []string{dev.Path}
+	}
+	for _, d := range dev.Devices {
+		spec = append(spec, d.Path)
+	}
+	return spec
+}
+
+func (kernelBackend) exportPool(name string) error {
+	pool, err := zfs.PoolOpen(name)
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
+	return pool.Export(true, "export temporary pool")
+}
+
+func (kernelBackend) createDataset(name string) error {
+	props := make(map[zfs.Prop]zfs.Property)
+	d, err := zfs.DatasetCreate(name, zfs.DatasetTypeFilesystem, props)
+	if err != nil {
+		return err
+	}
+	d.Close()
+	return nil
+}
+
+// createEncryptedDataset uses the zfs command, as libzfs bindings can't provide keys.
+func (kernelBackend) createEncryptedDataset(name, encryption, keyformat, keylocation, keyFile string) error {
+	if out, err := exec.Command("/sbin/zfs", "create", "-o", "encryption="+encryption, "-o", "keyformat="+keyformat,
+		"-o", "keylocation=file://"+keyFile, name).CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, out)
+	}
+	if out, err := exec.Command("/sbin/zfs", "set", "keylocation="+keylocation, name).CombinedOutput(); err != nil {
+		return fmt.Errorf("couldn't set key location: %v: %s", err, out)
+	}
+	return nil
+}
+
+func (kernelBackend) unloadKey(dataset string) error {
+	if out, err := exec.Command("/sbin/zfs", "unload-key", dataset).CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, out)
+	}
+	return nil
+}
+
+func (kernelBackend) snapshot(name string) error {
+	props := make(map[zfs.Prop]zfs.Property)
+	d, err := zfs.DatasetSnapshot(name, false, props)
+	if err != nil {
+		return err
+	}
+	d.Close()
+	return nil
+}
+
+func (kernelBackend) clone(snapshot, name string) error {
+	d, err := zfs.DatasetOpen(snapshot)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	c, err := d.Clone(name, make(map[zfs.Prop]zfs.Property))
+	if err != nil {
+		return err
+	}
+	c.Close()
+	return nil
+}
+
+func (kernelBackend) promote(name string) error {
+	d, err := zfs.DatasetOpen(name)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Promote()
+}
+
+// bookmark uses the zfs command, as libzfs bindings can't create bookmarks.
+func (kernelBackend) bookmark(snapshot, name string) error {
+	if out, err := exec.Command("/sbin/zfs", "bookmark", snapshot, name).CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, out)
+	}
+	return nil
+}
+
+// kernelDatasetProps maps property names to their libzfs identifier.
+var kernelDatasetProps = map[string]zfs.Prop{
+	"mountpoint":  zfs.DatasetPropMountpoint,
+	"canmount":    zfs.DatasetPropCanmount,
+	"compression": zfs.DatasetPropCompression,
+	"recordsize":  zfs.DatasetPropRecordsize,
+	"atime":       zfs.DatasetPropAtime,
+	"relatime":    zfs.DatasetPropRelatime,
+	"readonly":    zfs.DatasetPropReadonly,
+	"xattr":       zfs.DatasetPropXattr,
+	"acltype":     zfs.DatasetPropAcltype,
+	"devices":     zfs.DatasetPropDevices,
+	"exec":        zfs.DatasetPropExec,
+	"setuid":      zfs.DatasetPropSetuid,
+}
+
+// setProperty uses the zfs command for properties without a libzfs identifier.
+func (kernelBackend) setProperty(dataset, prop, value string) error {
+	p, ok := kernelDatasetProps[prop]
+	if !ok {
+		if out, err := exec.Command("/sbin/zfs", "set", prop+"="+value, dataset).CombinedOutput(); err != nil {
+			return fmt.Errorf("%v: %s", err, out)
+		}
+		return nil
+	}
+	d, err := zfs.DatasetOpen(dataset)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.SetProperty(p, value)
+}
+
+func (kernelBackend) setUserProperty(dataset, prop, value string) error {
+	d, err := zfs.DatasetOpen(dataset)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.SetUserProperty(prop, value)
+}
+
+func (kernelBackend) property(dataset, prop string) (string, error) {
+	p, ok := kernelDatasetProps[prop]
+	if !ok {
+		return "", fmt.Errorf("unsupported property %q", prop)
+	}
+	d, err := zfs.DatasetOpen(dataset)
+	if err != nil {
+		return "", err
+	}
+	defer d.Close()
+	v, err := d.GetProperty(p)
+	if err != nil {
+		return "", err
+	}
+	return v.Value, nil
+}
+
+// setCreation stores the creation date in a user property, as creation is read-only. The zfs mock answers it
+// when creation is queried.
+func (b kernelBackend) setCreation(snapshot string, t time.Time) error {
+	// Convert time in current timezone for mock
+	location, err := time.LoadLocation("Local")
+	if err != nil {
+		return fmt.Errorf("couldn't get current timezone: %v", err)
+	}
+	return b.setUserProperty(snapshot, "com.ubuntu.zsys:creation.test", strconv.FormatInt(t.In(location).Unix(), 10))
+}
+
+func (b kernelBackend) mount(dataset, legacyPath string) (string, error) {
+	// get potentially inherited mountpoint path
+	mountpoint, err := b.property(dataset, "mountpoint")
+	if err != nil {
+		return "", fmt.Errorf("couldn't get mount point: %v", err)
+	}
+
+	// Mount manually datasetPath if set to legacy to "/" (legacyPath)
+	if mountpoint == "legacy" {
+		if err := syscall.Mount(dataset, legacyPath, "zfs", 0, ""); err != nil {
+			return "", fmt.Errorf("couldn't manually mount dataset: %v", err)
+		}
+		return legacyPath, nil
+	}
+
+	d, err := zfs.DatasetOpen(dataset)
+	if err != nil {
+		return "", err
+	}
+	defer d.Close()
+	if err := d.Mount("", 0); err != nil {
+		return "", err
+	}
+	return mountpoint, nil
+}
+
+func (kernelBackend) unmount(dataset, mountPath string) error {
+	d, err := zfs.DatasetOpen(dataset)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	err = d.UnmountAll(0)
+	if mountPath != "" {
+		os.RemoveAll(mountPath)
+	}
+	return err
+}
+
+// setPoolState isn't supported: those states are only simulated by the userspace backend.
+func (kernelBackend) setPoolState(pool, state string) error {
+	return fmt.Errorf("%s pools are only simulated by the userspace backend", state)
+}
+
+func (kernelBackend) corrupt(pool, devicePath, mode string, seed int64) error {
+	return corruptDevice(devicePath, mode, seed)
+}
+
+func (kernelBackend) createPartition(devicePath, fstype, mountPath string) (string, func(), error) {
+	if fstype != "ext4" {
+		return "", nil, fmt.Errorf("unsupported filesystem: %s", fstype)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "mkfs.ext4", "-q", "-F", devicePath)
+	if err := cmd.Run(); err != nil {
+		return "", nil, fmt.Errorf("couldn't format %q to ext4: %v", devicePath, err)
+	}
+
+	cmd = exec.CommandContext(ctx, "mount", "-t", "ext4", devicePath, mountPath)
+	if err := cmd.Run(); err != nil {
+		return "", nil, fmt.Errorf("couldn't mount ext4 partition: %v", err)
+	}
+	return mountPath, func() { syscall.Unmount(mountPath, 0) }, nil
+}
+
+func (kernelBackend) commit() error {
+	return nil
+}
+
+func (kernelBackend) importedPools() ([]string, error) {
+	pools, err := zfs.PoolOpenAll()
+	if err != nil && err.Error() != "no error" && err.Error() != "dataset does not exist" {
+		return nil, err
+	}
+	defer zfs.PoolCloseAll(pools)
+
+	var names []string
+	for _, p := range pools {
+		name, err := p.Name()
+		if err != nil {
+			return nil, fmt.Errorf("couldn't aquite pool name: %v", err)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// cleanup exports and destroys all pools, as we can't run the tests on system which have a pool (no mount
+// namespace in zfs).
+func (kernelBackend) cleanup() {
+	pools, err := zfs.PoolOpenAll()
+	if err != nil {
+		return
+	}
+	for _, p := range pools {
+		p.Export(true, "export temporary pool after test")
+		p.Destroy("destroy temporary pool after test")
+		p.Close()
+	}
+}
+
+func (kernelBackend) env() []string {
+	return nil
+}
+
+// mocks returns the mount and umount wrappers, which delegate to the real commands, so that their invocations are
+// recorded in traces and can be replayed.
+func (kernelBackend) mocks() []string {
+	return []string{"mount", "umount"}
+}
+
+// userspaceBackend stores pools in the state of the userspace fake zfs backend, which the mocks answer from.
+// Mounts are only recorded: content is written in the dataset storage, and copied on 10_linux_zfs mounts.
+type userspaceBackend struct {
+	dir   string
+	state *fakezfs.State
+}
+
+// open returns the state, opening it on first use. It stays locked until commit is called.
+func (b *userspaceBackend) open() (*fakezfs.State, error) {
+	if b.state != nil {
+		return b.state, nil
+	}
+	s, err := fakezfs.Open(b.dir)
+	if err != nil {
+		return nil, err
+	}
+	b.state = s
+	return s, nil
+}
+
+// do runs f on the opened state.
+func (b *userspaceBackend) do(f func(s *fakezfs.State) error) error {
+	s, err := b.open()
+	if err != nil {
+		return err
+	}
+	return f(s)
+}
+
+func (b *userspaceBackend) createPool(name string, vdev zfs.VDevTree, altroot string, opts poolOptions) error {
+	var vdevs []string
+	var topology []fakezfs.Vdev
+	for _, dev := range vdev.Devices {
+		v, class := fakeVdev(dev), ""
+		switch dev.Type {
+		case zfs.VDevTypeLog:
+			class = fakezfs.ClassLog
+		case vdevTypeSpecial:
+			class = fakezfs.ClassSpecial
+		}
+		if class != "" {
+			// allocation classes group a single top level vdev
+			v = fakeVdev(dev.Devices[0])
+			v.Class = class
+		}
+		vdevs = append(vdevs, v.Devices...)
+		topology = append(topology, v)
+	}
+	for _, dev := range vdev.L2Cache {
+		vdevs = append(vdevs, dev.Path)
+		topology = append(topology, fakezfs.Vdev{Type: fakezfs.VdevDisk, Class: fakezfs.ClassCache, Devices: []string{dev.Path}})
+	}
+	props := map[string]string{"altroot": altroot}
+	for k, v := range opts.props {
+		props[k] = v
+	}
+	return b.do(func(s *fakezfs.State) error {
+		p, err := s.CreatePool(name, vdevs, props)
+		if err != nil {
+			return err
+		}
+		if err := p.SetTopology(topology); err != nil {
+			return err
+		}
+		if err := p.SetFeatures(opts.features); err != nil {
+			return err
+		}
+		for _, k := range sortedKeys(opts.fsProps) {
+			if err := s.SetProperty(name, k, opts.fsProps[k]); err != nil {
+				return fmt.Errorf("cannot create '%s': %v", name, err)
+			}
+		}
+		return nil
+	})
+}
+
+// fakeVdev returns the fake zfs top level vdev of a libzfs one.
+func fakeVdev(dev zfs.VDevTree) fakezfs.Vdev {
+	switch dev.Type {
+	case zfs.VDevTypeMirror, zfs.VDevTypeRaidz:
+		v := fakezfs.Vdev{Type: string(dev.Type)}
+		if dev.Type == zfs.VDevTypeRaidz {
+			v.Type = fmt.Sprintf("%s%d", dev.Type, dev.Parity)
+		}
+		for _, d := range dev.Devices {
+			v.Devices = append(v.Devices, d.Path)
+		}
+		return v
+	}
+	return fakezfs.Vdev{Type: fakezfs.VdevDisk, Devices: []string{dev.Path}}
+}
+
+func (b *userspaceBackend) exportPool(name string) error {
+	return b.do(func(s *fakezfs.State) error { return s.ExportPool(name) })
+}
+
+func (b *userspaceBackend) createDataset(name string) error {
+	return b.do(func(s *fakezfs.State) error {
+		_, err := s.CreateDataset(name)
+		return err
+	})
+}
+
+func (b *userspaceBackend) createEncryptedDataset(name, encryption, keyformat, keylocation, keyFile string) error {
+	return b.do(func(s *fakezfs.State) error {
+		_, err := s.CreateEncryptedDataset(name, encryption, keyformat, keylocation)
+		return err
+	})
+}
+
+func (b *userspaceBackend) unloadKey(dataset string) error {
+	return b.do(func(s *fakezfs.State) error { return s.UnloadKey(dataset) })
+}
+
+func (b *userspaceBackend) snapshot(name string) error {
+	return b.do(func(s *fakezfs.State) error {
+		_, err := s.Snapshot(name)
+		return err
+	})
+}
+
+func (b *userspaceBackend) clone(snapshot, name string) error {
+	return b.do(func(s *fakezfs.State) error {
+		_, err := s.Clone(snapshot, name)
+		return err
+	})
+}
+
+func (b *userspaceBackend) promote(name string) error {
+	return b.do(func(s *fakezfs.State) error { return s.Promote(name) })
+}
+
+func (b *userspaceBackend) bookmark(snapshot, name string) error {
+	return b.do(func(s *fakezfs.State) error {
+		_, err := s.Bookmark(snapshot, name)
+		return err
+	})
+}
+
+func (b *userspaceBackend) setProperty(dataset, prop, value string) error {
+	return b.do(func(s *fakezfs.State) error { return s.SetProperty(dataset, prop, value) })
+}
+
+func (b *userspaceBackend) setUserProperty(dataset, prop, value string) error {
+	return b.do(func(s *fakezfs.State) error { return s.SetProperty(dataset, prop, value) })
+}
+
+func (b *userspaceBackend) property(dataset, prop string) (v string, err error) {
+	err = b.do(func(s *fakezfs.State) error {
+		d, p := s.Dataset(dataset)
+		if d == nil {
+			return fmt.Errorf("dataset %q does not exist", dataset)
+		}
+		v, _ = s.DatasetProperty(p, d, prop, false)
+		return nil
+	})
+	return v, err
+}
+
+func (b *userspaceBackend) setCreation(snapshot string, t time.Time) error {
+	return b.do(func(s *fakezfs.State) error { return s.SetCreation(snapshot, t) })
+}
+
+func (b *userspaceBackend) mount(dataset, legacyPath string) (path string, err error) {
+	err = b.do(func(s *fakezfs.State) error {
+		d, p := s.Dataset(dataset)
+		if d == nil {
+			return fmt.Errorf("dataset %q does not exist", dataset)
+		}
+		path = s.StorageDir(dataset)
+		if mountpoint, _ := s.DatasetProperty(p, d, "mountpoint", false); mountpoint == "legacy" {
+			return s.Mount(dataset, legacyPath, false)
+		}
+		return s.MountDataset(dataset)
+	})
+	return path, err
+}
+
+func (b *userspaceBackend) unmount(dataset, mountPath string) error {
+	return b.do(func(s *fakezfs.State) error { return s.UnmountSource(dataset) })
+}
+
+func (b *userspaceBackend) setPoolState(pool, state string) error {
+	return b.do(func(s *fakezfs.State) error {
+		p := s.Pool(pool)
+		if p == nil {
+			return fmt.Errorf("pool %q does not exist", pool)
+		}
+		p.State = state
+		return nil
+	})
+}
+
+// corrupt damages devicePath as with the kernel backend, and records the corruption for the fake zpool to
+// reproduce its effect on the pool.
+func (b *userspaceBackend) corrupt(pool, devicePath, mode string, seed int64) error {
+	if err := corruptDevice(devicePath, mode, seed); err != nil {
+		return err
+	}
+	return b.do(func(s *fakezfs.State) error {
+		p := s.Pool(pool)
+		if p == nil {
+			return fmt.Errorf("pool %q does not exist", pool)
+		}
+		p.Corruption = mode
+		return nil
+	})
+}
+
+func (b *userspaceBackend) createPartition(devicePath, fstype, mountPath string) (path string, teardown func(), err error) {
+	err = b.do(func(s *fakezfs.State) error {
+		if _, err := s.AddDevice(devicePath, fstype); err != nil {
+			return err
+		}
+		path = s.StorageDir(filepath.Clean(devicePath))
+		return nil
+	})
+	return path, func() {}, err
+}
+
+func (b *userspaceBackend) commit() error {
+	if b.state == nil {
+		return nil
+	}
+	defer func() { b.state = nil }()
+	defer b.state.Close()
+	return b.state.Save()
+}
+
+func (b *userspaceBackend) importedPools() ([]string, error) {
+	if err := b.commit(); err != nil {
+		return nil, err
+	}
+	s, err := fakezfs.Open(b.dir)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	return s.ImportedPools(), nil
+}
+
+// cleanup has nothing to do: the state is removed with the test directory.
+func (b *userspaceBackend) cleanup() {}
+
+func (b *userspaceBackend) env() []string {
+	return []string{fakezfs.StateDirEnv + "=" + b.dir}
+}
+
+func (b *userspaceBackend) mocks() []string {
+	return []string{"mount", "umount"}
+}
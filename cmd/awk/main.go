@@ -1,31 +1,37 @@
 // Fake version of awk to use alternative versions depending on the environment variable TEST_AWK_BIN.
+// It can have arguments, like "busybox awk".
 package main
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"strings"
+
+	"github.com/ubuntu/grubmenugen-zfs-tests/internal/trace"
 )
 
 func main() {
-	awk := "/usr/bin/awk"
-	if mawk, ok := os.LookupEnv("TEST_AWK_BIN"); ok && mawk != "" {
-		awk = mawk
+	trace.Main("awk", run)
+}
+
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	awk := []string{"/usr/bin/awk"}
+	if impl := strings.Fields(os.Getenv("TEST_AWK_BIN")); len(impl) > 0 {
+		awk = impl
 	}
 
-	cmd := exec.Command(awk, os.Args[1:]...)
-	cmd.Stderr = os.Stderr
-	cmd.Stdout = os.Stdout
-	cmd.Stdin = os.Stdin
+	cmd := exec.Command(awk[0], append(awk[1:], args[1:]...)...)
+	cmd.Stderr = stderr
+	cmd.Stdout = stdout
+	cmd.Stdin = stdin
 	if err := cmd.Run(); err != nil {
 		if exiterr, ok := err.(*exec.ExitError); ok {
-			// FIXME: replace with go 1.12: os.Exit(exiterr.ExitCode())
-			_ = exiterr
-			os.Exit(1)
+			return exiterr.ExitCode()
 		}
-		fmt.Printf("Unexpected error when trying to execute %q: %v", awk, err)
-		os.Exit(2)
+		fmt.Fprintf(stdout, "Unexpected error when trying to execute %q: %v", strings.Join(awk, " "), err)
+		return 2
 	}
-	os.Exit(0)
-
+	return 0
 }
@@ -1,33 +1,116 @@
+// Fake version of date answering against the clock of the test case, set in TEST_MOCKDATE_NOW as seconds since
+// epoch. It defaults to a "current date" far in the future (2033-05-18T03:33:20+00:00 @2000000000).
+// Dates relative to the current time, like "yesterday" or "+1 hour", are rebased on the mocked one. Dates which the
+// real date would complete with the real current time, like "12:00", are rejected.
+// Dates are still formatted by the real date, so that timezones and format strings are handled the same way.
 package main
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/ubuntu/grubmenugen-zfs-tests/internal/trace"
 )
 
+const defaultNow = 2000000000
+
 func main() {
-	cmdLine := strings.Join(os.Args, " ")
+	trace.Main("date", run)
+}
 
-	// mock date +%s by returning a "current date" far in the future (2033-05-18T03:33:20+00:00  @2000000000)
-	if cmdLine == "date +%s" {
-		fmt.Println("2000000000")
-		os.Exit(0)
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	now := int64(defaultNow)
+	if v := os.Getenv("TEST_MOCKDATE_NOW"); v != "" {
+		var err error
+		if now, err = strconv.ParseInt(v, 10, 64); err != nil {
+			fmt.Fprintf(stderr, "invalid mocked current time %q: %v\n", v, err)
+			return 2
+		}
+	}
+	nowDate := fmt.Sprintf("@%d", now)
+
+	// Every date to print which is relative to the current time is replaced by the mocked one.
+	var dateArgs []string
+	var hasDate bool
+	for i := 1; i < len(args); i++ {
+		a := args[i]
+		var d string
+		switch {
+		case a == "-d" || a == "--date":
+			if i+1 < len(args) {
+				i++
+				d = args[i]
+			}
+		case strings.HasPrefix(a, "--date="):
+			d = strings.TrimPrefix(a, "--date=")
+		case strings.HasPrefix(a, "-d"):
+			d = strings.TrimPrefix(a, "-d")
+		case a == "-r" || a == "--reference" || strings.HasPrefix(a, "--reference="):
+			// the date is the one of a file
+			hasDate = true
+			dateArgs = append(dateArgs, a)
+			continue
+		default:
+			dateArgs = append(dateArgs, a)
+			continue
+		}
+		hasDate = true
+		d, err := rebase(d, now)
+		if err != nil {
+			fmt.Fprintf(stderr, "date: %v\n", err)
+			return 2
+		}
+		dateArgs = append(dateArgs, "-d", d)
+	}
+	if !hasDate {
+		dateArgs = append(dateArgs, "-d", nowDate)
 	}
 
-	cmd := exec.Command("/bin/date", os.Args[1:]...)
-	cmd.Stderr = os.Stderr
-	cmd.Stdout = os.Stdout
-	cmd.Stdin = os.Stdin
+	cmd := exec.Command("/bin/date", dateArgs...)
+	cmd.Stderr = stderr
+	cmd.Stdout = stdout
+	cmd.Stdin = stdin
 	if err := cmd.Run(); err != nil {
 		if exiterr, ok := err.(*exec.ExitError); ok {
-			// FIXME: replace with go 1.12: os.Exit(exiterr.ExitCode())
-			_ = exiterr
-			os.Exit(1)
+			return exiterr.ExitCode()
+		}
+		fmt.Fprintln(stderr, "Unexpected error when trying to execute date", err)
+		return 2
+	}
+	return 0
+}
+
+// relativeItemRe matches the items of dates relative to the current time, like "yesterday", "1 day ago" or
+// "+1 hour".
+var relativeItemRe = regexp.MustCompile(`^([+-]?\d+|now|today|yesterday|tomorrow|ago|next|last|this|` +
+	`(year|month|fortnight|week|day|hour|minute|min|second|sec)s?)$`)
+
+// yearRe matches a year, which makes a date independent of the current time.
+var yearRe = regexp.MustCompile(`\b\d{4}\b`)
+
+// rebase returns d with its items relative to the current time applied to now, seconds since epoch, instead.
+// Absolute dates are returned as is. Other dates, like "12:00" or "monday", are completed by date with parts of the
+// real current time: an error is returned for them.
+func rebase(d string, now int64) (string, error) {
+	if strings.HasPrefix(strings.TrimSpace(d), "@") || yearRe.MatchString(d) {
+		return d, nil
+	}
+
+	items := strings.Fields(strings.ToLower(d))
+	if len(items) == 0 {
+		return "", fmt.Errorf("the empty date %q is relative to the current day, which can't be mocked", d)
+	}
+	for _, item := range items {
+		if !relativeItemRe.MatchString(item) {
+			return "", fmt.Errorf("%q depends on the current time in a way which can't be mocked", d)
 		}
-		fmt.Println("Unexpected error when trying to execute date", err)
-		os.Exit(2)
 	}
-	os.Exit(0)
+	// the absolute date has its own timezone so that the relative items apply to the mocked instant
+	return time.Unix(now, 0).UTC().Format("2006-01-02 15:04:05 -0700") + " " + d, nil
 }
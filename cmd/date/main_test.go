@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRebase(t *testing.T) {
+	t.Parallel()
+
+	testCases := map[string]struct {
+		date string
+
+		want    string
+		wantErr bool
+	}{
+		"now":                  {date: "now", want: "2033-05-18 03:33:20 +0000 now"},
+		"yesterday":            {date: "yesterday", want: "2033-05-18 03:33:20 +0000 yesterday"},
+		"days ago":             {date: "1 day ago", want: "2033-05-18 03:33:20 +0000 1 day ago"},
+		"signed offset":        {date: "+1 hour", want: "2033-05-18 03:33:20 +0000 +1 hour"},
+		"mixed case":           {date: "Next Week", want: "2033-05-18 03:33:20 +0000 Next Week"},
+		"seconds since epoch":  {date: "@1588888888", want: "@1588888888"},
+		"absolute date":        {date: "2020-05-07 22:01:28", want: "2020-05-07 22:01:28"},
+		"absolute and offset":  {date: "2020-05-07 +1 day", want: "2020-05-07 +1 day"},
+		"time of current day":  {date: "12:00", wantErr: true},
+		"day of current week":  {date: "monday", wantErr: true},
+		"day of current year":  {date: "May 3", wantErr: true},
+		"start of current day": {date: "", wantErr: true},
+	}
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := rebase(tc.date, 2000000000)
+			if tc.wantErr {
+				assert.Error(t, err, "rebase should fail")
+				return
+			}
+			require.NoError(t, err, "rebase shouldn't fail")
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestRun(t *testing.T) {
+	orig, set := os.LookupEnv("TEST_MOCKDATE_NOW")
+	require.NoError(t, os.Setenv("TEST_MOCKDATE_NOW", "2000000000"))
+	defer func() {
+		if !set {
+			os.Unsetenv("TEST_MOCKDATE_NOW")
+			return
+		}
+		os.Setenv("TEST_MOCKDATE_NOW", orig)
+	}()
+
+	testCases := map[string]struct {
+		args []string
+
+		wantRet    int
+		wantStdout string
+	}{
+		"current time":         {args: []string{"-u", "+%s"}, wantStdout: "2000000000\n"},
+		"now":                  {args: []string{"-u", "-d", "now", "+%s"}, wantStdout: "2000000000\n"},
+		"yesterday":            {args: []string{"-u", "-d", "yesterday", "+%s"}, wantStdout: "1999913600\n"},
+		"relative date option": {args: []string{"-u", "--date=+1 hour", "+%s"}, wantStdout: "2000003600\n"},
+		"attached date":        {args: []string{"-u", "-d1 day ago", "+%s"}, wantStdout: "1999913600\n"},
+		"absolute date":        {args: []string{"-u", "-d", "@1588888888", "+%s"}, wantStdout: "1588888888\n"},
+		"unsupported date":     {args: []string{"-u", "-d", "12:00", "+%s"}, wantRet: 2},
+	}
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			ret := run(append([]string{"date"}, tc.args...), nil, &stdout, &stderr)
+
+			assert.Equal(t, tc.wantRet, ret, "unexpected exit code, error output: %s", stderr.String())
+			assert.Equal(t, tc.wantStdout, stdout.String(), "unexpected output")
+			if tc.wantRet != 0 {
+				assert.NotEmpty(t, stderr.String(), "failures should be reported on the error output")
+			}
+		})
+	}
+}
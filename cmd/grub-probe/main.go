@@ -1,58 +1,133 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
+	"io"
 	"os"
-	"os/exec"
+	"path/filepath"
 	"strings"
+
+	"github.com/ubuntu/grubmenugen-zfs-tests/internal/fakezfs"
+	"github.com/ubuntu/grubmenugen-zfs-tests/internal/faults"
+	"github.com/ubuntu/grubmenugen-zfs-tests/internal/grubprobe"
+	"github.com/ubuntu/grubmenugen-zfs-tests/internal/trace"
 )
 
 func main() {
-	if len(os.Args) < 2 {
+	trace.Main("grub-probe", faults.Inject("grub-probe", run))
+}
+
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	target := "fs"
+	var isDevice bool
+	var positional []string
+	for _, a := range args[1:] {
+		switch {
+		case strings.HasPrefix(a, "--target="):
+			target = strings.TrimPrefix(a, "--target=")
+		case a == "--device":
+			isDevice = true
+		default:
+			positional = append(positional, a)
+		}
+	}
+	if len(positional) == 0 {
 		// Avoid a panic if no args have been provided and return the same code than the real grub-probe
-		fmt.Fprintln(os.Stderr, `No path or device is specified.
+		fmt.Fprintln(stderr, `No path or device is specified.
 Usage: grub-probe [OPTION...] [OPTION]... [PATH|DEVICE]
 Try 'grub-probe --help' or 'grub-probe --usage' for more information.`)
-		os.Exit(64)
-	}
-
-	switch os.Args[1] {
-	case "--target=device":
-		cmd := exec.Command("/usr/sbin/grub-probe", os.Args[1:]...)
-		cmd.Stderr = os.Stderr
-		cmd.Stdout = os.Stdout
-		cmd.Stdin = os.Stdin
-		if err := cmd.Run(); err != nil {
-			if exiterr, ok := err.(*exec.ExitError); ok {
-				// FIXME: replace with go 1.12: os.Exit(exiterr.ExitCode())
-				_ = exiterr
-				os.Exit(1)
+		return 64
+	}
+
+	table, err := grubprobe.Load(os.Getenv(grubprobe.DevicesEnv))
+	if err != nil {
+		fmt.Fprintln(stderr, "grub-probe: error:", err)
+		return 1
+	}
+
+	// Only the first device is probed: all vdevs of a pool share the same answers.
+	dev := positional[0]
+	if !isDevice {
+		if dev, err = deviceOf(table, dev); err != nil {
+			fmt.Fprintln(stderr, "grub-probe: error:", err)
+			return 1
+		}
+		if target == "device" {
+			fmt.Fprintln(stdout, dev)
+			return 0
+		}
+		// Paths outside of the fake devices are on the host root filesystem
+		if _, ok := table.Lookup(dev); !ok {
+			switch target {
+			case "fs":
+				fmt.Fprintln(stdout, "ext2")
+				return 0
+			case "abstraction":
+				return 0
 			}
-			fmt.Println("Unexpected error when trying to execute grube-prove", err)
-			os.Exit(2)
-		}
-		os.Exit(0)
-	case "--device":
-		if !strings.HasPrefix(os.Args[3], "--target") {
-			break
-		}
-		v := map[string]string{
-			"abstraction":        "modfor_" + os.Args[2],
-			"compatibility_hint": "hd0,gpt2",
-			"fs":                 "ext2",
-			"fs_uuid":            "UUID-" + os.Args[2],
-			"partmap":            "gpt",
-			"hints_string":       "--hint-bios=hd0,gpt2 --hint-efi=hd0,gpt2",
-		}
-		fmt.Println(v[strings.Split(os.Args[3], "=")[1]])
-		os.Exit(0)
-	case "--target=abstraction":
-		os.Exit(0)
-	case "--target=fs":
-		fmt.Println("ext2")
-		os.Exit(0)
-	}
-
-	fmt.Fprintln(os.Stderr, "grub-probe called with unexpected arguments:", strings.Join(os.Args, " "))
-	os.Exit(2)
+		}
+	}
+
+	if e := table.Error(dev, target); e != "" {
+		fmt.Fprintf(stderr, "grub-probe: error: %s.\n", e)
+		return 1
+	}
+	v, err := table.Answer(dev, target)
+	if err != nil {
+		fmt.Fprintln(stderr, "grub-probe called with unexpected arguments:", strings.Join(args, " "))
+		return 2
+	}
+	fmt.Fprintln(stdout, v)
+	return 0
+}
+
+// deviceOf returns the device of path, from the userspace fake zfs backend mounts if any, or from the host mount
+// table. Datasets mounted by the zfs kernel module are on the first vdev of their pool.
+func deviceOf(table grubprobe.Table, path string) (string, error) {
+	if dir := os.Getenv(fakezfs.StateDirEnv); dir != "" {
+		s, err := fakezfs.Open(dir)
+		if err != nil {
+			return "", err
+		}
+		dev, ok := s.DeviceOf(path)
+		s.Close()
+		if ok {
+			return dev, nil
+		}
+	}
+
+	f, err := os.Open("/proc/mounts")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	path = filepath.Clean(path)
+	var device, target string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		if fields[1] != "/" && path != fields[1] && !strings.HasPrefix(path, fields[1]+"/") {
+			continue
+		}
+		if len(fields[1]) >= len(target) {
+			device, target = fields[0], fields[1]
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return "", err
+	}
+	if device == "" {
+		return "", fmt.Errorf("failed to get canonical path of `%s'", path)
+	}
+	if !strings.HasPrefix(device, "/") {
+		if dev, ok := table.PoolDevice(strings.SplitN(device, "/", 2)[0]); ok {
+			return dev, nil
+		}
+	}
+	return device, nil
 }
@@ -1,27 +1,121 @@
-// Fake version of mokutil that only returns the possible states of secure
-// boot when mokutil is called with --sb-state depending the whether the
-// system is EFI with secure boot, EFI w/o secure boot or a legacy (ie BIOS)
-// system.
+// Fake version of mokutil that answers depending on the secure boot state of the system, set in
+// TEST_MOKUTIL_SECUREBOOT: EFI with secure boot, EFI w/o secure boot, EFI in setup mode, a legacy (ie BIOS) system,
+// an EFI system without variables store, a crashing mokutil or one timing out after TEST_MOKUTIL_TIMEOUT.
+// Enrolled keys, listed and tested by --list-enrolled and --test-key, are set in TEST_MOKUTIL_ENROLLED_KEYS,
+// one key subject per line.
 // It doesn't call the real mokutil at all.
 package main
 
 import (
+	"crypto/sha1"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"strings"
+	"time"
+
+	"github.com/ubuntu/grubmenugen-zfs-tests/internal/trace"
 )
 
 func main() {
+	trace.Main("mokutil", run)
+}
+
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
 	switch sb := os.Getenv("TEST_MOKUTIL_SECUREBOOT"); sb {
-	case "efi-sb":
-		fmt.Println("SecureBoot enabled")
-	case "efi-nosb":
-		fmt.Println("SecureBoot disabled")
+	case "efi-sb", "efi-nosb", "setup-mode", "no-efivars":
 	case "legacy":
-		fmt.Fprint(os.Stderr, "EFI variables are not supported on this system")
-		os.Exit(1)
+		fmt.Fprint(stderr, "EFI variables are not supported on this system")
+		return 1
+	case "crash":
+		// exit code of a process killed by SIGSEGV, as reported by the shell
+		return 139
+	case "timeout":
+		// answers nothing, as if killed by timeout(1) once its delay is over
+		d, err := time.ParseDuration(os.Getenv("TEST_MOKUTIL_TIMEOUT"))
+		if err != nil {
+			fmt.Fprintf(stderr, "Invalid timeout: %v", err)
+			return 255
+		}
+		time.Sleep(d)
+		return 124
 	default:
-		fmt.Fprintf(os.Stderr, "Unknown value: %s", sb)
-		os.Exit(255)
+		fmt.Fprintf(stderr, "Unknown value: %s", sb)
+		return 255
+	}
+
+	if len(args) < 2 {
+		fmt.Fprintln(stderr, "mokutil called without arguments")
+		return 2
+	}
+
+	variable := "MokListRT"
+	if args[1] == "--sb-state" {
+		variable = "SecureBoot"
+	}
+	if os.Getenv("TEST_MOKUTIL_SECUREBOOT") == "no-efivars" {
+		fmt.Fprintf(stderr, "Failed to read \"%s\" variable: No such file or directory\n", variable)
+		return 255
+	}
+
+	var keys []string
+	if v := os.Getenv("TEST_MOKUTIL_ENROLLED_KEYS"); v != "" {
+		keys = strings.Split(v, "\n")
+	}
+
+	switch {
+	case args[1] == "--sb-state" && len(args) == 2:
+		switch os.Getenv("TEST_MOKUTIL_SECUREBOOT") {
+		case "efi-sb":
+			fmt.Fprintln(stdout, "SecureBoot enabled")
+		case "efi-nosb":
+			fmt.Fprintln(stdout, "SecureBoot disabled")
+		case "setup-mode":
+			fmt.Fprintln(stdout, "SecureBoot disabled")
+			fmt.Fprintln(stdout, "Platform is in Setup Mode")
+		}
+		return 0
+
+	case args[1] == "--list-enrolled" && len(args) == 2:
+		if len(keys) == 0 {
+			fmt.Fprintln(stdout, "MokListRT is empty")
+			return 1
+		}
+		for i, k := range keys {
+			fmt.Fprintf(stdout, "[key %d]\n", i+1)
+			fmt.Fprintf(stdout, "SHA1 Fingerprint: %s\n", fingerprint(k))
+			fmt.Fprintf(stdout, "        Subject: %s\n", k)
+		}
+		return 0
+
+	case args[1] == "--test-key" && len(args) == 3:
+		// key files only contain the subject of the key
+		b, err := ioutil.ReadFile(args[2])
+		if err != nil {
+			fmt.Fprintf(stderr, "Failed to open %s\n", args[2])
+			return 255
+		}
+		for _, k := range keys {
+			if k == strings.TrimSpace(string(b)) {
+				fmt.Fprintf(stdout, "%s is already enrolled\n", args[2])
+				return 0
+			}
+		}
+		fmt.Fprintf(stdout, "%s is not enrolled\n", args[2])
+		return 1
+	}
+
+	fmt.Fprintln(stderr, "mokutil called with unexpected arguments:", strings.Join(args, " "))
+	return 2
+}
+
+// fingerprint returns a stable SHA1 fingerprint for a key subject, formatted as mokutil does.
+func fingerprint(subject string) string {
+	h := sha1.Sum([]byte(subject))
+	var parts []string
+	for _, b := range h {
+		parts = append(parts, fmt.Sprintf("%02x", b))
 	}
-	os.Exit(0)
+	return strings.Join(parts, ":")
 }
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mokutil-")
+	require.NoError(t, err, "couldn't create temporary directory")
+	defer os.RemoveAll(dir)
+	enrolledKey := filepath.Join(dir, "enrolled.der")
+	require.NoError(t, ioutil.WriteFile(enrolledKey, []byte("CN=Ubuntu Secure Boot\n"), 0644))
+	otherKey := filepath.Join(dir, "other.der")
+	require.NoError(t, ioutil.WriteFile(otherKey, []byte("CN=Someone Else\n"), 0644))
+
+	testCases := map[string]struct {
+		state string
+		keys  string
+		args  []string
+
+		wantRet    int
+		wantStdout string
+		wantStderr string
+	}{
+		"secure boot enabled":  {state: "efi-sb", args: []string{"--sb-state"}, wantStdout: "SecureBoot enabled\n"},
+		"secure boot disabled": {state: "efi-nosb", args: []string{"--sb-state"}, wantStdout: "SecureBoot disabled\n"},
+		"setup mode":           {state: "setup-mode", args: []string{"--sb-state"}, wantStdout: "SecureBoot disabled\nPlatform is in Setup Mode\n"},
+		"legacy":               {state: "legacy", args: []string{"--sb-state"}, wantRet: 1, wantStderr: "EFI variables are not supported"},
+		"no efivars":           {state: "no-efivars", args: []string{"--sb-state"}, wantRet: 255, wantStderr: `Failed to read "SecureBoot" variable`},
+		"crash":                {state: "crash", args: []string{"--sb-state"}, wantRet: 139},
+		"timeout":              {state: "timeout", args: []string{"--sb-state"}, wantRet: 124},
+		"unknown state":        {state: "something", args: []string{"--sb-state"}, wantRet: 255, wantStderr: "Unknown value: something"},
+
+		"list enrolled keys": {state: "efi-sb", keys: "CN=Ubuntu Secure Boot\nCN=Other", args: []string{"--list-enrolled"},
+			wantStdout: "[key 1]\nSHA1 Fingerprint: " + fingerprint("CN=Ubuntu Secure Boot") + "\n        Subject: CN=Ubuntu Secure Boot\n" +
+				"[key 2]\nSHA1 Fingerprint: " + fingerprint("CN=Other") + "\n        Subject: CN=Other\n"},
+		"list no enrolled keys":          {state: "efi-sb", args: []string{"--list-enrolled"}, wantRet: 1, wantStdout: "MokListRT is empty\n"},
+		"list enrolled keys, no efivars": {state: "no-efivars", keys: "CN=Other", args: []string{"--list-enrolled"}, wantRet: 255, wantStderr: `Failed to read "MokListRT" variable`},
+		"test enrolled key":              {state: "efi-sb", keys: "CN=Other\nCN=Ubuntu Secure Boot", args: []string{"--test-key", enrolledKey}, wantStdout: enrolledKey + " is already enrolled\n"},
+		"test not enrolled key":          {state: "efi-sb", keys: "CN=Ubuntu Secure Boot", args: []string{"--test-key", otherKey}, wantRet: 1, wantStdout: otherKey + " is not enrolled\n"},
+		"test missing key file":          {state: "efi-sb", args: []string{"--test-key", filepath.Join(dir, "missing.der")}, wantRet: 255, wantStderr: "Failed to open"},
+
+		"no arguments":         {state: "efi-sb", wantRet: 2, wantStderr: "without arguments"},
+		"unexpected arguments": {state: "efi-sb", args: []string{"--sb-state", "extra"}, wantRet: 2, wantStderr: "unexpected arguments"},
+	}
+	for name, tc := range testCases {
+		tc := tc
+		// the mock is configured by the environment, shared by all subtests: they can't run in parallel
+		t.Run(name, func(t *testing.T) {
+			defer setEnv(t, "TEST_MOKUTIL_SECUREBOOT", tc.state)()
+			defer setEnv(t, "TEST_MOKUTIL_ENROLLED_KEYS", tc.keys)()
+			defer setEnv(t, "TEST_MOKUTIL_TIMEOUT", "10ms")()
+
+			var stdout, stderr bytes.Buffer
+			ret := run(append([]string{"mokutil"}, tc.args...), nil, &stdout, &stderr)
+
+			assert.Equal(t, tc.wantRet, ret, "unexpected exit code")
+			assert.Equal(t, tc.wantStdout, stdout.String(), "unexpected output")
+			if tc.wantStderr == "" {
+				assert.Empty(t, stderr.String(), "unexpected error output")
+			} else {
+				assert.True(t, strings.Contains(stderr.String(), tc.wantStderr), "error output %q should contain %q", stderr.String(), tc.wantStderr)
+			}
+		})
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	t.Parallel()
+
+	f := fingerprint("CN=Ubuntu Secure Boot")
+	assert.Len(t, f, 59, "SHA1 fingerprints are 20 bytes separated by colons")
+	assert.Equal(t, f, fingerprint("CN=Ubuntu Secure Boot"), "fingerprints should be stable")
+	assert.NotEqual(t, f, fingerprint("CN=Other"), "fingerprints should differ between subjects")
+}
+
+// setEnv sets the environment variable name to value and returns a function restoring it.
+func setEnv(t *testing.T, name, value string) func() {
+	t.Helper()
+
+	orig, set := os.LookupEnv(name)
+	require.NoError(t, os.Setenv(name, value), "couldn't set environment variable")
+	return func() {
+		if !set {
+			os.Unsetenv(name)
+			return
+		}
+		os.Setenv(name, orig)
+	}
+}
@@ -0,0 +1,39 @@
+// Fake version of umount which unmounts datasets and devices of the userspace fake zfs backend state, restoring
+// the previous content of the target directory.
+// Any other target, or all targets if the fake backend isn't used, is delegated to the real umount.
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+
+	"github.com/ubuntu/grubmenugen-zfs-tests/internal/fakezfs"
+	"github.com/ubuntu/grubmenugen-zfs-tests/internal/trace"
+)
+
+func main() {
+	trace.Main("umount", run, trace.WithClearedTarget())
+}
+
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	if dir := os.Getenv(fakezfs.StateDirEnv); dir != "" {
+		if ret := fakezfs.Run(dir, fakezfs.UmountCmd, args[1:], stdout, stderr); ret != fakezfs.NotHandled {
+			return ret
+		}
+	}
+
+	cmd := exec.Command("/bin/umount", args[1:]...)
+	cmd.Stderr = stderr
+	cmd.Stdout = stdout
+	cmd.Stdin = stdin
+	if err := cmd.Run(); err != nil {
+		if exiterr, ok := err.(*exec.ExitError); ok {
+			return exiterr.ExitCode()
+		}
+		fmt.Fprintln(stderr, "Unexpected error when trying to execute umount", err)
+		return 2
+	}
+	return 0
+}
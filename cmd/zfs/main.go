@@ -2,69 +2,90 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
 	"strings"
+
+	"github.com/ubuntu/grubmenugen-zfs-tests/internal/fakezfs"
+	"github.com/ubuntu/grubmenugen-zfs-tests/internal/faults"
+	"github.com/ubuntu/grubmenugen-zfs-tests/internal/trace"
 )
 
 const creationCmd = "zfs get -pH creation "
 const listCurrentSystemDatasetCmd = "zfs mount"
 
 func main() {
-	cmdLine := strings.Join(os.Args, " ")
-	args := os.Args[1:]
+	trace.Main("zfs", faults.Inject("zfs", run))
+}
+
+func run(argv []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	cmdLine := strings.Join(argv, " ")
+	args := argv[1:]
 
-	if strings.HasPrefix(cmdLine, creationCmd) && len(os.Args) == 5 {
+	// Answer from the userspace fake zfs backend state
+	if dir := os.Getenv(fakezfs.StateDirEnv); dir != "" {
+		var out bytes.Buffer
+		ret := fakezfs.Run(dir, fakezfs.Zfs, args, &out, stderr)
+		if err := writeOutput(cmdLine, &out, stdout); err != nil {
+			fmt.Fprintf(stderr, "Can't COPY zfs command: %v", err)
+			return 2
+		}
+		return ret
+	}
+
+	if strings.HasPrefix(cmdLine, creationCmd) && len(argv) == 5 {
 		args[2] = "com.ubuntu.zsys:creation.test"
 	}
 
 	cmd := exec.Command("/sbin/zfs", args...)
-	cmd.Stderr = os.Stderr
+	cmd.Stderr = stderr
 
 	outPipe, err := cmd.StdoutPipe()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Can't create stdout pipe: %v", err)
-		os.Exit(2)
+		fmt.Fprintf(stderr, "Can't create stdout pipe: %v", err)
+		return 2
 	}
 
 	if err := cmd.Start(); err != nil {
-		fmt.Fprintf(os.Stderr, "Unexpected error when trying to start zfs: %v", err)
-		os.Exit(2)
+		fmt.Fprintf(stderr, "Unexpected error when trying to start zfs: %v", err)
+		return 2
 	}
-	currentRootDataset := os.Getenv("TEST_MOCKZFS_CURRENT_ROOT_DATASET")
-	if cmdLine == listCurrentSystemDatasetCmd && currentRootDataset != "" {
-		s := bufio.NewScanner(outPipe)
-		for s.Scan() {
-			t := s.Text()
-			if strings.HasPrefix(t, currentRootDataset+" ") {
-				t = currentRootDataset + " /"
-			}
-			fmt.Println(t)
-		}
-		err = s.Err()
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Can't FILTER zfs command: %v", err)
-			os.Exit(2)
-		}
-	} else {
-		_, err = io.Copy(os.Stdout, outPipe)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Can't COPY zfs command: %v", err)
-			os.Exit(2)
-		}
+	if err := writeOutput(cmdLine, outPipe, stdout); err != nil {
+		fmt.Fprintf(stderr, "Can't COPY zfs command: %v", err)
+		return 2
 	}
 
-	cmd.Stdin = os.Stdin
+	cmd.Stdin = stdin
 	if err := cmd.Wait(); err != nil {
 		if exiterr, ok := err.(*exec.ExitError); ok {
 			// FIXME: replace with go 1.12: os.Exit(exiterr.ExitCode())
 			_ = exiterr
-			os.Exit(1)
+			return 1
+		}
+		fmt.Fprintf(stderr, "Unexpected error when trying to execute zfs: %v", err)
+		return 2
+	}
+	return 0
+}
+
+// writeOutput copies zfs output to stdout, remapping the current system root dataset mountpoint to /.
+func writeOutput(cmdLine string, out io.Reader, stdout io.Writer) error {
+	currentRootDataset := os.Getenv("TEST_MOCKZFS_CURRENT_ROOT_DATASET")
+	if cmdLine != listCurrentSystemDatasetCmd || currentRootDataset == "" {
+		_, err := io.Copy(stdout, out)
+		return err
+	}
+
+	s := bufio.NewScanner(out)
+	for s.Scan() {
+		t := s.Text()
+		if strings.HasPrefix(t, currentRootDataset+" ") {
+			t = currentRootDataset + " /"
 		}
-		fmt.Fprintf(os.Stderr, "Unexpected error when trying to execute zfs: %v", err)
-		os.Exit(2)
+		fmt.Fprintln(stdout, t)
 	}
-	os.Exit(0)
+	return s.Err()
 }
@@ -2,16 +2,24 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"strings"
+
+	"github.com/ubuntu/grubmenugen-zfs-tests/internal/fakezfs"
+	"github.com/ubuntu/grubmenugen-zfs-tests/internal/trace"
 )
 
 const importCmd = "zpool import -f -a"
 
 func main() {
-	cmdLine := strings.Join(os.Args, " ")
-	args := os.Args[1:]
+	trace.Main("zpool", run)
+}
+
+func run(argv []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	cmdLine := strings.Join(argv, " ")
+	args := argv[1:]
 
 	if strings.HasPrefix(cmdLine, importCmd) {
 		dir, ok := os.LookupEnv("TEST_POOL_DIR")
@@ -21,18 +29,23 @@ func main() {
 		args = append(args, "-d", dir)
 	}
 
+	// Answer from the userspace fake zfs backend state
+	if dir := os.Getenv(fakezfs.StateDirEnv); dir != "" {
+		return fakezfs.Run(dir, fakezfs.Zpool, args, stdout, stderr)
+	}
+
 	cmd := exec.Command("/sbin/zpool", args...)
-	cmd.Stderr = os.Stderr
-	cmd.Stdout = os.Stdout
-	cmd.Stdin = os.Stdin
+	cmd.Stderr = stderr
+	cmd.Stdout = stdout
+	cmd.Stdin = stdin
 	if err := cmd.Run(); err != nil {
 		if exiterr, ok := err.(*exec.ExitError); ok {
 			// FIXME: replace with go 1.12: os.Exit(exiterr.ExitCode())
 			_ = exiterr
-			os.Exit(1)
+			return 1
 		}
-		fmt.Println("Unexpected error when trying to execute zpool", err)
-		os.Exit(2)
+		fmt.Fprintln(stdout, "Unexpected error when trying to execute zpool", err)
+		return 2
 	}
-	os.Exit(0)
+	return 0
 }
@@ -0,0 +1,251 @@
+package main_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ubuntu/grubmenugen-zfs-tests/internal/bootlist"
+	"github.com/ubuntu/grubmenugen-zfs-tests/internal/grubcfg"
+	"github.com/ubuntu/grubmenugen-zfs-tests/internal/metamenu"
+)
+
+// TestStagesConsistency checks that the reference bootlist, metamenu and grubmenu of each test case agree with
+// each other: the menus only boot what was found on disk, and everything bootable found on disk is in the menus.
+func TestStagesConsistency(t *testing.T) {
+	t.Parallel()
+	defer registerTest(t)()
+	// golden files are regenerated by previous stages in update mode
+	waitForTest(t, "TestGrubMenu")
+
+	testCases := newTestCases(t)
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			for _, f := range []string{"bootlist", "metamenu", "grubmenu"} {
+				if _, err := os.Stat(filepath.Join(tc.path, f)); os.IsNotExist(err) {
+					t.Skipf("no reference %s: test case only declares expectations", f)
+				}
+			}
+
+			var bl []bootlist.Entry
+			var mm []metamenu.Entry
+			var gm *grubcfg.Menu
+			parseReference(t, filepath.Join(tc.path, "bootlist"), func(f *os.File) (err error) {
+				bl, err = bootlist.Parse(f)
+				return err
+			})
+			parseReference(t, filepath.Join(tc.path, "metamenu"), func(f *os.File) (err error) {
+				mm, err = metamenu.Parse(f)
+				return err
+			})
+			parseReference(t, filepath.Join(tc.path, "grubmenu"), func(f *os.File) (err error) {
+				gm, err = grubcfg.Parse(f)
+				return err
+			})
+
+			for _, d := range checkBootlistToMetaMenu(bl, mm) {
+				t.Error(d)
+			}
+			for _, d := range checkMetaMenuToGrubMenu(mm, gm) {
+				t.Error(d)
+			}
+		})
+	}
+}
+
+// parseReference opens the reference file at path and parses it with parse.
+func parseReference(t *testing.T, path string, parse func(f *os.File) error) {
+	t.Helper()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal("couldn't open reference file", err)
+	}
+	defer f.Close()
+
+	if err := parse(f); err != nil {
+		t.Fatalf("invalid reference file %q: %v", path, err)
+	}
+}
+
+// checkBootlistToMetaMenu returns the inconsistencies between a bootlist and the metamenu generated from it.
+func checkBootlistToMetaMenu(bl []bootlist.Entry, mm []metamenu.Entry) []string {
+	var diffs []string
+
+	datasets := make(map[string]bootlist.Entry)
+	for _, b := range bl {
+		datasets[b.Dataset] = b
+	}
+
+	// every menu entry boots a kernel and its initrd found on a listed dataset
+	inMenu := make(map[string]bool)
+	advanced := make(map[string]bool)
+	mains := make(map[string]metamenu.Entry)
+	for _, m := range mm {
+		label := fmt.Sprintf("metamenu %s entry %q (%s)", m.Kind, m.Name, m.Dataset)
+		b, ok := datasets[m.Dataset]
+		if !ok {
+			diffs = append(diffs, fmt.Sprintf("%s: dataset not in bootlist", label))
+			continue
+		}
+		inMenu[m.Dataset] = true
+
+		if m.Device != b.Device {
+			diffs = append(diffs, fmt.Sprintf("%s: device %q differs from bootlist %q", label, m.Device, b.Device))
+		}
+		if m.Zsys != b.Zsys {
+			diffs = append(diffs, fmt.Sprintf("%s: zsys %t differs from bootlist %t", label, m.Zsys, b.Zsys))
+		}
+		i := indexOf(b.Kernels, m.Kernel)
+		if i < 0 {
+			diffs = append(diffs, fmt.Sprintf("%s: kernel %q not in bootlist", label, m.Kernel))
+			continue
+		}
+		if i < len(b.Initrds) && m.Initrd != b.Initrds[i] {
+			diffs = append(diffs, fmt.Sprintf("%s: initrd %q doesn't match bootlist initrd %q for kernel %q",
+				label, m.Initrd, b.Initrds[i], m.Kernel))
+		}
+
+		switch m.Kind {
+		case metamenu.Main:
+			mains[m.MachineID] = m
+			if isSnapshot(m.Dataset) {
+				diffs = append(diffs, fmt.Sprintf("%s: main entry boots a snapshot", label))
+			}
+		case metamenu.Advanced:
+			advanced[m.Dataset+" "+m.Kernel] = true
+		}
+	}
+
+	// history entries are snapshots or clones of their machine main system
+	for _, m := range mm {
+		if m.Kind != metamenu.History {
+			continue
+		}
+		main, ok := mains[m.MachineID]
+		if !ok {
+			diffs = append(diffs, fmt.Sprintf("metamenu history entry %q (%s): no main entry for machine %s",
+				m.Name, m.Dataset, m.MachineID))
+			continue
+		}
+		if m.Dataset == main.Dataset {
+			diffs = append(diffs, fmt.Sprintf("metamenu history entry %q (%s): is the main system of machine %s",
+				m.Name, m.Dataset, m.MachineID))
+		}
+	}
+
+	// every kernel of a main system is in the advanced entries, and every dataset of a machine with a menu is listed
+	for _, b := range bl {
+		main, ok := mains[b.MachineID]
+		if !ok {
+			continue
+		}
+		if main.Dataset == b.Dataset {
+			for _, k := range b.Kernels {
+				if !advanced[b.Dataset+" "+k] {
+					diffs = append(diffs, fmt.Sprintf("bootlist %s: kernel %q not in any advanced entry", b.Dataset, k))
+				}
+			}
+		}
+		if !inMenu[b.Dataset] {
+			diffs = append(diffs, fmt.Sprintf("bootlist %s: not in any menu entry of machine %s", b.Dataset, b.MachineID))
+		}
+	}
+
+	return diffs
+}
+
+// bootTarget is what a grub menu entry boots.
+type bootTarget struct {
+	dataset, kernel, initrd string
+}
+
+func (b bootTarget) String() string {
+	return fmt.Sprintf("%s with %s and %s", b.dataset, b.kernel, b.initrd)
+}
+
+// checkMetaMenuToGrubMenu returns the inconsistencies between a metamenu and the grub menu generated from it.
+func checkMetaMenuToGrubMenu(mm []metamenu.Entry, gm *grubcfg.Menu) []string {
+	var diffs []string
+
+	// entries per enclosing submenu id, "" being the top level menu
+	booted := make(map[string]map[bootTarget]bool)
+	gm.Walk(func(parents []*grubcfg.Item, it *grubcfg.Item) {
+		if it.Submenu {
+			return
+		}
+		id, target := grubEntryTarget(parents, it)
+		if booted[id] == nil {
+			booted[id] = make(map[bootTarget]bool)
+		}
+		booted[id][target] = true
+	})
+
+	// each metamenu entry has its grub entries at the expected place
+	expected := make(map[string]map[bootTarget]bool)
+	for _, m := range mm {
+		var id string
+		switch m.Kind {
+		case metamenu.Advanced:
+			id = "gnulinux-advanced-" + m.Dataset
+		case metamenu.History:
+			// only zsys systems can revert to a previous state
+			if !m.Zsys {
+				continue
+			}
+			id = "gnulinux-history-" + m.Dataset
+		}
+		if expected[id] == nil {
+			expected[id] = make(map[bootTarget]bool)
+		}
+		target := bootTarget{dataset: m.Dataset, kernel: m.Kernel, initrd: m.Initrd}
+		expected[id][target] = true
+
+		if !booted[id][target] {
+			where := "top level menu"
+			if id != "" {
+				where = fmt.Sprintf("submenu %q", id)
+			}
+			diffs = append(diffs, fmt.Sprintf("metamenu %s entry %q: no grub entry booting %s in %s", m.Kind, m.Name, target, where))
+		}
+	}
+
+	// each grub entry comes from a metamenu entry
+	gm.Walk(func(parents []*grubcfg.Item, it *grubcfg.Item) {
+		if it.Submenu {
+			return
+		}
+		id, target := grubEntryTarget(parents, it)
+		if !expected[id][target] {
+			diffs = append(diffs, fmt.Sprintf("grub entry %q: boots %s, which is not in the metamenu", grubcfg.Path(parents, it), target))
+		}
+	})
+
+	return diffs
+}
+
+// grubEntryTarget returns what a grub entry boots and the id of its enclosing submenu, empty at top level.
+func grubEntryTarget(parents []*grubcfg.Item, it *grubcfg.Item) (string, bootTarget) {
+	var id string
+	if len(parents) > 0 {
+		id = parents[len(parents)-1].ID
+	}
+	return id, bootTarget{dataset: it.RootDataset, kernel: it.Kernel, initrd: strings.Join(it.Initrds, " ")}
+}
+
+func indexOf(l []string, s string) int {
+	for i, v := range l {
+		if v == s {
+			return i
+		}
+	}
+	return -1
+}
+
+func isSnapshot(dataset string) bool {
+	return strings.Contains(dataset, "@")
+}
@@ -1,29 +1,41 @@
 package main_test
 
 import (
-	"context"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strconv"
 	"strings"
-	"syscall"
 	"testing"
 	"time"
 
 	zfs "github.com/bicomsystems/go-libzfs"
 	"github.com/otiai10/copy"
+	"github.com/ubuntu/grubmenugen-zfs-tests/internal/fakezfs"
+	"github.com/ubuntu/grubmenugen-zfs-tests/internal/faults"
+	"github.com/ubuntu/grubmenugen-zfs-tests/internal/grubprobe"
+	"github.com/ubuntu/grubmenugen-zfs-tests/internal/trace"
 	"gopkg.in/yaml.v2"
 )
 
 const mB = 1024 * 1024
 
+// defaultClock is the current time of test systems not declaring any: a date far in the future
+// (2033-05-18T03:33:20+00:00).
+var defaultClock = time.Unix(2000000000, 0)
+
 type FakeDevices struct {
 	Devices []FakeDevice
+	Mokutil MokutilScenario
+	// Clock is the current time of the test system. It defaults to defaultClock.
+	Clock time.Time
+	// Faults alter the answers of the mocks to some invocations.
+	Faults []faults.Fault
+	Expect *Expectations
 	*testing.T
+	backend systemBackend
 }
 
 type FstabEntry struct {
@@ -36,29 +48,225 @@ type FakeDevice struct {
 	Names   []string
 	Type    string
 	Content map[string]string
-	ZFS     struct {
+	// GrubProbe are the grub-probe answers for each device file.
+	GrubProbe grubprobe.Answers `yaml:"grub_probe"`
+	ZFS       struct {
 		PoolName string `yaml:"pool_name"`
-		Datasets []struct {
-			Name                string
-			KeepImported        bool `yaml:"keep_imported"`
-			Content             map[string]string
-			IsCurrentSystemRoot bool      `yaml:"is_current_system_root"`
-			ZsysBootfs          bool      `yaml:"zsys_bootfs"`
-			LastUsed            time.Time `yaml:"last_used"`
-			LastBootedKernel    string    `yaml:"last_booted_kernel"`
-			Mountpoint          string
-			CanMount            string
-			Snapshots           []struct {
-				Name             string
-				Content          map[string]string
-				Fstab            []FstabEntry
-				CreationDate     time.Time `yaml:"creation_date"`
-				LastBootedKernel string    `yaml:"last_booted_kernel"`
+		Datasets []FakeDataset
+		// Zsys are machines installed by zsys, whose whole dataset tree is generated after Datasets.
+		Zsys         []ZsysMachine
+		KeepImported bool `yaml:"keep_imported"`
+		// Topology is the vdev tree of the pool. Without one, devices are mirrored.
+		Topology []TopologyVdev
+		// Features are the only features enabled on the pool. By default, all of them are, or the ones allowed by
+		// its compatibility property.
+		Features       []string
+		PoolProperties map[string]string `yaml:"pool_properties"`
+		// FilesystemProperties are the properties of the root dataset of the pool, including user ones.
+		FilesystemProperties map[string]string `yaml:"filesystem_properties"`
+		// State is the state of the pool when 10_linux_zfs imports it, like degraded or foreign.
+		State      string
+		Corruption Corruption
+	}
+}
+
+// FakeDataset is a dataset of a zfs pool, with its content and snapshots.
+type FakeDataset struct {
+	Name                string
+	KeepImported        bool `yaml:"keep_imported"`
+	Content             map[string]string
+	IsCurrentSystemRoot bool      `yaml:"is_current_system_root"`
+	ZsysBootfs          bool      `yaml:"zsys_bootfs"`
+	LastUsed            time.Time `yaml:"last_used"`
+	LastBootedKernel    string    `yaml:"last_booted_kernel"`
+	Mountpoint          string
+	CanMount            string
+	// Encryption encrypts the dataset with its own key, like aes-256-gcm or on.
+	Encryption  string
+	KeyFormat   string `yaml:"keyformat"`
+	KeyLocation string `yaml:"keylocation"`
+	// KeyLoaded keeps the key loaded in pools staying imported. Exported pools have their keys unloaded.
+	KeyLoaded bool `yaml:"key_loaded"`
+	// CloneOf creates the dataset as a clone of a snapshot of a previous dataset of the pool, like
+	// ROOT/ubuntu_123456@snap. Promote then swaps it with its origin once its snapshots are taken.
+	CloneOf string `yaml:"clone_of"`
+	Promote bool
+	// Properties and UserProperties are set once the dataset content is written.
+	Properties     map[string]string
+	UserProperties map[string]string `yaml:"user_properties"`
+	Snapshots      []FakeSnapshot
+	// Bookmarks are created once all snapshots are taken, from the snapshot of the same name by default.
+	Bookmarks []struct {
+		Name     string
+		Snapshot string
+	}
+	Fstab []FstabEntry
+}
+
+// FakeSnapshot is a snapshot of a dataset, taken once its content is replaced.
+type FakeSnapshot struct {
+	Name             string
+	Content          map[string]string
+	Fstab            []FstabEntry
+	CreationDate     time.Time `yaml:"creation_date"`
+	LastBootedKernel string    `yaml:"last_booted_kernel"`
+	Properties       map[string]string
+	UserProperties   map[string]string `yaml:"user_properties"`
+}
+
+// TopologyVdev is a top level vdev of a pool, made of some of the device names of its definition.
+type TopologyVdev struct {
+	// Type is disk, mirror, raidz1, raidz2, raidz3, or one of the log, special and cache allocation classes. Log and
+	// special devices are mirrored, cache ones are striped.
+	Type    string
+	Devices []string
+}
+
+// Pool states reproduced by removing vdevs once the pool is exported.
+const (
+	// poolDegraded mirrors lost one of their vdevs.
+	poolDegraded = "degraded"
+	// poolMissingVdev pools are striped on their vdevs, and lost one of them.
+	poolMissingVdev = "missing-vdev"
+)
+
+// checkPoolState fails the test if the pool state of device is unknown or doesn't fit its vdevs. It skips it if the
+// state can't be reproduced with the zfs kernel module.
+func (fdevice FakeDevices) checkPoolState(device FakeDevice) {
+	switch device.ZFS.State {
+	case "":
+	case poolDegraded, poolMissingVdev:
+		if len(device.Names) < 2 {
+			fdevice.Fatalf("pool %q needs at least 2 devices to be %s", device.ZFS.PoolName, device.ZFS.State)
+		}
+	case fakezfs.PoolForeign, fakezfs.PoolReadOnly, fakezfs.PoolLocked:
+		if *kernelZFS {
+			fdevice.Skipf("%s pools are only simulated by the userspace backend", device.ZFS.State)
+		}
+	default:
+		fdevice.Fatalf("unknown state %q for pool %q", device.ZFS.State, device.ZFS.PoolName)
+	}
+}
+
+// setPoolState brings an exported pool in the state declared for device, which vdevs are devPaths.
+func (fdevice FakeDevices) setPoolState(device FakeDevice, devPaths []string) {
+	switch device.ZFS.State {
+	case "":
+	case poolDegraded, poolMissingVdev:
+		if err := os.Remove(devPaths[len(devPaths)-1]); err != nil {
+			fdevice.Fatalf("couldn't remove vdev of pool %q: %v", device.ZFS.PoolName, err)
+		}
+	default:
+		if err := fdevice.backend.setPoolState(device.ZFS.PoolName, device.ZFS.State); err != nil {
+			fdevice.Fatalf("couldn't set state of pool %q: %v", device.ZFS.PoolName, err)
+		}
+	}
+}
+
+// vdevTree returns the vdev tree of the pool of device, which vdevs are devPaths.
+func (fdevice FakeDevices) vdevTree(device FakeDevice, devPaths []string) zfs.VDevTree {
+	paths := make(map[string]string)
+	for i, n := range device.Names {
+		paths[n] = devPaths[i]
+	}
+	files := func(names []string) []zfs.VDevTree {
+		var devs []zfs.VDevTree
+		for _, n := range names {
+			p, ok := paths[n]
+			if !ok {
+				fdevice.Fatalf("unknown device %q in topology of pool %q", n, device.ZFS.PoolName)
+			}
+			devs = append(devs, zfs.VDevTree{Type: zfs.VDevTypeFile, Path: p})
+		}
+		return devs
+	}
+
+	vdev := zfs.VDevTree{Type: zfs.VDevTypeRoot}
+	if len(device.ZFS.Topology) == 0 {
+		// Top level vdevs are striped, several devices are mirrored unless a vdev should be missing.
+		vdev.Devices = files(device.Names)
+		if len(vdev.Devices) > 1 && device.ZFS.State != poolMissingVdev {
+			vdev.Devices = []zfs.VDevTree{{Type: zfs.VDevTypeMirror, Devices: vdev.Devices}}
+		}
+		return vdev
+	}
+
+	for _, v := range device.ZFS.Topology {
+		devs := files(v.Devices)
+		if len(devs) == 0 {
+			fdevice.Fatalf("%s vdev without devices in topology of pool %q", v.Type, device.ZFS.PoolName)
+		}
+		switch v.Type {
+		case "disk":
+			if len(devs) > 1 {
+				fdevice.Fatalf("disk vdevs have one device in topology of pool %q, got %s", device.ZFS.PoolName, v.Devices)
+			}
+			vdev.Devices = append(vdev.Devices, devs[0])
+		case "mirror":
+			vdev.Devices = append(vdev.Devices, zfs.VDevTree{Type: zfs.VDevTypeMirror, Devices: devs})
+		case "raidz1", "raidz2", "raidz3":
+			parity, _ := strconv.Atoi(strings.TrimPrefix(v.Type, "raidz"))
+			vdev.Devices = append(vdev.Devices, zfs.VDevTree{Type: zfs.VDevTypeRaidz, Parity: uint(parity), Devices: devs})
+		case "log", "special":
+			top := devs[0]
+			if len(devs) > 1 {
+				top = zfs.VDevTree{Type: zfs.VDevTypeMirror, Devices: devs}
+			}
+			vdev.Devices = append(vdev.Devices, zfs.VDevTree{Type: zfs.VDevType(v.Type), Devices: []zfs.VDevTree{top}})
+		case "cache":
+			vdev.L2Cache = append(vdev.L2Cache, devs...)
+		default:
+			fdevice.Fatalf("unknown vdev type %q in topology of pool %q", v.Type, device.ZFS.PoolName)
+		}
+	}
+	return vdev
+}
+
+// setProperties sets the native properties, then the user properties, of dataset in name order.
+func (fdevice FakeDevices) setProperties(dataset string, props, userProps map[string]string) {
+	for _, k := range sortedKeys(props) {
+		if strings.Contains(k, ":") {
+			fdevice.Fatalf("%q is a user property of %q: declare it in user_properties", k, dataset)
+		}
+		if err := fdevice.backend.setProperty(dataset, k, props[k]); err != nil {
+			fdevice.Fatalf("couldn't set property %q of %q: %v", k, dataset, err)
+		}
+	}
+	for _, k := range sortedKeys(userProps) {
+		if !strings.Contains(k, ":") {
+			fdevice.Fatalf("user property %q of %q should be of the form module:property", k, dataset)
+		}
+		if err := fdevice.backend.setUserProperty(dataset, k, userProps[k]); err != nil {
+			fdevice.Fatalf("couldn't set user property %q of %q: %v", k, dataset, err)
+		}
+	}
+}
+
+// probeAnswers returns the grub-probe answers of the device file name of device: the declared ones, completed by
+// the ones of its vdev in the pool topology. GRUB can't read pools with features outside of the grub2 compatibility
+// set, like allocation_classes which special vdevs need.
+func probeAnswers(device FakeDevice, name string) grubprobe.Answers {
+	compatibility := device.ZFS.PoolProperties["compatibility"]
+	restricted := device.ZFS.Features != nil || (compatibility != "" && compatibility != "off")
+	if len(device.ZFS.Topology) == 0 && !restricted {
+		return device.GrubProbe
+	}
+
+	defaults := grubprobe.Answers{FS: "zfs"}
+	if len(fakezfs.IncompatibleFeatures("grub2", device.ZFS.Features)) > 0 {
+		defaults.Error = "unknown filesystem"
+	}
+	for _, v := range device.ZFS.Topology {
+		if v.Type == "special" {
+			defaults.Error = "unknown filesystem"
+		}
+		for _, d := range v.Devices {
+			if d == name && v.Type != "disk" {
+				defaults.Abstraction = v.Type
 			}
-			Fstab []FstabEntry
 		}
-		KeepImported bool `yaml:"keep_imported"`
 	}
+	return device.GrubProbe.Or(defaults)
 }
 
 // newFakeDevices returns a FakeDevices from a yaml file
@@ -75,43 +283,241 @@ func newFakeDevices(t *testing.T, path string) FakeDevices {
 	return devices
 }
 
-// shuffleFile shuffles chunks of filePath
-// NOTE: There is a risk of flaky test because the pool is closed after the device has been altered.
-// If it's the case revisit the moment this function is called to call it after the defered pool.Close
-func shuffleFile(fdevice FakeDevices, filePath string) {
-	var chunks int64 = 100
+// now returns the current time of the test system.
+func (fdevice FakeDevices) now() time.Time {
+	if fdevice.Clock.IsZero() {
+		return defaultClock
+	}
+	return fdevice.Clock
+}
+
+// clockEnv returns the environment variable for the date mock to answer with the current time of the test system.
+func (fdevice FakeDevices) clockEnv() string {
+	return "TEST_MOCKDATE_NOW=" + strconv.FormatInt(fdevice.now().Unix(), 10)
+}
+
+// grubProbeDevicesFile returns the path of the device table the grub-probe mock answers from for a test.
+func grubProbeDevicesFile(testDir string) string {
+	return filepath.Join(testDir, "grub-probe.json")
+}
+
+// faultsFile returns the path of the faults file the mocks read for a test.
+func faultsFile(testDir string) string {
+	return filepath.Join(testDir, "faults.json")
+}
+
+// assertFaultsFired checks that each declared fault matched at least one mock invocation recorded in traceFile.
+// Otherwise, the test case wouldn't check how 10_linux_zfs degrades.
+func (fdevice FakeDevices) assertFaultsFired(traceFile string) {
+	if len(fdevice.Faults) == 0 {
+		return
+	}
+
+	records, err := trace.Load(traceFile)
+	if err != nil && !os.IsNotExist(err) {
+		fdevice.Fatal("couldn't load mocks trace", err)
+	}
+	for _, f := range fdevice.Faults {
+		var fired bool
+		for _, r := range records {
+			if f.Matches(r.Command, r.Args) {
+				fired = true
+				break
+			}
+		}
+		if !fired {
+			fdevice.Errorf("%s fault on %s %q never fired", f.Kind, f.Command, f.Args)
+		}
+	}
+}
+
+// keys are the content of the key files of encrypted datasets, per key format.
+var keys = map[string]string{
+	"passphrase": "grubzfs-testsuite",
+	"hex":        strings.Repeat("0123456789abcdef", 4),
+	"raw":        strings.Repeat("k", 32),
+}
+
+// writeKeyFile writes the key of an encrypted dataset in testDir and returns its path.
+func writeKeyFile(testDir, dataset, keyformat string) (string, error) {
+	key, ok := keys[keyformat]
+	if !ok {
+		return "", fmt.Errorf("unknown key format %q", keyformat)
+	}
+	p := filepath.Join(testDir, "keys", strings.Replace(dataset, "/", "_", -1)+".key")
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return "", fmt.Errorf("couldn't create key directory: %v", err)
+	}
+	if err := ioutil.WriteFile(p, []byte(key), 0600); err != nil {
+		return "", fmt.Errorf("couldn't write key file: %v", err)
+	}
+	return p, nil
+}
+
+// Corruption damages the device files of a pool once it's exported.
+type Corruption struct {
+	// Mode is how devices are damaged, like fakezfs.CorruptLabels.
+	Mode string
+	// Seed generates the bytes written on damaged areas. It defaults to defaultCorruptionSeed.
+	Seed int64
+	// Devices are the names of the damaged devices, all devices of the pool by default.
+	Devices []string
+}
+
+// defaultCorruptionSeed is the seed of corruptions not declaring any.
+const defaultCorruptionSeed = 1
+
+// corruptedDeviceName is the name of devices whose labels are wiped when their pool doesn't declare any corruption.
+const corruptedDeviceName = "corrupted"
+
+// Layout of the 4 labels of a vdev: 2 at the start and 2 at the end of the device, each ending with the uberblock ring.
+const (
+	vdevLabelSize       = 256 * 1024
+	uberblockRingOffset = 128 * 1024
+	uberblockRingSize   = 128 * 1024
+)
+
+// corruption returns the corruption of the pool of device, if any.
+func (device FakeDevice) corruption() Corruption {
+	c := device.ZFS.Corruption
+	if c.Mode == "" {
+		for _, name := range device.Names {
+			if name == corruptedDeviceName {
+				c = Corruption{Mode: fakezfs.CorruptLabels, Devices: []string{name}}
+			}
+		}
+	}
+	if c.Mode == "" {
+		return c
+	}
+	if c.Seed == 0 {
+		c.Seed = defaultCorruptionSeed
+	}
+	if len(c.Devices) == 0 {
+		c.Devices = device.Names
+	}
+	return c
+}
+
+// unloadKeys unloads the keys of the encrypted datasets of the imported pool of device which don't keep it loaded.
+func (fdevice FakeDevices) unloadKeys(device FakeDevice) {
+	for _, dataset := range device.ZFS.Datasets {
+		if dataset.Encryption == "" || dataset.Encryption == "off" || dataset.KeyLoaded {
+			continue
+		}
+		name := device.ZFS.PoolName + "/" + dataset.Name
+		if err := fdevice.backend.unloadKey(name); err != nil {
+			fdevice.Fatalf("couldn't unload key of dataset %q: %v", name, err)
+		}
+	}
+}
+
+// checkCorruption fails the test if the corruption of the pool of device is unknown or targets other devices.
+func (fdevice FakeDevices) checkCorruption(device FakeDevice) {
+	c := device.corruption()
+	switch c.Mode {
+	case "", fakezfs.CorruptLabels, fakezfs.CorruptUberblocks, fakezfs.CorruptTruncate:
+	default:
+		fdevice.Fatalf("unknown corruption %q for pool %q", c.Mode, device.ZFS.PoolName)
+	}
+	for _, name := range c.Devices {
+		var found bool
+		for _, n := range device.Names {
+			if n == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fdevice.Fatalf("can't corrupt %q: not a device of pool %q", name, device.ZFS.PoolName)
+		}
+	}
+}
 
-	f, err := os.OpenFile(filePath, os.O_RDWR, os.ModeAppend)
+// corrupt damages the devices of the exported pool of device, in testDir, as declared.
+func (fdevice FakeDevices) corrupt(device FakeDevice, testDir string) {
+	c := device.corruption()
+	if c.Mode == "" {
+		return
+	}
+	for _, name := range c.Devices {
+		p := filepath.Join(testDir, name+".disk")
+		fdevice.Logf("corrupting %s of pool %q: %s, seed %d", name, device.ZFS.PoolName, c.Mode, c.Seed)
+		if err := fdevice.backend.corrupt(device.ZFS.PoolName, p, c.Mode, c.Seed); err != nil {
+			fdevice.Fatalf("couldn't corrupt %q: %v", p, err)
+		}
+	}
+}
+
+// corruptDevice damages the vdev file at path as described by mode, writing bytes generated from seed, so that the
+// result is the same on every run.
+func corruptDevice(path, mode string, seed int64) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
 	if err != nil {
-		fdevice.Fatal("Failed to open device file", err)
+		return fmt.Errorf("failed to open device file: %v", err)
 	}
 	defer f.Close()
 
-	s, err := f.Stat()
+	fi, err := f.Stat()
 	if err != nil {
-		fdevice.Fatal("Failed to stat file", err)
+		return fmt.Errorf("failed to stat file: %v", err)
+	}
+	// labels at the end of the device are aligned on the label size
+	size := fi.Size() &^ (vdevLabelSize - 1)
+	if size < 4*vdevLabelSize {
+		return fmt.Errorf("device is too small to hold zfs labels: %d bytes", fi.Size())
+	}
+	labels := []int64{0, vdevLabelSize, size - 2*vdevLabelSize, size - vdevLabelSize}
+
+	r := rand.New(rand.NewSource(seed))
+	scramble := func(offset, length int64) error {
+		b := make([]byte, length)
+		r.Read(b)
+		if _, err := f.WriteAt(b, offset); err != nil {
+			return fmt.Errorf("failed to write to file: %v", err)
+		}
+		return nil
 	}
 
-	chunkSize := s.Size() / chunks
-	b := make([]byte, int(chunkSize))
-
-	var i int64
-	for i = 1; i < chunks; i++ {
-		if _, err := f.ReadAt(b, i*chunkSize); err != nil {
-			fdevice.Fatal("Failed to read file", err)
+	switch mode {
+	case fakezfs.CorruptLabels:
+		for _, l := range labels {
+			if err := scramble(l, vdevLabelSize); err != nil {
+				return err
+			}
 		}
-		rand.Shuffle(len(b), func(x, y int) { b[x], b[y] = b[y], b[x] })
-		if _, err := f.WriteAt(b, i*chunkSize); err != nil {
-			fdevice.Fatal("Failed to write to file", err)
+	case fakezfs.CorruptUberblocks:
+		for _, l := range labels {
+			if err := scramble(l+uberblockRingOffset, uberblockRingSize); err != nil {
+				return err
+			}
 		}
+	case fakezfs.CorruptTruncate:
+		// the labels at the end of the device are lost
+		if err := f.Truncate(size / 2); err != nil {
+			return fmt.Errorf("failed to truncate file: %v", err)
+		}
+	default:
+		return fmt.Errorf("unknown corruption %q", mode)
 	}
+	return f.Sync()
 }
 
 // create on disk mock devices as files and return the main dataset
 // which is set as root, if any
-func (fdevice FakeDevices) create(path string) string {
+func (fdevice *FakeDevices) create(path string) string {
 	var systemRootDataset string
 
+	fdevice.backend = newSystemBackend(path)
+	backend := fdevice.backend
+	var probeTable grubprobe.Table
+
+	for i, device := range fdevice.Devices {
+		fdevice.checkPoolState(device)
+		fdevice.checkCorruption(device)
+		fdevice.Devices[i].ZFS.Datasets = zsysLayout(device.ZFS.PoolName, device.ZFS.Datasets, device.ZFS.Zsys, fdevice.now())
+	}
+
 	for _, device := range fdevice.Devices {
 		func() {
 			// Create file on disk
@@ -129,6 +535,15 @@ func (fdevice FakeDevices) create(path string) string {
 				devPaths = append(devPaths, p)
 				f.Close()
 			}
+			if device.Type != "" {
+				for i, p := range devPaths {
+					probeTable.Devices = append(probeTable.Devices, grubprobe.Device{
+						Path:    p,
+						Pool:    device.ZFS.PoolName,
+						Answers: probeAnswers(device, device.Names[i]),
+					})
+				}
+			}
 
 			deviceMountPath := filepath.Join(path, device.Names[0])
 			if err := os.MkdirAll(deviceMountPath, 0700); err != nil {
@@ -137,58 +552,60 @@ func (fdevice FakeDevices) create(path string) string {
 
 			switch strings.ToLower(device.Type) {
 			case "zfs":
-				var devs []zfs.VDevTree
-
-				for _, p := range devPaths {
-					devs = append(devs, zfs.VDevTree{
-						Type: zfs.VDevTypeFile,
-						Path: p,
-					})
-				}
-				var t zfs.VDevType = zfs.VDevTypeFile
-				if len(devs) > 1 {
-					t = zfs.VDevTypeMirror
+				vdev := fdevice.vdevTree(device, devPaths)
+				opts := poolOptions{
+					features: device.ZFS.Features,
+					props:    device.ZFS.PoolProperties,
+					fsProps:  device.ZFS.FilesystemProperties,
 				}
-				vdev := zfs.VDevTree{
-					Type:    t,
-					Devices: devs,
-				}
-
-				features := make(map[string]string)
-				props := make(map[zfs.Prop]string)
-				props[zfs.PoolPropAltroot] = deviceMountPath
-				fsprops := make(map[zfs.Prop]string)
-
-				pool, err := zfs.PoolCreate(device.ZFS.PoolName, vdev, features, props, fsprops)
-				if err != nil {
+				if err := backend.createPool(device.ZFS.PoolName, vdev, deviceMountPath, opts); err != nil {
 					fdevice.Fatalf("couldn't create pool %q: %v", device.ZFS.PoolName, err)
 				}
-				defer pool.Close()
 				defer func() {
-					if device.ZFS.KeepImported {
-						return
+					if !device.ZFS.KeepImported && !fdevice.Expect.keepImported(device.ZFS.PoolName) {
+						backend.exportPool(device.ZFS.PoolName)
+					} else {
+						fdevice.unloadKeys(device)
 					}
-					pool.Export(true, "export temporary pool")
+					// the pool is exported before being damaged, so that it doesn't rewrite its labels
+					fdevice.corrupt(device, path)
+					fdevice.setPoolState(device, devPaths)
 				}()
 
 				for _, dataset := range device.ZFS.Datasets {
 					func() {
 						datasetName := device.ZFS.PoolName + "/" + dataset.Name
 						var datasetPath string
-						var d zfs.Dataset
 						if dataset.Name == "." {
-							d, err = zfs.DatasetOpen(device.ZFS.PoolName)
+							datasetName = device.ZFS.PoolName
+						} else if dataset.CloneOf != "" {
+							if dataset.Encryption != "" {
+								fdevice.Fatalf("clone %q inherits the encryption of its origin, it can't declare one", datasetName)
+							}
+							origin := device.ZFS.PoolName + "/" + dataset.CloneOf
+							if err := backend.clone(origin, datasetName); err != nil {
+								fdevice.Fatalf("couldn't clone %q to %q: %v", origin, datasetName, err)
+							}
+						} else if dataset.Encryption != "" && dataset.Encryption != "off" {
+							keyformat, keylocation := dataset.KeyFormat, dataset.KeyLocation
+							if keyformat == "" {
+								keyformat = "passphrase"
+							}
+							if keylocation == "" {
+								keylocation = "prompt"
+							}
+							keyFile, err := writeKeyFile(path, datasetName, keyformat)
 							if err != nil {
-								fdevice.Fatalf("couldn't open dataset %q: %v", datasetName, err)
+								fdevice.Fatalf("couldn't create key of dataset %q: %v", datasetName, err)
+							}
+							if err := backend.createEncryptedDataset(datasetName, dataset.Encryption, keyformat, keylocation, keyFile); err != nil {
+								fdevice.Fatalf("couldn't create encrypted dataset %q: %v", datasetName, err)
 							}
 						} else {
-							props := make(map[zfs.Prop]zfs.Property)
-							d, err = zfs.DatasetCreate(datasetName, zfs.DatasetTypeFilesystem, props)
-							if err != nil {
+							if err := backend.createDataset(datasetName); err != nil {
 								fdevice.Fatalf("couldn't create dataset %q: %v", datasetName, err)
 							}
 						}
-						defer d.Close()
 
 						if dataset.IsCurrentSystemRoot {
 							systemRootDataset = datasetName
@@ -196,89 +613,98 @@ func (fdevice FakeDevices) create(path string) string {
 
 						var shouldMount bool
 						if dataset.Mountpoint != "" {
-							d.SetProperty(zfs.DatasetPropMountpoint, dataset.Mountpoint)
+							fdevice.setProperties(datasetName, map[string]string{"mountpoint": dataset.Mountpoint}, nil)
 						}
 						if dataset.CanMount != "" {
-							d.SetProperty(zfs.DatasetPropCanmount, dataset.CanMount)
+							fdevice.setProperties(datasetName, map[string]string{"canmount": dataset.CanMount}, nil)
 							if dataset.CanMount == "noauto" || dataset.CanMount == "on" {
 								shouldMount = true
 							}
-							d.Unmount(0)
+							if err := backend.unmount(datasetName, ""); err != nil {
+								fdevice.Fatalf("couldn't unmount dataset %q: %v", datasetName, err)
+							}
 						}
 
+						userProps := make(map[string]string)
 						if dataset.ZsysBootfs {
-							d.SetUserProperty("com.ubuntu.zsys:bootfs", "yes")
+							userProps["com.ubuntu.zsys:bootfs"] = "yes"
 							if !dataset.LastUsed.IsZero() {
-								d.SetUserProperty("com.ubuntu.zsys:last-used", strconv.FormatInt(dataset.LastUsed.Unix(), 10))
+								userProps["com.ubuntu.zsys:last-used"] = strconv.FormatInt(dataset.LastUsed.Unix(), 10)
 							}
 						}
 						if dataset.LastBootedKernel != "" {
-							d.SetUserProperty("com.ubuntu.zsys:last-booted-kernel", dataset.LastBootedKernel)
+							userProps["com.ubuntu.zsys:last-booted-kernel"] = dataset.LastBootedKernel
 						}
+						fdevice.setProperties(datasetName, nil, userProps)
 						if shouldMount {
-							// get potentially inherited mountpoint path
-							mountProp, err := d.GetProperty(zfs.DatasetPropMountpoint)
+							var err error
+							datasetPath, err = backend.mount(datasetName, deviceMountPath)
 							if err != nil {
-								fdevice.Fatalf("couldn't get mount point for %q: %v", datasetName, err)
-							}
-							datasetPath = mountProp.Value
-							if datasetPath != "legacy" {
-								if err := d.Mount("", 0); err != nil {
-									fdevice.Fatalf("couldn't mount dataset: %q: %v", datasetName, err)
-								}
-								// Mount manually datasetPath if set to legacy to "/" (deviceMountPath)
-							} else {
-								datasetPath = deviceMountPath
-								if err := syscall.Mount(datasetName, datasetPath, "zfs", 0, ""); err != nil {
-									fdevice.Fatalf("couldn't manually mount dataset: %q: %v", datasetName, err)
-								}
+								fdevice.Fatalf("couldn't mount dataset: %q: %v", datasetName, err)
 							}
 
 							if !dataset.KeepImported {
-								defer os.RemoveAll(datasetPath)
-								defer d.UnmountAll(0)
+								defer backend.unmount(datasetName, datasetPath)
 							}
 						}
 
 						for _, s := range dataset.Snapshots {
 							func() {
-								replaceContent(fdevice.T, s.Content, datasetPath)
-								completeSystemWithFstab(fdevice.T, path, dataset.Mountpoint, datasetPath, false, time.Time{}, s.Fstab)
-								props := make(map[zfs.Prop]zfs.Property)
-								d, err := zfs.DatasetSnapshot(datasetName+"@"+s.Name, false, props)
-								if err != nil {
-									fmt.Fprintf(os.Stderr, "Couldn't create snapshot %q: %v\n", datasetName+"@"+s.Name, err)
+								// snapshots of datasets which aren't mounted keep their content
+								if datasetPath != "" {
+									replaceContent(fdevice.T, s.Content, datasetPath)
+									completeSystemWithFstab(fdevice.T, path, dataset.Mountpoint, datasetPath, false, fdevice.now(), s.Fstab)
+								}
+								snapshotName := datasetName + "@" + s.Name
+								if err := backend.snapshot(snapshotName); err != nil {
+									fmt.Fprintf(os.Stderr, "Couldn't create snapshot %q: %v\n", snapshotName, err)
 									os.Exit(1)
 								}
-								defer d.Close()
 
-								// Convert time in current timezone for mock
-								location, err := time.LoadLocation("Local")
-								if err != nil {
-									fdevice.Fatal("couldn't get current timezone", err)
+								if err := backend.setCreation(snapshotName, s.CreationDate); err != nil {
+									fdevice.Fatalf("couldn't set creation date of snapshot %q: %v", snapshotName, err)
 								}
-								d.SetUserProperty("com.ubuntu.zsys:creation.test", strconv.FormatInt(s.CreationDate.In(location).Unix(), 10))
 
+								userProps := make(map[string]string)
 								if s.LastBootedKernel != "" {
-									d.SetUserProperty("com.ubuntu.zsys:last-booted-kernel", s.LastBootedKernel)
+									userProps["com.ubuntu.zsys:last-booted-kernel"] = s.LastBootedKernel
+								}
+								for k, v := range s.UserProperties {
+									userProps[k] = v
 								}
+								fdevice.setProperties(snapshotName, s.Properties, userProps)
 							}()
 						}
 
+						for _, b := range dataset.Bookmarks {
+							snapshot := b.Snapshot
+							if snapshot == "" {
+								snapshot = b.Name
+							}
+							snapshotName, bookmarkName := datasetName+"@"+snapshot, datasetName+"#"+b.Name
+							if err := backend.bookmark(snapshotName, bookmarkName); err != nil {
+								fdevice.Fatalf("couldn't create bookmark %q: %v", bookmarkName, err)
+							}
+						}
+
 						if shouldMount {
 							replaceContent(fdevice.T, dataset.Content, datasetPath)
-							completeSystemWithFstab(fdevice.T, path, dataset.Mountpoint, datasetPath, dataset.ZsysBootfs, dataset.LastUsed, dataset.Fstab)
+							lastUsed := dataset.LastUsed
+							if lastUsed.IsZero() {
+								lastUsed = fdevice.now()
+							}
+							completeSystemWithFstab(fdevice.T, path, dataset.Mountpoint, datasetPath, dataset.ZsysBootfs, lastUsed, dataset.Fstab)
 						}
-					}()
-				}
 
-				for _, deviceName := range device.Names {
-					// Device which name is "corrupted" will suffer some randomness and become an invalid pool
-					if deviceName != "corrupted" {
-						continue
-					}
-					p := filepath.Join(path, deviceName+".disk")
-					shuffleFile(fdevice, p)
+						// properties like readonly can prevent writing the content
+						fdevice.setProperties(datasetName, dataset.Properties, dataset.UserProperties)
+
+						if dataset.Promote {
+							if err := backend.promote(datasetName); err != nil {
+								fdevice.Fatalf("couldn't promote dataset %q: %v", datasetName, err)
+							}
+						}
+					}()
 				}
 
 			case "ext4":
@@ -286,22 +712,12 @@ func (fdevice FakeDevices) create(path string) string {
 					fdevice.Fatalf("Only one device allowed for ext4. Got %s", device.Names)
 				}
 				p := devPaths[0]
-				func() {
-					ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-					defer cancel()
-					cmd := exec.CommandContext(ctx, "mkfs.ext4", "-q", "-F", p)
-					if err := cmd.Run(); err != nil {
-						fdevice.Fatalf("couldn't format %q to ext4: %v", p, err)
-					}
-
-					cmd = exec.CommandContext(ctx, "mount", "-t", "ext4", p, deviceMountPath)
-					if err := cmd.Run(); err != nil {
-						fdevice.Fatalf("couldn't mount ext4 partition: %v", err)
-					}
-					defer syscall.Unmount(deviceMountPath, 0)
-
-					replaceContent(fdevice.T, device.Content, deviceMountPath)
-				}()
+				contentPath, teardown, err := backend.createPartition(p, "ext4", deviceMountPath)
+				if err != nil {
+					fdevice.Fatal(err)
+				}
+				replaceContent(fdevice.T, device.Content, contentPath)
+				teardown()
 
 			case "":
 				// do nothing for "no pool, no partition" (empty disk)
@@ -312,6 +728,16 @@ func (fdevice FakeDevices) create(path string) string {
 		}()
 	}
 
+	if err := backend.commit(); err != nil {
+		fdevice.Fatal("couldn't save devices state", err)
+	}
+	if err := probeTable.Write(grubProbeDevicesFile(path)); err != nil {
+		fdevice.Fatal("couldn't save grub-probe device table", err)
+	}
+	if err := faults.Write(faultsFile(path), fdevice.Faults); err != nil {
+		fdevice.Fatal("couldn't save faults", err)
+	}
+
 	return systemRootDataset
 }
 
@@ -320,28 +746,21 @@ func (fdevice FakeDevices) create(path string) string {
 // Note that as we can't run the tests on system which have a pool (no mount namespace in zfs), we export and destroy
 // all pools for the next tests to start in a preserved state.
 func (fdevice FakeDevices) assertExistingPoolsAndCleanup() {
+	defer fdevice.backend.cleanup()
+
 	keepImportedPools := make(map[string]bool)
-	pools, err := zfs.PoolOpenAll()
-	if err != nil && err.Error() != "no error" && err.Error() != "dataset does not exist" {
+	pools, err := fdevice.backend.importedPools()
+	if err != nil {
 		fdevice.Fatalf("couldn't open all remaining pools: %v", err)
 	}
-	for _, p := range pools {
-		func() {
-			defer p.Close()
-			defer p.Destroy("destroy temporary pool after test")
-			defer p.Export(true, "export temporary pool after test")
-			name, err := p.Name()
-			if err != nil {
-				fdevice.Fatalf("couldn't aquite pool name: %v", err)
-			}
-			keepImportedPools[name] = true
-		}()
+	for _, name := range pools {
+		keepImportedPools[name] = true
 	}
 
 	for _, device := range fdevice.Devices {
 		switch strings.ToLower(device.Type) {
 		case "zfs":
-			if device.ZFS.KeepImported {
+			if device.ZFS.KeepImported || fdevice.Expect.keepImported(device.ZFS.PoolName) {
 				if _, ok := keepImportedPools[device.ZFS.PoolName]; !ok {
 					fdevice.Errorf("we expected %s to be imported after running grub_mkconfig but it isn't", device.ZFS.PoolName)
 				}
@@ -359,7 +778,7 @@ func (fdevice FakeDevices) assertExistingPoolsAndCleanup() {
 }
 
 // completeSystemWithFstab ensures the system has required /boot and /etc,
-// it can update /etc/machine-id and os-release access time for non zsys systems
+// it updates /etc/machine-id and os-release access time to lastUsed
 // and can take a dynamically generated fstab
 func completeSystemWithFstab(t *testing.T, path, mountpoint, datasetPath string, isZsys bool, lastUsed time.Time, entries []FstabEntry) {
 	if mountpoint != "/" && mountpoint != "/etc" {
@@ -406,11 +825,7 @@ func completeSystemWithFstab(t *testing.T, path, mountpoint, datasetPath string,
 		}
 	}
 
-	// Change access time on machine-id when last_used isn't set.
-	// If zero, set magic date (2033-05-18T03:33:20+00:00 @2000000000) for non zsys systems
-	if lastUsed.IsZero() {
-		lastUsed = time.Unix(2000000000, 0)
-	}
+	// Change access time on machine-id: when last_used isn't set, this is the test system current time
 	// on separated /etc, /etc/machine-id doesn't exists
 	if _, err := os.Stat(machineIdPath); err == nil {
 		if err := os.Chtimes(machineIdPath, lastUsed, lastUsed); err != nil {
@@ -0,0 +1,298 @@
+package main_test
+
+import (
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/ubuntu/grubmenugen-zfs-tests/internal/bootlist"
+	"github.com/ubuntu/grubmenugen-zfs-tests/internal/grubcfg"
+	"github.com/ubuntu/grubmenugen-zfs-tests/internal/trace"
+)
+
+// Expectations are the assertions of the optional expect section of a test case definition.
+// They are checked in addition to the reference files, which are optional for test cases declaring expectations.
+type Expectations struct {
+	// MainEntries is the number of top level menu entries.
+	MainEntries *int `yaml:"main_entries"`
+	// DefaultEntry is the title of the first top level menu entry, booted by default.
+	DefaultEntry string `yaml:"default_entry"`
+	// NeverListedKernels are kernel names or paths which must not be booted by any menu entry.
+	NeverListedKernels []string `yaml:"never_listed_kernels"`
+	// ListedKernels are kernel names or paths which must each be booted by a menu entry.
+	ListedKernels []string `yaml:"listed_kernels"`
+	// EntryCommands are regular expressions which must each match a command of every top level menu entry, like
+	// the insmod and search commands giving GRUB access to the boot device.
+	EntryCommands []string `yaml:"entry_commands"`
+	// History are regular expressions matching, in order, the ids of all states listed in the history submenu of a
+	// main entry, by its title, like "^gnulinux-history-rpool/ROOT/ubuntu@autozsys_1234$".
+	History map[string][]string
+	// HistorySizes are the number of states listed in the history submenu of a main entry, by its title.
+	HistorySizes map[string]int `yaml:"history_sizes"`
+	// ImportedPools are the pools which must stay imported after the menu generation.
+	ImportedPools []string `yaml:"imported_pools"`
+	// ExitStatus is the expected exit status of grub-mkconfig.
+	ExitStatus int `yaml:"exit_status"`
+	// Stderr are regular expressions which must all match grub-mkconfig error output.
+	Stderr []string
+	// MockExitCodes are the exit codes of mock invocations, by command line prefix like "mokutil --sb-state".
+	// There must be at least one matching invocation, and all of them must have exited with this code.
+	MockExitCodes map[string]int `yaml:"mock_exit_codes"`
+}
+
+// assertRun checks the exit status and error output of grub-mkconfig against expectations.
+// It returns false if grub-mkconfig failed as expected, and thus there is no generated content to check.
+func (e *Expectations) assertRun(t *testing.T, out grubMkConfigOutput, err error) bool {
+	t.Helper()
+
+	var want int
+	if e != nil {
+		want = e.ExitStatus
+		for _, p := range e.Stderr {
+			re, err := regexp.Compile(p)
+			if err != nil {
+				t.Fatalf("invalid stderr pattern %q: %v", p, err)
+			}
+			if !re.MatchString(out.stderr) {
+				t.Errorf("grub-mkconfig stderr doesn't match %q", p)
+			}
+		}
+	}
+
+	if err == nil {
+		if want != 0 {
+			t.Fatalf("grub-mkconfig exited successfully, expected exit status %d", want)
+		}
+		return true
+	}
+
+	exitErr, ok := err.(*exec.ExitError)
+	if want == 0 || !ok {
+		t.Fatal("got error, expected none", err)
+	}
+	if got := exitErr.ExitCode(); got != want {
+		t.Fatalf("grub-mkconfig exit status is %d, expected %d", got, want)
+	}
+	return false
+}
+
+// assertBootlist checks the generated bootlist at path against expectations.
+func (e *Expectations) assertBootlist(t *testing.T, path string) {
+	t.Helper()
+
+	if e == nil || (len(e.NeverListedKernels) == 0 && len(e.ListedKernels) == 0) {
+		return
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		t.Fatal("couldn't open generated bootlist", err)
+	}
+	defer f.Close()
+
+	entries, err := bootlist.Parse(f)
+	if err != nil {
+		t.Fatalf("invalid generated bootlist: %v", err)
+	}
+	listed := make(map[string]bool)
+	for _, entry := range entries {
+		for _, k := range entry.Kernels {
+			if e.isNeverListed(k) {
+				t.Errorf("bootlist %s: kernel %q is listed, expected never to be", entry.Dataset, k)
+			}
+			for _, want := range e.ListedKernels {
+				if matchesKernel(k, want) {
+					listed[want] = true
+				}
+			}
+		}
+	}
+	for _, k := range e.ListedKernels {
+		if !listed[k] {
+			t.Errorf("bootlist doesn't list kernel %q, expected it to", k)
+		}
+	}
+}
+
+// assertGrubMenu checks the generated grub menu at path against expectations. Every menu entry must boot a kernel
+// with an initrd from a root dataset, so that degraded systems are either dropped or listed without broken entries.
+func (e *Expectations) assertGrubMenu(t *testing.T, path string) {
+	t.Helper()
+
+	if e == nil {
+		return
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal("couldn't open generated grub menu", err)
+	}
+	defer f.Close()
+
+	m, err := grubcfg.Parse(f)
+	if err != nil {
+		t.Fatalf("invalid generated grub menu: %v", err)
+	}
+
+	var mainEntries []*grubcfg.Item
+	for _, it := range m.Items {
+		if !it.Submenu {
+			mainEntries = append(mainEntries, it)
+		}
+	}
+	if e.MainEntries != nil && len(mainEntries) != *e.MainEntries {
+		t.Errorf("got %d main entries, expected %d", len(mainEntries), *e.MainEntries)
+	}
+	for _, p := range e.EntryCommands {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			t.Fatalf("invalid entry command pattern %q: %v", p, err)
+		}
+		for _, it := range mainEntries {
+			if !hasCommand(it, re) {
+				t.Errorf("main entry %q: no command matches %q", it.Title, p)
+			}
+		}
+	}
+	if e.DefaultEntry != "" {
+		if len(m.Items) == 0 || m.Items[0].Submenu {
+			t.Errorf("no default entry, expected %q", e.DefaultEntry)
+		} else if m.Items[0].Title != e.DefaultEntry {
+			t.Errorf("default entry is %q, expected %q", m.Items[0].Title, e.DefaultEntry)
+		}
+	}
+	listed := make(map[string]bool)
+	m.Walk(func(parents []*grubcfg.Item, it *grubcfg.Item) {
+		if it.Submenu {
+			return
+		}
+		if it.Kernel == "" || it.RootDataset == "" || len(it.Initrds) == 0 {
+			t.Errorf("%s: broken entry, booting kernel %q with initrds %q from %q", grubcfg.Path(parents, it), it.Kernel, it.Initrds, it.RootDataset)
+		}
+		if e.isNeverListed(it.Kernel) {
+			t.Errorf("%s: boots kernel %q, expected never to be listed", grubcfg.Path(parents, it), it.Kernel)
+		}
+		for _, k := range e.ListedKernels {
+			if matchesKernel(it.Kernel, k) {
+				listed[k] = true
+			}
+		}
+	})
+	for _, k := range e.ListedKernels {
+		if !listed[k] {
+			t.Errorf("no menu entry boots kernel %q, expected one", k)
+		}
+	}
+
+	for title, want := range e.HistorySizes {
+		if got := len(history(m, title)); got != want {
+			t.Errorf("%q: got %d history states, expected %d", title, got, want)
+		}
+	}
+	for title, patterns := range e.History {
+		states := history(m, title)
+		if len(states) != len(patterns) {
+			t.Errorf("%q: got %d history states, expected %d", title, len(states), len(patterns))
+		}
+		for i, p := range patterns {
+			re, err := regexp.Compile(p)
+			if err != nil {
+				t.Fatalf("invalid history pattern %q: %v", p, err)
+			}
+			if i < len(states) && !re.MatchString(states[i].ID) {
+				t.Errorf("%q: history state %d is %q, expected to match %q", title, i, states[i].ID, p)
+			}
+		}
+	}
+}
+
+// assertTrace checks the mock invocations recorded in traceFile against expectations.
+func (e *Expectations) assertTrace(t *testing.T, traceFile string) {
+	t.Helper()
+
+	if e == nil || len(e.MockExitCodes) == 0 {
+		return
+	}
+
+	records, err := trace.Load(traceFile)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal("couldn't load mocks trace", err)
+	}
+	for prefix, want := range e.MockExitCodes {
+		var found bool
+		for _, r := range records {
+			if cmd := r.String(); cmd != prefix && !strings.HasPrefix(cmd, prefix+" ") {
+				continue
+			}
+			found = true
+			if r.ExitCode != want {
+				t.Errorf("%s exited with %d, expected %d", r, r.ExitCode, want)
+			}
+		}
+		if !found {
+			t.Errorf("%s was never invoked, expected to exit with %d", prefix, want)
+		}
+	}
+}
+
+// history returns the states listed in the history submenu of the main entry title, if any.
+func history(m *grubcfg.Menu, title string) []*grubcfg.Item {
+	h := m.Find("History for " + title)
+	if h == nil {
+		return nil
+	}
+	return h.Items
+}
+
+// hasCommand returns if one of the commands of the menu entry it matches re.
+func hasCommand(it *grubcfg.Item, re *regexp.Regexp) bool {
+	for _, c := range it.Commands {
+		if re.MatchString(c.String()) {
+			return true
+		}
+	}
+	return false
+}
+
+// keepImported returns if pool is expected to stay imported.
+func (e *Expectations) keepImported(pool string) bool {
+	if e == nil {
+		return false
+	}
+	for _, p := range e.ImportedPools {
+		if p == pool {
+			return true
+		}
+	}
+	return false
+}
+
+// isNeverListed returns if kernel, a path or a name, matches one of the kernels which must never be listed.
+func (e *Expectations) isNeverListed(kernel string) bool {
+	for _, k := range e.NeverListedKernels {
+		if matchesKernel(kernel, k) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesKernel returns if the kernel path of a menu entry matches k, a kernel path or name.
+func matchesKernel(kernel, k string) bool {
+	return kernel == k || (!strings.Contains(k, "/") && path.Base(kernel) == k)
+}
+
+// hasReference returns if the reference file at path should be compared with the generated one, and updated.
+// Test cases declaring expectations can omit reference files: -update doesn't create them.
+func hasReference(path string, e *Expectations) bool {
+	if e == nil {
+		return true
+	}
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -2,6 +2,7 @@ package main_test
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"flag"
 	"os"
@@ -10,16 +11,28 @@ import (
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/ubuntu/grubmenugen-zfs-tests/internal/trace"
 )
 
 const defaultLinuxZFS = "/etc/grub.d/10_linux_zfs"
 
 var (
-	linuxZFS = flag.String("linux-zfs", defaultLinuxZFS, "Grub linux ZFS file to test. Can be override with GRUBTESTS_LINUXZFS")
+	linuxZFS     = flag.String("linux-zfs", defaultLinuxZFS, "Grub linux ZFS file to test. Can be override with GRUBTESTS_LINUXZFS")
+	recordTraces = flag.String("record-traces", "", "save the trace of mock invocations of each test in this directory")
+	replayTraces = flag.String("replay-traces", "", "answer mock invocations from the traces saved in this directory instead of running them")
 )
 
-// runGrubMkConfig setup and runs grubMkConfig.
-func runGrubMkConfig(t *testing.T, env []string, testDir string) error {
+// grubMkConfigOutput is what grub-mkconfig printed on its standard and error outputs, and the trace of the mocks
+// it invoked.
+type grubMkConfigOutput struct {
+	stdout string
+	stderr string
+	trace  string
+}
+
+// runGrubMkConfig setup and runs grubMkConfig. Its outputs are captured and logged.
+func runGrubMkConfig(t *testing.T, env []string, testDir string) (grubMkConfigOutput, error) {
 	for src, dst := range map[string]string{
 		*linuxZFS:                 defaultLinuxZFS,
 		"/etc/grub.d/00_header":   "",
@@ -37,8 +50,10 @@ func runGrubMkConfig(t *testing.T, env []string, testDir string) error {
 	// We need to set grub_probe twice: once in environment (for subprocess) and once in grub_mkconfig directly
 	updateFile(t, grubMkConfig, map[string]string{
 		`sysconfdir="/etc"`: `sysconfdir="` + testDir + `/etc"` +
-			"\nexport GRUB_LINUX_ZFS_TEST GRUB_LINUX_ZFS_TEST_INPUT GRUB_LINUX_ZFS_TEST_OUTPUT TEST_POOL_DIR TEST_MOKUTIL_SECUREBOOT TEST_MOCKZFS_CURRENT_ROOT_DATASET TEST_AWK_BIN LC_ALL TZ grub_probe\n",
+			"\nexport GRUB_LINUX_ZFS_TEST GRUB_LINUX_ZFS_TEST_INPUT GRUB_LINUX_ZFS_TEST_OUTPUT TEST_POOL_DIR TEST_MOKUTIL_SECUREBOOT TEST_MOKUTIL_ENROLLED_KEYS TEST_MOKUTIL_TIMEOUT TEST_MOCKZFS_CURRENT_ROOT_DATASET TEST_MOCKZFS_STATE_DIR TEST_MOCKDATE_NOW TEST_GRUBPROBE_DEVICES TEST_MOCK_FAULTS TEST_MOCK_TRACE TEST_MOCK_REPLAY TEST_AWK_BIN LC_ALL TZ grub_probe\n",
 		`grub_probe="${sbindir}/grub-probe"`: "grub_probe=`which grub-probe`",
+		// The userspace zfs backend doesn't need privileges: let grub-mkconfig run as a regular user.
+		"root=f": "root=t",
 	})
 	// Update 10_linux_zfs to replace /dev/loopX loop devices by /dev/loop00 when calling prepare_grub_to_access_device.
 	updateFile(t, filepath.Join(testDir, "etc", "grub.d", "10_linux_zfs"), map[string]string{
@@ -46,14 +61,40 @@ func runGrubMkConfig(t *testing.T, env []string, testDir string) error {
 			`case "$1" in /dev/loop*) set -- /dev/loop00 $2;; esac`,
 	})
 
+	// Each mock invocation is recorded in the test trace, or answered from a previously saved one.
+	traceFile := filepath.Join(testDir, "mocks.trace")
+	env = append(env, trace.RecordEnv+"="+traceFile)
+	if *replayTraces != "" {
+		replay := filepath.Join(*replayTraces, t.Name()+".trace")
+		if _, err := os.Stat(replay); err != nil {
+			t.Fatal("couldn't find trace to replay", err)
+		}
+		env = append(env, trace.ReplayEnv+"="+replay)
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 	cmd := exec.CommandContext(ctx, grubMkConfig, "-o", filepath.Join(testDir, "grub.cfg"))
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
 	cmd.Env = env
 
-	return cmd.Run()
+	err := cmd.Run()
+	out := grubMkConfigOutput{stdout: stdout.String(), stderr: stderr.String(), trace: traceFile}
+	if out.stdout != "" {
+		t.Logf("grub-mkconfig stdout:\n%s", out.stdout)
+	}
+	if out.stderr != "" {
+		t.Logf("grub-mkconfig stderr:\n%s", out.stderr)
+	}
+
+	if *recordTraces != "" {
+		if _, err := os.Stat(traceFile); err == nil {
+			copyFile(t, traceFile, filepath.Join(*recordTraces, t.Name()+".trace"))
+		}
+	}
+	return out, err
 }
 
 // updateFile update the file inline by replacing for each element in replace map by what its value.
@@ -8,11 +8,16 @@ import (
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/ubuntu/grubmenugen-zfs-tests/internal/bootlist"
+	"github.com/ubuntu/grubmenugen-zfs-tests/internal/grubcfg"
+	"github.com/ubuntu/grubmenugen-zfs-tests/internal/metamenu"
+	"github.com/ubuntu/grubmenugen-zfs-tests/internal/trace"
 )
 
 var compileMocksOnce sync.Once
@@ -29,7 +34,7 @@ func ensureBinaryMocks(t *testing.T) {
 	}
 
 	compileMocksOnce.Do(func() {
-		for _, mock := range []string{"mokutil", "zfs", "zpool", "date", "grub-probe", "awk"} {
+		for _, mock := range []string{"mokutil", "zfs", "zpool", "date", "grub-probe", "awk", "mount", "umount"} {
 			cmd := exec.Command("go", "build", "-o", filepath.Join(mockDir, mock, mock), filepath.Join(filepath.Dir(mockDir), "cmd/", mock, "main.go"))
 			cmd.Stdout = os.Stdout
 			cmd.Stderr = os.Stderr
@@ -40,9 +45,62 @@ func ensureBinaryMocks(t *testing.T) {
 	})
 }
 
+// hermeticPath returns the PATH environment variable controlling which commands grub-mkconfig can reach: the given
+// mocks come first, then binDir, populated with links to the host commands of PATH. Hidden commands aren't linked, as
+// if they weren't installed. Each mock is only listed once.
+func hermeticPath(t *testing.T, binDir string, mocks []string, hidden ...string) string {
+	t.Helper()
+
+	if err := os.MkdirAll(binDir, 0755); err != nil {
+		t.Fatal("couldn't create directory for host commands", err)
+	}
+	linked := make(map[string]bool)
+	for _, h := range hidden {
+		linked[h] = true
+	}
+	for _, dir := range filepath.SplitList(os.Getenv("PATH")) {
+		// PATH can list directories which don't exist
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			p := filepath.Join(dir, e.Name())
+			// only the first executable of a given name in PATH is reachable
+			if linked[e.Name()] {
+				continue
+			}
+			if info, err := os.Stat(p); err != nil || info.IsDir() || info.Mode()&0111 == 0 {
+				continue
+			}
+			if err := os.Symlink(p, filepath.Join(binDir, e.Name())); err != nil {
+				t.Fatalf("couldn't link host command %q: %v", p, err)
+			}
+			linked[e.Name()] = true
+		}
+	}
+
+	var dirs []string
+	seen := make(map[string]bool)
+	for _, m := range mocks {
+		if seen[m] {
+			continue
+		}
+		seen[m] = true
+		dirs = append(dirs, filepath.Join(mockDir, m))
+	}
+	return "PATH=" + strings.Join(append(dirs, binDir), ":")
+}
+
+// hostBinDir returns the directory of links to the host commands reachable by grub-mkconfig for a test.
+func hostBinDir(testDir string) string {
+	return filepath.Join(testDir, "hostbin")
+}
+
 // anonymizeTempDirNames ununiquifies the name of the temporary directory, or
 // loop devices so that we can compare the content generated with update
 // to the content generated during the test.
+// Paths in the temporary directory are made relative to it.
 func anonymizeTempDirNames(t *testing.T, path string) string {
 	t.Helper()
 
@@ -53,13 +111,16 @@ func anonymizeTempDirNames(t *testing.T, path string) string {
 	defer f.Close()
 
 	filere := regexp.MustCompile("/tmp/grubtests-[[:alnum:]]+/")
+	dirre := regexp.MustCompile("/tmp/grubtests-[[:alnum:]]+")
 	devloopre := regexp.MustCompile("/dev/loop[[:digit:]]+")
 	s := bufio.NewScanner(f)
 	var out string
 	for s.Scan() {
 		out = out +
 			devloopre.ReplaceAllString(
-				filere.ReplaceAllString(s.Text(), ""),
+				dirre.ReplaceAllString(
+					filere.ReplaceAllString(s.Text(), ""),
+					"."),
 				"/dev/loop00") + "\n"
 	}
 	if err := s.Err(); err != nil {
@@ -69,19 +130,181 @@ func anonymizeTempDirNames(t *testing.T, path string) string {
 	return out
 }
 
-// assertFileContentAlmostEquals between generated and expected file path.
-// It strips temporary directory with special name.
-func assertFileContentAlmostEquals(t *testing.T, generatedF, expectedF, msg string) {
+// readGeneratedAndReference returns the anonymized generated content and the reference content.
+// ok is false if there is nothing to compare: no file generated for an empty reference.
+func readGeneratedAndReference(t *testing.T, generatedF, expectedF string) (generated, expected string, ok bool) {
 	t.Helper()
 
-	expected, err := ioutil.ReadFile(expectedF)
+	b, err := ioutil.ReadFile(expectedF)
 	if err != nil {
 		t.Fatal("couldn't open reference file", err)
 	}
-	if _, err := os.Stat(generatedF); string(expected) == "" && os.IsNotExist(err) {
+	if _, err := os.Stat(generatedF); len(b) == 0 && os.IsNotExist(err) {
+		return "", "", false
+	}
+	return anonymizeTempDirNames(t, generatedF), string(b), true
+}
+
+// assertBootlistEquals between generated and expected bootlist path.
+// Each differing field is reported, after stripping temporary directory with special name.
+func assertBootlistEquals(t *testing.T, generatedF, expectedF string) {
+	t.Helper()
+
+	generated, expected, ok := readGeneratedAndReference(t, generatedF, expectedF)
+	if !ok {
+		return
+	}
+
+	want, err := bootlist.Parse(strings.NewReader(expected))
+	if err != nil {
+		t.Fatalf("invalid reference bootlist %q: %v", expectedF, err)
+	}
+	got, err := bootlist.Parse(strings.NewReader(generated))
+	if err != nil {
+		t.Fatalf("invalid generated bootlist: %v", err)
+	}
+
+	diffs := bootlist.Diff(got, want)
+	for _, d := range diffs {
+		t.Error(d)
+	}
+	if len(diffs) == 0 {
+		assert.Equal(t, expected, generated, "generated and reference files are different.")
+	}
+}
+
+// assertMetaMenuEquals between generated and expected metamenu path.
+// Added, removed, reordered and changed entries are reported per machine.
+func assertMetaMenuEquals(t *testing.T, generatedF, expectedF string) {
+	t.Helper()
+
+	generated, expected, ok := readGeneratedAndReference(t, generatedF, expectedF)
+	if !ok {
+		return
+	}
+
+	want, err := metamenu.Parse(strings.NewReader(expected))
+	if err != nil {
+		t.Fatalf("invalid reference metamenu %q: %v", expectedF, err)
+	}
+	got, err := metamenu.Parse(strings.NewReader(generated))
+	if err != nil {
+		t.Fatalf("invalid generated metamenu: %v", err)
+	}
+
+	diffs := metamenu.Diff(got, want)
+	for _, d := range diffs {
+		t.Error(d)
+	}
+	if len(diffs) == 0 {
+		assert.Equal(t, expected, generated, "generated and reference files are different.")
+	}
+}
+
+// assertGrubMenuEquals between generated and expected grub menu path.
+// Differences are reported per menu entry or submenu, designated by their title path.
+func assertGrubMenuEquals(t *testing.T, generatedF, expectedF string) {
+	t.Helper()
+
+	generated, expected, ok := readGeneratedAndReference(t, generatedF, expectedF)
+	if !ok {
+		return
+	}
+
+	want, err := grubcfg.Parse(strings.NewReader(expected))
+	if err != nil {
+		t.Fatalf("invalid reference grub menu %q: %v", expectedF, err)
+	}
+	got, err := grubcfg.Parse(strings.NewReader(generated))
+	if err != nil {
+		t.Fatalf("invalid generated grub menu: %v", err)
+	}
+
+	diffs := grubcfg.Diff(got, want)
+	for _, d := range diffs {
+		t.Error(d)
+	}
+	if len(diffs) == 0 {
+		assert.Equal(t, expected, generated, "generated and reference files are different.")
+	}
+}
+
+// otherTempDirRe matches temporary directories created by the scripts, like mount points, whose names change on each run.
+var otherTempDirRe = regexp.MustCompile(`(^|[\s=])/tmp/[^/\s]+`)
+
+// writeCommands writes the command line of each mock invocation of traceFile to path, one per line, as formatted by
+// formatCommands.
+func writeCommands(t *testing.T, traceFile, testDir, path string) {
+	t.Helper()
+
+	records, err := trace.Load(traceFile)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal("couldn't load mocks trace", err)
+	}
+	if err := ioutil.WriteFile(path, []byte(formatCommands(records, testDir)), 0644); err != nil {
+		t.Fatal("couldn't write commands file", err)
+	}
+}
+
+// formatCommands returns the command line of each record, one per line. mount and umount are skipped, as their
+// invocations depend on how the zfs backend mounts datasets.
+// Temporary directories created by the scripts are replaced by /tmp/tmpdir. Test directory references are
+// expanded for anonymizeTempDirNames to anonymize them.
+func formatCommands(records []trace.Record, testDir string) string {
+	var out strings.Builder
+	for _, r := range records {
+		if r.Command == "mount" || r.Command == "umount" {
+			continue
+		}
+		line := []string{r.Command}
+		for _, a := range r.Args {
+			a = strings.Replace(a, "${TEST_POOL_DIR}", testDir, -1)
+			a = otherTempDirRe.ReplaceAllStringFunc(a, func(m string) string {
+				if strings.Contains(m, testDir) {
+					return m
+				}
+				return m[:strings.Index(m, "/tmp/")] + "/tmp/tmpdir"
+			})
+			if a == "" || strings.ContainsAny(a, " \t\n'\"") {
+				a = strconv.Quote(a)
+			}
+			line = append(line, a)
+		}
+		out.WriteString(strings.Join(line, " ") + "\n")
+	}
+	return out.String()
+}
+
+func TestFormatCommands(t *testing.T) {
+	t.Parallel()
+
+	testDir := "/tmp/grubtests-123"
+	records := []trace.Record{
+		{Command: "zpool", Args: []string{"import", "-d", "${TEST_POOL_DIR}"}},
+		{Command: "mount", Args: []string{"-t", "zfs", "rpool/ROOT/ubuntu", "/tmp/tmp.AbCd"}},
+		{Command: "grub-probe", Args: []string{"--target=device", "/"}},
+		{Command: "zfs", Args: []string{"get", "-H", "-o", "value", "mountpoint", "/tmp/tmp.AbCd/etc", testDir + "/main"}},
+		{Command: "awk", Args: []string{"{print $1}", ""}},
+		{Command: "umount", Args: []string{"/tmp/tmp.AbCd"}},
+	}
+
+	want := `zpool import -d /tmp/grubtests-123
+grub-probe --target=device /
+zfs get -H -o value mountpoint /tmp/tmpdir/etc /tmp/grubtests-123/main
+awk "{print $1}" ""
+`
+	assert.Equal(t, want, formatCommands(records, testDir), "mount and umount should be skipped and temporary directories anonymized")
+}
+
+// assertCommandsEquals between generated and expected commands path.
+func assertCommandsEquals(t *testing.T, generatedF, expectedF string) {
+	t.Helper()
+
+	generated, expected, ok := readGeneratedAndReference(t, generatedF, expectedF)
+	if !ok {
 		return
 	}
-	assert.Equal(t, string(expected), anonymizeTempDirNames(t, generatedF), "generated and reference files are different.")
+	assert.Equal(t, expected, generated, "generated and reference commands are different.")
 }
 
 // getTempOrReferenceFile returns the tempFile path.
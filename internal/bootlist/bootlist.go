@@ -0,0 +1,177 @@
+// Package bootlist parses and serializes the bootlist intermediate format generated by 10_linux_zfs.
+//
+// A bootlist has one tab separated record per line, for each bootable dataset or snapshot:
+// dataset, zsys flag, machine-id, OS name, last-used timestamp, device, initrds, kernels and last booted kernel.
+// Initrds and kernels are "|" separated lists. Empty zsys flag and last booted kernel are written as "-".
+package bootlist
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	fieldSeparator = "\t"
+	listSeparator  = "|"
+	unset          = "-"
+)
+
+// fields are the names of the record fields, in order.
+var fields = []string{
+	"dataset",
+	"zsys",
+	"machine-id",
+	"name",
+	"last-used",
+	"device",
+	"initrd",
+	"kernel",
+	"last-booted-kernel",
+}
+
+// Entry is one bootable dataset or snapshot.
+type Entry struct {
+	Dataset          string
+	Zsys             bool
+	MachineID        string
+	Name             string
+	LastUsed         int64
+	Device           string
+	Initrds          []string
+	Kernels          []string
+	LastBootedKernel string
+}
+
+// ParseError is a malformed record. Column is the 1-based index of the faulty field.
+type ParseError struct {
+	Line   int
+	Column int
+	Msg    string
+}
+
+func (e ParseError) Error() string {
+	if e.Column == 0 {
+		return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+	}
+	return fmt.Sprintf("line %d, column %d (%s): %s", e.Line, e.Column, fields[e.Column-1], e.Msg)
+}
+
+// Parse reads all records of a bootlist.
+func Parse(r io.Reader) ([]Entry, error) {
+	var entries []Entry
+	seen := make(map[string]int)
+
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 1024*1024)
+	line := 0
+	for s.Scan() {
+		line++
+		e, err := parseLine(s.Text(), line)
+		if err != nil {
+			return nil, err
+		}
+		if prev, ok := seen[e.Dataset]; ok {
+			return nil, ParseError{Line: line, Column: 1, Msg: fmt.Sprintf("dataset %q already listed on line %d", e.Dataset, prev)}
+		}
+		seen[e.Dataset] = line
+		entries = append(entries, e)
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("couldn't read bootlist: %v", err)
+	}
+	return entries, nil
+}
+
+// parseLine parses and validates a single record.
+func parseLine(l string, line int) (Entry, error) {
+	var e Entry
+	values := strings.Split(l, fieldSeparator)
+	if len(values) != len(fields) {
+		return e, ParseError{Line: line, Msg: fmt.Sprintf("expected %d fields, got %d", len(fields), len(values))}
+	}
+	errAt := func(col int, format string, a ...interface{}) error {
+		return ParseError{Line: line, Column: col + 1, Msg: fmt.Sprintf(format, a...)}
+	}
+
+	for i, v := range values {
+		if v == "" {
+			return e, errAt(i, "empty value")
+		}
+	}
+
+	e.Dataset = values[0]
+	if strings.Count(e.Dataset, "@") > 1 {
+		return e, errAt(0, "invalid dataset name %q", e.Dataset)
+	}
+
+	switch values[1] {
+	case "yes":
+		e.Zsys = true
+	case unset:
+	default:
+		return e, errAt(1, "expected %q or %q, got %q", "yes", unset, values[1])
+	}
+
+	e.MachineID = values[2]
+	e.Name = values[3]
+
+	lastUsed, err := strconv.ParseInt(values[4], 10, 64)
+	if err != nil || strconv.FormatInt(lastUsed, 10) != values[4] {
+		return e, errAt(4, "invalid timestamp %q", values[4])
+	}
+	e.LastUsed = lastUsed
+
+	e.Device = values[5]
+
+	for i, dst := range []*[]string{&e.Initrds, &e.Kernels} {
+		col := 6 + i
+		for _, p := range strings.Split(values[col], listSeparator) {
+			if p == "" {
+				return e, errAt(col, "empty path in list %q", values[col])
+			}
+			*dst = append(*dst, p)
+		}
+	}
+
+	if values[8] != unset {
+		e.LastBootedKernel = values[8]
+	}
+
+	return e, nil
+}
+
+// String serializes the entry as a bootlist record, without trailing newline.
+func (e Entry) String() string {
+	zsys := unset
+	if e.Zsys {
+		zsys = "yes"
+	}
+	lastBootedKernel := unset
+	if e.LastBootedKernel != "" {
+		lastBootedKernel = e.LastBootedKernel
+	}
+	return strings.Join([]string{
+		e.Dataset,
+		zsys,
+		e.MachineID,
+		e.Name,
+		strconv.FormatInt(e.LastUsed, 10),
+		e.Device,
+		strings.Join(e.Initrds, listSeparator),
+		strings.Join(e.Kernels, listSeparator),
+		lastBootedKernel,
+	}, fieldSeparator)
+}
+
+// Write serializes entries as a bootlist.
+func Write(w io.Writer, entries []Entry) error {
+	for _, e := range entries {
+		if _, err := fmt.Fprintln(w, e.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
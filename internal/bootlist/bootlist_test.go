@@ -0,0 +1,127 @@
+package bootlist_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ubuntu/grubmenugen-zfs-tests/internal/bootlist"
+)
+
+const validLine = "rpool/ROOT/ubuntu@snap1\tyes\t11111111111111111111111111111111\tUbuntu 19.04\t1544444444\tmain.disk\t" +
+	"/ROOT/ubuntu@snap1/boot/initrd.img-5.0.0-13-generic|/ROOT/ubuntu@snap1/boot/initrd.img-4.15.0-13-generic\t" +
+	"/ROOT/ubuntu@snap1/boot/vmlinuz-5.0.0-13-generic|/ROOT/ubuntu@snap1/boot/vmlinuz-4.15.0-13-generic\t-\n"
+
+func TestParse(t *testing.T) {
+	entries, err := bootlist.Parse(strings.NewReader(validLine))
+	if err != nil {
+		t.Fatal("got error, expected none", err)
+	}
+	assert.Equal(t, []bootlist.Entry{{
+		Dataset:   "rpool/ROOT/ubuntu@snap1",
+		Zsys:      true,
+		MachineID: "11111111111111111111111111111111",
+		Name:      "Ubuntu 19.04",
+		LastUsed:  1544444444,
+		Device:    "main.disk",
+		Initrds:   []string{"/ROOT/ubuntu@snap1/boot/initrd.img-5.0.0-13-generic", "/ROOT/ubuntu@snap1/boot/initrd.img-4.15.0-13-generic"},
+		Kernels:   []string{"/ROOT/ubuntu@snap1/boot/vmlinuz-5.0.0-13-generic", "/ROOT/ubuntu@snap1/boot/vmlinuz-4.15.0-13-generic"},
+	}}, entries)
+}
+
+func TestParseErrors(t *testing.T) {
+	replaceField := func(i int, v string) string {
+		f := strings.Split(strings.TrimSuffix(validLine, "\n"), "\t")
+		f[i] = v
+		return strings.Join(f, "\t") + "\n"
+	}
+
+	testCases := map[string]struct {
+		content string
+		wantErr string
+	}{
+		"missing field":        {content: "rpool\tyes\n", wantErr: "line 1: expected 9 fields, got 2"},
+		"empty field":          {content: replaceField(2, ""), wantErr: "line 1, column 3 (machine-id): empty value"},
+		"invalid zsys":         {content: replaceField(1, "no"), wantErr: "line 1, column 2 (zsys)"},
+		"invalid last used":    {content: replaceField(4, "yesterday"), wantErr: "line 1, column 5 (last-used)"},
+		"non canonical number": {content: replaceField(4, "01544444444"), wantErr: "line 1, column 5 (last-used)"},
+		"empty kernel":         {content: replaceField(7, "/vmlinuz||/vmlinuz-old"), wantErr: "line 1, column 8 (kernel)"},
+		"invalid dataset":      {content: replaceField(0, "rpool@a@b"), wantErr: "line 1, column 1 (dataset)"},
+		"duplicated dataset":   {content: validLine + validLine, wantErr: "line 2, column 1 (dataset): dataset \"rpool/ROOT/ubuntu@snap1\" already listed on line 1"},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			_, err := bootlist.Parse(strings.NewReader(tc.content))
+			if err == nil {
+				t.Fatal("expected an error, got none")
+			}
+			assert.Contains(t, err.Error(), tc.wantErr)
+		})
+	}
+}
+
+// TestRoundTrip ensures that all reference bootlists are valid and serialized back identically.
+func TestRoundTrip(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("..", "..", "testdata", "definitions", "*", "*", "bootlist"))
+	if err != nil {
+		t.Fatal("couldn't list reference bootlists", err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no reference bootlist found")
+	}
+
+	for _, f := range files {
+		f := f
+		t.Run(f, func(t *testing.T) {
+			content, err := ioutil.ReadFile(f)
+			if err != nil {
+				t.Fatal("couldn't read bootlist", err)
+			}
+			entries, err := bootlist.Parse(bytes.NewReader(content))
+			if err != nil {
+				t.Fatal("got error, expected none", err)
+			}
+
+			var out bytes.Buffer
+			if err := bootlist.Write(&out, entries); err != nil {
+				t.Fatal("couldn't write bootlist", err)
+			}
+			assert.Equal(t, string(content), out.String())
+		})
+	}
+}
+
+func TestDiff(t *testing.T) {
+	base, err := bootlist.Parse(strings.NewReader(validLine + strings.Replace(validLine, "@snap1", "@snap2", -1)))
+	if err != nil {
+		t.Fatal("couldn't parse bootlist", err)
+	}
+	snap1, snap2 := base[0], base[1]
+
+	changedInitrd := snap1
+	changedInitrd.Initrds = []string{"/ROOT/ubuntu@snap1/boot/initrd.img-5.0.0-13-generic"}
+
+	testCases := map[string]struct {
+		got  []bootlist.Entry
+		want []string
+	}{
+		"identical":      {got: []bootlist.Entry{snap1, snap2}},
+		"field differs":  {got: []bootlist.Entry{changedInitrd, snap2}, want: []string{`rpool/ROOT/ubuntu@snap1: initrd differs: got "/ROOT/ubuntu@snap1/boot/initrd.img-5.0.0-13-generic", want "/ROOT/ubuntu@snap1/boot/initrd.img-5.0.0-13-generic|/ROOT/ubuntu@snap1/boot/initrd.img-4.15.0-13-generic"`}},
+		"missing":        {got: []bootlist.Entry{snap1}, want: []string{"rpool/ROOT/ubuntu@snap2: missing entry"}},
+		"unexpected":     {got: []bootlist.Entry{snap1, snap2, {Dataset: "rpool/ROOT/other"}}, want: []string{"rpool/ROOT/other: unexpected entry"}},
+		"order differs":  {got: []bootlist.Entry{snap2, snap1}, want: []string{"entries order differs: got rpool/ROOT/ubuntu@snap2, rpool/ROOT/ubuntu@snap1, want rpool/ROOT/ubuntu@snap1, rpool/ROOT/ubuntu@snap2"}},
+		"empty bootlist": {want: []string{"rpool/ROOT/ubuntu@snap1: missing entry", "rpool/ROOT/ubuntu@snap2: missing entry"}},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.want, bootlist.Diff(tc.got, base))
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package bootlist
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Diff returns human readable differences between got and want entries, matched by dataset.
+// It is empty when both lists are identical.
+func Diff(got, want []Entry) []string {
+	var diffs []string
+
+	gotByDataset := make(map[string]Entry)
+	for _, e := range got {
+		gotByDataset[e.Dataset] = e
+	}
+	wantByDataset := make(map[string]Entry)
+	for _, e := range want {
+		wantByDataset[e.Dataset] = e
+	}
+
+	var gotOrder, wantOrder []string
+	for _, w := range want {
+		g, ok := gotByDataset[w.Dataset]
+		if !ok {
+			diffs = append(diffs, fmt.Sprintf("%s: missing entry", w.Dataset))
+			continue
+		}
+		wantOrder = append(wantOrder, w.Dataset)
+		diffs = append(diffs, diffEntry(g, w)...)
+	}
+	for _, g := range got {
+		if _, ok := wantByDataset[g.Dataset]; !ok {
+			diffs = append(diffs, fmt.Sprintf("%s: unexpected entry", g.Dataset))
+			continue
+		}
+		gotOrder = append(gotOrder, g.Dataset)
+	}
+
+	for i := range wantOrder {
+		if gotOrder[i] != wantOrder[i] {
+			diffs = append(diffs, fmt.Sprintf("entries order differs: got %s, want %s",
+				strings.Join(gotOrder, ", "), strings.Join(wantOrder, ", ")))
+			break
+		}
+	}
+
+	return diffs
+}
+
+// diffEntry compares each field of two entries for the same dataset. Entry fields are in the same order than fields.
+func diffEntry(got, want Entry) []string {
+	var diffs []string
+	gv, wv := reflect.ValueOf(got), reflect.ValueOf(want)
+	for i := range fields {
+		g, w := gv.Field(i).Interface(), wv.Field(i).Interface()
+		if reflect.DeepEqual(g, w) {
+			continue
+		}
+		diffs = append(diffs, fmt.Sprintf("%s: %s differs: got %s, want %s", want.Dataset, fields[i], format(g), format(w)))
+	}
+	return diffs
+}
+
+// format quotes a field value for diff messages.
+func format(v interface{}) string {
+	switch v := v.(type) {
+	case []string:
+		return fmt.Sprintf("%q", strings.Join(v, listSeparator))
+	default:
+		return fmt.Sprintf("%q", fmt.Sprint(v))
+	}
+}
@@ -0,0 +1,139 @@
+package fakezfs
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// options are parsed command line short options, like getopt does: flags can be grouped, values attached or not
+// and options mixed with arguments.
+type options struct {
+	flags map[byte][]string
+	args  []string
+}
+
+// parseOptions parses args accepting boolFlags without value and valueFlags taking one.
+func parseOptions(args []string, boolFlags, valueFlags string) (options, error) {
+	o := options{flags: make(map[byte][]string)}
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		if a == "--" {
+			o.args = append(o.args, args[i+1:]...)
+			break
+		}
+		if !strings.HasPrefix(a, "-") || a == "-" {
+			o.args = append(o.args, a)
+			continue
+		}
+		for j := 1; j < len(a); j++ {
+			c := a[j]
+			switch {
+			case strings.IndexByte(boolFlags, c) >= 0:
+				o.flags[c] = append(o.flags[c], "")
+			case strings.IndexByte(valueFlags, c) >= 0:
+				v := a[j+1:]
+				if v == "" {
+					if i+1 >= len(args) {
+						return o, fmt.Errorf("missing argument for '%c' option", c)
+					}
+					i++
+					v = args[i]
+				}
+				o.flags[c] = append(o.flags[c], v)
+				j = len(a)
+			default:
+				return o, fmt.Errorf("invalid option '%c'", c)
+			}
+		}
+	}
+	return o, nil
+}
+
+// has returns if flag was passed.
+func (o options) has(flag byte) bool {
+	_, ok := o.flags[flag]
+	return ok
+}
+
+// list returns all comma separated values passed to flag.
+func (o options) list(flag byte) []string {
+	var r []string
+	for _, v := range o.flags[flag] {
+		r = append(r, strings.Split(v, ",")...)
+	}
+	return r
+}
+
+// last returns the last value passed to flag.
+func (o options) last(flag byte) string {
+	v := o.flags[flag]
+	if len(v) == 0 {
+		return ""
+	}
+	return v[len(v)-1]
+}
+
+// printTable prints rows in tab separated form when scripted, or aligned under headers otherwise.
+func printTable(w io.Writer, headers []string, rows [][]string, scripted bool) {
+	if scripted {
+		for _, r := range rows {
+			fmt.Fprintln(w, strings.Join(r, "\t"))
+		}
+		return
+	}
+
+	widths := make([]int, len(headers))
+	for i, h := range headers {
+		widths[i] = len(h)
+	}
+	for _, r := range rows {
+		for i, c := range r {
+			if len(c) > widths[i] {
+				widths[i] = len(c)
+			}
+		}
+	}
+	line := func(cells []string) {
+		var b strings.Builder
+		for i, c := range cells {
+			if i == len(cells)-1 {
+				b.WriteString(c)
+				break
+			}
+			fmt.Fprintf(&b, "%-*s  ", widths[i], c)
+		}
+		fmt.Fprintln(w, b.String())
+	}
+	line(headers)
+	for _, r := range rows {
+		line(r)
+	}
+}
+
+// StateDirEnv is the environment variable pointing mocks to the state directory. When unset, mocks use the real
+// system commands.
+const StateDirEnv = "TEST_MOCKZFS_STATE_DIR"
+
+// Command is an emulated command operating on the state.
+type Command func(s *State, args []string, stdout, stderr io.Writer) int
+
+// Run opens the state in dir, runs cmd and saves the state unless the command wasn't handled.
+func Run(dir string, cmd Command, args []string, stdout, stderr io.Writer) int {
+	s, err := Open(dir)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	defer s.Close()
+
+	ret := cmd(s, args, stdout, stderr)
+	if ret == NotHandled {
+		return ret
+	}
+	if err := s.Save(); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	return ret
+}
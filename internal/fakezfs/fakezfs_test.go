@@ -0,0 +1,614 @@
+package fakezfs
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestState returns a state with a "rpool" pool, backed by a vdev file in the returned directory.
+func newTestState(t *testing.T) (*State, string, func()) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "fakezfs-")
+	if err != nil {
+		t.Fatal("couldn't create temporary directory", err)
+	}
+	s, err := Open(filepath.Join(dir, "state"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal("couldn't open state", err)
+	}
+	vdev := filepath.Join(dir, "main.disk")
+	if err := ioutil.WriteFile(vdev, nil, 0644); err != nil {
+		t.Fatal("couldn't create vdev", err)
+	}
+	if _, err := s.CreatePool("rpool", []string{vdev}, map[string]string{"altroot": filepath.Join(dir, "main")}); err != nil {
+		t.Fatal("couldn't create pool", err)
+	}
+	return s, dir, func() {
+		s.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// run runs cmd on the state and returns its exit code and outputs.
+func run(s *State, cmd Command, args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	ret := cmd(s, args, &stdout, &stderr)
+	return ret, stdout.String(), stderr.String()
+}
+
+func TestZfsListOrder(t *testing.T) {
+	s, _, cleanUp := newTestState(t)
+	defer cleanUp()
+
+	for _, name := range []string{"rpool/ROOT", "rpool/ROOT/ubuntu_b", "rpool/ROOT/ubuntu_a", "rpool/ROOT/ubuntu_b@snap2"} {
+		var err error
+		if strings.Contains(name, "@") {
+			_, err = s.Snapshot(name)
+		} else {
+			_, err = s.CreateDataset(name)
+		}
+		if err != nil {
+			t.Fatal("couldn't create dataset", err)
+		}
+	}
+	// snapshots are sorted by creation transaction, not name
+	if _, err := s.Snapshot("rpool/ROOT/ubuntu_b@snap1"); err != nil {
+		t.Fatal("couldn't create snapshot", err)
+	}
+
+	ret, out, _ := run(s, Zfs, "list", "-H", "-o", "name", "-t", "all")
+	assert.Equal(t, 0, ret)
+	assert.Equal(t, "rpool\nrpool/ROOT\nrpool/ROOT/ubuntu_a\nrpool/ROOT/ubuntu_b\nrpool/ROOT/ubuntu_b@snap2\nrpool/ROOT/ubuntu_b@snap1\n", out)
+
+	ret, out, _ = run(s, Zfs, "list", "-H", "-o", "name", "-t", "snapshot", "rpool/ROOT/ubuntu_b")
+	assert.Equal(t, 0, ret)
+	assert.Equal(t, "rpool/ROOT/ubuntu_b@snap2\nrpool/ROOT/ubuntu_b@snap1\n", out)
+}
+
+func TestZfsGet(t *testing.T) {
+	s, dir, cleanUp := newTestState(t)
+	defer cleanUp()
+
+	if _, err := s.CreateDataset("rpool/ROOT"); err != nil {
+		t.Fatal("couldn't create dataset", err)
+	}
+	if _, err := s.CreateDataset("rpool/ROOT/ubuntu"); err != nil {
+		t.Fatal("couldn't create dataset", err)
+	}
+	if err := s.SetProperty("rpool/ROOT", "mountpoint", "/"); err != nil {
+		t.Fatal("couldn't set mountpoint", err)
+	}
+	if err := s.SetProperty("rpool/ROOT/ubuntu", "com.ubuntu.zsys:bootfs", "yes"); err != nil {
+		t.Fatal("couldn't set user property", err)
+	}
+	creation := time.Date(2019, time.April, 18, 4, 0, 0, 0, time.UTC)
+	if err := s.SetCreation("rpool/ROOT/ubuntu", creation); err != nil {
+		t.Fatal("couldn't set creation", err)
+	}
+
+	testCases := map[string]struct {
+		args    []string
+		wantRet int
+		want    string
+	}{
+		"inherited mountpoint with altroot": {
+			args: []string{"get", "-H", "-o", "value,source", "mountpoint", "rpool/ROOT/ubuntu"},
+			want: filepath.Join(dir, "main", "ubuntu") + "\tinherited from rpool/ROOT\n"},
+		"user property": {
+			args: []string{"get", "-H", "-o", "value,source", "com.ubuntu.zsys:bootfs", "rpool/ROOT/ubuntu"},
+			want: "yes\tlocal\n"},
+		"unset user property": {
+			args: []string{"get", "-H", "-o", "value,source", "com.ubuntu.zsys:bootfs", "rpool/ROOT"},
+			want: "-\t-\n"},
+		"parsable creation": {
+			args: []string{"get", "-pH", "-o", "value", "creation", "rpool/ROOT/ubuntu"},
+			want: "1555560000\n"},
+		"canmount default": {
+			args: []string{"get", "-H", "-o", "value,source", "canmount", "rpool/ROOT/ubuntu"},
+			want: "on\tdefault\n"},
+
+		"invalid property": {
+			args:    []string{"get", "-H", "doesnotexist", "rpool/ROOT/ubuntu"},
+			wantRet: 2},
+		"unknown dataset": {
+			args:    []string{"get", "-H", "mountpoint", "rpool/doesnotexist"},
+			wantRet: 1},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			ret, out, _ := run(s, Zfs, tc.args...)
+			assert.Equal(t, tc.wantRet, ret, "unexpected exit code")
+			if tc.wantRet != 0 {
+				return
+			}
+			assert.Equal(t, tc.want, out)
+		})
+	}
+}
+
+func TestZpoolImportExport(t *testing.T) {
+	s, dir, cleanUp := newTestState(t)
+	defer cleanUp()
+
+	if err := s.ExportPool("rpool"); err != nil {
+		t.Fatal("couldn't export pool", err)
+	}
+	ret, out, _ := run(s, Zpool, "list")
+	assert.Equal(t, 0, ret)
+	assert.Equal(t, "no pools available\n", out)
+
+	// vdevs are only found in the searched directories
+	ret, _, _ = run(s, Zpool, "import", "-a", "-N", "-d", "/doesnotexist")
+	assert.Equal(t, 0, ret)
+	assert.Empty(t, s.ImportedPools(), "pool shouldn't have been imported")
+
+	ret, _, _ = run(s, Zpool, "import", "-f", "-a", "-o", "cachefile=none", "-o", "readonly=on", "-N", "-d", dir)
+	assert.Equal(t, 0, ret)
+	assert.Equal(t, []string{"rpool"}, s.ImportedPools())
+
+	ret, out, _ = run(s, Zpool, "get", "-H", "-o", "value", "readonly", "rpool")
+	assert.Equal(t, 0, ret)
+	assert.Equal(t, "on\n", out)
+
+	ret, _, _ = run(s, Zpool, "export", "rpool")
+	assert.Equal(t, 0, ret)
+	assert.Empty(t, s.ImportedPools(), "pool should have been exported")
+
+	// pools with wiped labels can't be found anymore
+	s.Pool("rpool").Corruption = CorruptLabels
+	run(s, Zpool, "import", "-a", "-N", "-d", dir)
+	assert.Empty(t, s.ImportedPools(), "corrupted pool shouldn't have been imported")
+}
+
+func TestZpoolImportPoolStates(t *testing.T) {
+	testCases := map[string]struct {
+		mirror       bool
+		state        string
+		corruption   string
+		removeVdev   bool
+		importOpts   []string
+		wantImported bool
+		wantHealth   string
+		wantStderr   string
+	}{
+		"online":                  {wantImported: true, wantHealth: "ONLINE"},
+		"degraded mirror":         {mirror: true, removeVdev: true, wantImported: true, wantHealth: "DEGRADED"},
+		"missing vdev":            {removeVdev: true, wantStderr: "one or more devices is currently unavailable"},
+		"foreign":                 {state: PoolForeign, wantStderr: "previously in use from another system"},
+		"foreign forced":          {state: PoolForeign, importOpts: []string{"-f"}, wantImported: true, wantHealth: "ONLINE"},
+		"readonly":                {state: PoolReadOnly, wantStderr: "unsupported version or feature"},
+		"readonly imported as is": {state: PoolReadOnly, importOpts: []string{"-o", "readonly=on"}, wantImported: true, wantHealth: "ONLINE"},
+		"locked":                  {state: PoolLocked, wantImported: true, wantHealth: "ONLINE", wantStderr: "encryption key not loaded"},
+		"scrambled uberblocks":    {corruption: CorruptUberblocks, wantStderr: "I/O error"},
+		"truncated vdevs":         {corruption: CorruptTruncate, wantStderr: "one or more devices is currently unavailable"},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			s, dir, cleanUp := newTestState(t)
+			defer cleanUp()
+
+			second := filepath.Join(dir, "second.disk")
+			if err := ioutil.WriteFile(second, nil, 0644); err != nil {
+				t.Fatal("couldn't create vdev", err)
+			}
+			p := s.Pool("rpool")
+			p.Vdevs = append(p.Vdevs, second)
+			if tc.mirror {
+				p.Topology = []Vdev{{Type: VdevMirror, Devices: p.Vdevs}}
+			}
+			if _, err := s.CreateDataset("rpool/ROOT"); err != nil {
+				t.Fatal("couldn't create dataset", err)
+			}
+			if err := s.SetProperty("rpool/ROOT", "mountpoint", "/"); err != nil {
+				t.Fatal("couldn't set mountpoint", err)
+			}
+			if err := s.ExportPool("rpool"); err != nil {
+				t.Fatal("couldn't export pool", err)
+			}
+			p.State = tc.state
+			p.Corruption = tc.corruption
+			if tc.removeVdev {
+				if err := os.Remove(second); err != nil {
+					t.Fatal("couldn't remove vdev", err)
+				}
+			}
+
+			args := append([]string{"import", "-a", "-d", dir}, tc.importOpts...)
+			ret, _, stderr := run(s, Zpool, args...)
+
+			if tc.wantStderr != "" {
+				assert.Equal(t, 1, ret, "import should fail")
+				assert.Contains(t, stderr, tc.wantStderr)
+			} else {
+				assert.Equal(t, 0, ret, "import should succeed")
+			}
+			if !tc.wantImported {
+				assert.Empty(t, s.ImportedPools(), "pool shouldn't have been imported")
+				return
+			}
+			assert.Equal(t, []string{"rpool"}, s.ImportedPools())
+			_, out, _ := run(s, Zpool, "get", "-H", "-o", "value", "health", "rpool")
+			assert.Equal(t, tc.wantHealth+"\n", out)
+		})
+	}
+}
+
+func TestPoolTopology(t *testing.T) {
+	testCases := map[string]struct {
+		topology []Vdev
+		remove   []string
+
+		wantHealth string
+		wantConfig string
+	}{
+		"stripe": {
+			topology:   []Vdev{{Type: VdevDisk, Devices: []string{"a"}}, {Type: VdevDisk, Devices: []string{"b"}}},
+			wantHealth: "ONLINE",
+			wantConfig: "\t  a\tONLINE\n\t  b\tONLINE\n"},
+		"raidz1 losing one device": {
+			topology:   []Vdev{{Type: "raidz1", Devices: []string{"a", "b", "c"}}},
+			remove:     []string{"c"},
+			wantHealth: "DEGRADED",
+			wantConfig: "\t  raidz1-0\tDEGRADED\n\t    a\tONLINE\n\t    b\tONLINE\n\t    c\tUNAVAIL\n"},
+		"raidz1 losing two devices": {
+			topology: []Vdev{{Type: "raidz1", Devices: []string{"a", "b", "c"}}},
+			remove:   []string{"b", "c"}},
+		"raidz2 losing two devices": {
+			topology:   []Vdev{{Type: "raidz2", Devices: []string{"a", "b", "c", "d"}}},
+			remove:     []string{"c", "d"},
+			wantHealth: "DEGRADED"},
+		"stripe of mirrors losing one device per mirror": {
+			topology:   []Vdev{{Type: VdevMirror, Devices: []string{"a", "b"}}, {Type: VdevMirror, Devices: []string{"c", "d"}}},
+			remove:     []string{"b", "d"},
+			wantHealth: "DEGRADED"},
+		"stripe of mirrors losing a mirror": {
+			topology: []Vdev{{Type: VdevMirror, Devices: []string{"a", "b"}}, {Type: VdevMirror, Devices: []string{"c", "d"}}},
+			remove:   []string{"c", "d"}},
+		"allocation classes": {
+			topology: []Vdev{
+				{Type: VdevDisk, Class: ClassCache, Devices: []string{"d"}},
+				{Type: VdevMirror, Devices: []string{"a", "b"}},
+				{Type: VdevDisk, Class: ClassLog, Devices: []string{"c"}},
+				{Type: VdevDisk, Class: ClassSpecial, Devices: []string{"e"}}},
+			wantHealth: "ONLINE",
+			wantConfig: "\t  mirror-1\tONLINE\n\t    a\tONLINE\n\t    b\tONLINE\n" +
+				"\tspecial\n\t  e\tONLINE\n\tlogs\n\t  c\tONLINE\n\tcache\n\t  d\tONLINE\n"},
+		"missing cache device": {
+			topology:   []Vdev{{Type: VdevDisk, Devices: []string{"a"}}, {Type: VdevDisk, Class: ClassCache, Devices: []string{"b"}}},
+			remove:     []string{"b"},
+			wantHealth: "ONLINE"},
+		"degraded log mirror": {
+			topology:   []Vdev{{Type: VdevDisk, Devices: []string{"a"}}, {Type: VdevMirror, Class: ClassLog, Devices: []string{"b", "c"}}},
+			remove:     []string{"c"},
+			wantHealth: "DEGRADED"},
+		"missing special device": {
+			topology: []Vdev{{Type: VdevDisk, Devices: []string{"a"}}, {Type: VdevDisk, Class: ClassSpecial, Devices: []string{"b"}}},
+			remove:   []string{"b"}},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			s, dir, cleanUp := newTestState(t)
+			defer cleanUp()
+
+			// device names are relative to the test directory
+			path := func(name string) string { return filepath.Join(dir, name) }
+			p := s.Pool("rpool")
+			p.Vdevs = nil
+			var topology []Vdev
+			for _, v := range tc.topology {
+				var devices []string
+				for _, d := range v.Devices {
+					if err := ioutil.WriteFile(path(d), nil, 0644); err != nil {
+						t.Fatal("couldn't create vdev", err)
+					}
+					p.Vdevs = append(p.Vdevs, path(d))
+					devices = append(devices, path(d))
+				}
+				topology = append(topology, Vdev{Type: v.Type, Class: v.Class, Devices: devices})
+			}
+			if err := p.SetTopology(topology); err != nil {
+				t.Fatal("couldn't set topology", err)
+			}
+			if err := s.ExportPool("rpool"); err != nil {
+				t.Fatal("couldn't export pool", err)
+			}
+			for _, d := range tc.remove {
+				if err := os.Remove(path(d)); err != nil {
+					t.Fatal("couldn't remove vdev", err)
+				}
+			}
+
+			_, out, _ := run(s, Zpool, "import", "-d", dir)
+			if tc.wantConfig != "" {
+				assert.Contains(t, strings.Replace(out, dir+"/", "", -1), "\trpool\t"+tc.wantHealth+"\n"+tc.wantConfig)
+			}
+
+			ret, _, stderr := run(s, Zpool, "import", "-a", "-N", "-d", dir)
+			if tc.wantHealth == "" {
+				assert.Equal(t, 1, ret, "import should fail")
+				assert.Contains(t, stderr, "one or more devices is currently unavailable")
+				assert.Empty(t, s.ImportedPools(), "pool shouldn't have been imported")
+				return
+			}
+			assert.Equal(t, 0, ret, "import should succeed")
+			_, out, _ = run(s, Zpool, "get", "-H", "-o", "value", "health", "rpool")
+			assert.Equal(t, tc.wantHealth+"\n", out)
+		})
+	}
+}
+
+func TestSetInvalidTopology(t *testing.T) {
+	testCases := map[string][]Vdev{
+		"unknown type":            {{Type: "draid", Devices: []string{"a", "b"}}},
+		"mirror of one device":    {{Type: VdevMirror, Devices: []string{"a"}}, {Type: VdevDisk, Devices: []string{"b"}}},
+		"raidz2 of two devices":   {{Type: "raidz2", Devices: []string{"a", "b"}}},
+		"raidz4":                  {{Type: "raidz4", Devices: []string{"a", "b"}}},
+		"unknown class":           {{Type: VdevDisk, Devices: []string{"a"}}, {Type: VdevDisk, Class: "dedup", Devices: []string{"b"}}},
+		"mirrored cache":          {{Type: VdevDisk, Devices: []string{"a"}}, {Type: VdevMirror, Class: ClassCache, Devices: []string{"b", "c"}}},
+		"no data vdev":            {{Type: VdevMirror, Class: ClassLog, Devices: []string{"a", "b"}}},
+		"device in several vdevs": {{Type: VdevDisk, Devices: []string{"a"}}, {Type: VdevMirror, Devices: []string{"a", "b"}}},
+		"unused device":           {{Type: VdevDisk, Devices: []string{"a"}}},
+		"unknown device":          {{Type: VdevMirror, Devices: []string{"a", "b", "c"}}},
+	}
+
+	for name, topology := range testCases {
+		topology := topology
+		t.Run(name, func(t *testing.T) {
+			p := &Pool{Name: "rpool", Vdevs: []string{"a", "b"}}
+			assert.Error(t, p.SetTopology(topology), "invalid topology should be refused")
+			assert.Empty(t, p.Topology, "topology shouldn't have been set")
+		})
+	}
+}
+
+func TestPoolFeatures(t *testing.T) {
+	testCases := map[string]struct {
+		features      []string
+		compatibility string
+		special       bool
+
+		wantEnabled  []string
+		wantDisabled []string
+		wantErr      bool
+	}{
+		"all features by default": {wantEnabled: []string{"lz4_compress", "encryption", "allocation_classes"}},
+		"restricted features": {
+			features:     []string{"lz4_compress", "hole_birth"},
+			wantEnabled:  []string{"lz4_compress", "hole_birth"},
+			wantDisabled: []string{"encryption", "large_blocks"}},
+		"grub2 compatibility": {
+			compatibility: "grub2",
+			wantEnabled:   []string{"lz4_compress", "large_blocks"},
+			wantDisabled:  []string{"encryption", "large_dnode"}},
+		"compatibility off":                    {compatibility: "off", wantEnabled: []string{"encryption"}},
+		"restricted features with special":     {features: []string{"allocation_classes"}, special: true, wantEnabled: []string{"allocation_classes"}},
+		"grub2 compatible features":            {features: []string{"lz4_compress"}, compatibility: "grub2", wantEnabled: []string{"lz4_compress"}},
+		"error on incompatible features":       {features: []string{"encryption"}, compatibility: "grub2", wantErr: true},
+		"error on unknown compatibility":       {compatibility: "grub0", wantErr: true},
+		"error on unknown feature":             {features: []string{"time_travel"}, wantErr: true},
+		"error on special without its feature": {features: []string{"lz4_compress"}, special: true, wantErr: true},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			s, dir, cleanUp := newTestState(t)
+			defer cleanUp()
+
+			p := s.Pool("rpool")
+			if tc.compatibility != "" {
+				p.Properties["compatibility"] = tc.compatibility
+			}
+			if tc.special {
+				special := filepath.Join(dir, "special.disk")
+				p.Vdevs = append(p.Vdevs, special)
+				p.Topology = []Vdev{{Type: VdevDisk, Devices: p.Vdevs[:1]}, {Type: VdevDisk, Class: ClassSpecial, Devices: []string{special}}}
+			}
+
+			err := p.SetFeatures(tc.features)
+			if tc.wantErr {
+				assert.Error(t, err, "SetFeatures should fail")
+				return
+			}
+			if err != nil {
+				t.Fatal("couldn't set features", err)
+			}
+			for _, f := range tc.wantEnabled {
+				_, out, _ := run(s, Zpool, "get", "-H", "-o", "value", "feature@"+f, "rpool")
+				assert.Equal(t, "enabled\n", out, "feature %s should be enabled", f)
+			}
+			for _, f := range tc.wantDisabled {
+				_, out, _ := run(s, Zpool, "get", "-H", "-o", "value", "feature@"+f, "rpool")
+				assert.Equal(t, "disabled\n", out, "feature %s should be disabled", f)
+			}
+		})
+	}
+}
+
+func TestLockedPoolDatasets(t *testing.T) {
+	s, _, cleanUp := newTestState(t)
+	defer cleanUp()
+
+	if _, err := s.CreateDataset("rpool/ROOT"); err != nil {
+		t.Fatal("couldn't create dataset", err)
+	}
+	s.Pool("rpool").State = PoolLocked
+
+	ret, out, _ := run(s, Zfs, "get", "-H", "-o", "value", "encryption,keystatus,encryptionroot", "rpool/ROOT")
+	assert.Equal(t, 0, ret)
+	assert.Equal(t, "aes-256-gcm\nunavailable\nrpool\n", out)
+
+	ret, _, stderr := run(s, MountCmd, "-o", "zfsutil", "-t", "zfs", "rpool/ROOT", s.Dir())
+	assert.Equal(t, 1, ret, "datasets of locked pools can't be mounted")
+	assert.Contains(t, stderr, "Permission denied")
+}
+
+func TestEncryptedDatasets(t *testing.T) {
+	s, _, cleanUp := newTestState(t)
+	defer cleanUp()
+
+	if _, err := s.CreateEncryptedDataset("rpool/ROOT", "on", "passphrase", "file:///tmp/key"); err != nil {
+		t.Fatal("couldn't create encrypted dataset", err)
+	}
+	if _, err := s.CreateDataset("rpool/ROOT/ubuntu"); err != nil {
+		t.Fatal("couldn't create dataset", err)
+	}
+	if err := s.SetProperty("rpool/ROOT/ubuntu", "mountpoint", "/"); err != nil {
+		t.Fatal("couldn't set mountpoint", err)
+	}
+
+	props := "encryption,keyformat,keylocation,keystatus,encryptionroot"
+	ret, out, _ := run(s, Zfs, "get", "-H", "-o", "value", props, "rpool/ROOT/ubuntu")
+	assert.Equal(t, 0, ret)
+	assert.Equal(t, "aes-256-gcm\npassphrase\nnone\navailable\nrpool/ROOT\n", out, "children inherit encryption")
+	ret, out, _ = run(s, Zfs, "get", "-H", "-o", "value", props, "rpool")
+	assert.Equal(t, 0, ret)
+	assert.Equal(t, "off\nnone\nnone\n-\n-\n", out, "parents aren't encrypted")
+
+	assert.NoError(t, s.MountDataset("rpool/ROOT/ubuntu"), "datasets with their key loaded can be mounted")
+	assert.Error(t, s.UnloadKey("rpool/ROOT"), "keys of mounted datasets can't be unloaded")
+	assert.Error(t, s.UnloadKey("rpool/ROOT/ubuntu"), "only encryption roots have a key")
+	assert.NoError(t, s.UnmountSource("rpool/ROOT/ubuntu"))
+	assert.NoError(t, s.UnloadKey("rpool/ROOT"))
+
+	ret, out, _ = run(s, Zfs, "get", "-H", "-o", "value", "keystatus", "rpool/ROOT/ubuntu")
+	assert.Equal(t, 0, ret)
+	assert.Equal(t, "unavailable\n", out)
+	ret, _, stderr := run(s, Zfs, "mount", "rpool/ROOT/ubuntu")
+	assert.Equal(t, 1, ret, "datasets without their key loaded can't be mounted")
+	assert.Contains(t, stderr, "encryption key not loaded")
+}
+
+func TestClonesAndBookmarks(t *testing.T) {
+	s, _, cleanUp := newTestState(t)
+	defer cleanUp()
+
+	if _, err := s.CreateDataset("rpool/ROOT"); err != nil {
+		t.Fatal("couldn't create dataset", err)
+	}
+	if _, err := s.CreateDataset("rpool/ROOT/ubuntu_a"); err != nil {
+		t.Fatal("couldn't create dataset", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(s.StorageDir("rpool/ROOT/ubuntu_a"), "content"), []byte("snap1"), 0644); err != nil {
+		t.Fatal("couldn't write dataset content", err)
+	}
+	for _, name := range []string{"rpool/ROOT/ubuntu_a@snap1", "rpool/ROOT/ubuntu_a@snap2"} {
+		if _, err := s.Snapshot(name); err != nil {
+			t.Fatal("couldn't create snapshot", err)
+		}
+	}
+
+	_, err := s.Clone("rpool/ROOT/ubuntu_a@snap1", "rpool/ROOT/ubuntu_b")
+	assert.NoError(t, err)
+	assertDirContent(t, s.StorageDir("rpool/ROOT/ubuntu_b"), map[string]string{"content": "snap1"})
+	_, err = s.Clone("rpool/ROOT/ubuntu_a@doesnotexist", "rpool/ROOT/ubuntu_c")
+	assert.Error(t, err, "clones need an existing snapshot")
+	_, err = s.Clone("rpool/ROOT/ubuntu_a@snap1", "bpool/ubuntu_c")
+	assert.Error(t, err, "clones are in the pool of their snapshot")
+
+	ret, out, _ := run(s, Zfs, "get", "-H", "-o", "name,value", "origin", "rpool/ROOT/ubuntu_a", "rpool/ROOT/ubuntu_b")
+	assert.Equal(t, 0, ret)
+	assert.Equal(t, "rpool/ROOT/ubuntu_a\t-\nrpool/ROOT/ubuntu_b\trpool/ROOT/ubuntu_a@snap1\n", out)
+
+	assert.Error(t, s.Promote("rpool/ROOT/ubuntu_a"), "only clones can be promoted")
+	assert.NoError(t, s.Promote("rpool/ROOT/ubuntu_b"))
+	ret, out, _ = run(s, Zfs, "get", "-H", "-o", "name,value", "origin", "rpool/ROOT/ubuntu_a", "rpool/ROOT/ubuntu_b")
+	assert.Equal(t, 0, ret)
+	assert.Equal(t, "rpool/ROOT/ubuntu_a\trpool/ROOT/ubuntu_b@snap1\nrpool/ROOT/ubuntu_b\t-\n", out,
+		"origin should be swapped after promotion")
+	ret, out, _ = run(s, Zfs, "list", "-H", "-o", "name", "-t", "snapshot")
+	assert.Equal(t, 0, ret)
+	assert.Equal(t, "rpool/ROOT/ubuntu_a@snap2\nrpool/ROOT/ubuntu_b@snap1\n", out,
+		"snapshots up to the origin should move to the promoted clone")
+	assertDirContent(t, s.StorageDir("rpool/ROOT/ubuntu_b@snap1"), map[string]string{"content": "snap1"})
+
+	_, err = s.Bookmark("rpool/ROOT/ubuntu_a@snap2", "rpool/ROOT/ubuntu_a#snap2")
+	assert.NoError(t, err)
+	_, err = s.Bookmark("rpool/ROOT/ubuntu_a@snap2", "rpool/ROOT/ubuntu_b#snap2")
+	assert.Error(t, err, "bookmarks are on the filesystem of their snapshot")
+	assert.Error(t, s.SetProperty("rpool/ROOT/ubuntu_a#snap2", "canmount", "off"), "bookmarks have no settable properties")
+
+	ret, out, _ = run(s, Zfs, "list", "-H", "-o", "name", "-r", "rpool/ROOT/ubuntu_a")
+	assert.Equal(t, 0, ret)
+	assert.Equal(t, "rpool/ROOT/ubuntu_a\n", out, "bookmarks aren't listed by default")
+	ret, out, _ = run(s, Zfs, "list", "-H", "-o", "name,type,canmount", "-t", "all", "-r", "rpool/ROOT/ubuntu_a")
+	assert.Equal(t, 0, ret)
+	assert.Equal(t, "rpool/ROOT/ubuntu_a\tfilesystem\ton\nrpool/ROOT/ubuntu_a@snap2\tsnapshot\t-\n"+
+		"rpool/ROOT/ubuntu_a#snap2\tbookmark\t-\n", out)
+	ret, out, _ = run(s, Zfs, "get", "-H", "-o", "value", "guid", "rpool/ROOT/ubuntu_a@snap2", "rpool/ROOT/ubuntu_a#snap2")
+	assert.Equal(t, 0, ret)
+	lines := strings.Split(out, "\n")
+	assert.Equal(t, lines[0], lines[1], "bookmarks share the guid of their snapshot")
+}
+
+func TestMountShadowsContent(t *testing.T) {
+	s, dir, cleanUp := newTestState(t)
+	defer cleanUp()
+
+	if _, err := s.CreateDataset("rpool/ROOT"); err != nil {
+		t.Fatal("couldn't create dataset", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(s.StorageDir("rpool/ROOT"), "content"), []byte("dataset"), 0644); err != nil {
+		t.Fatal("couldn't write dataset content", err)
+	}
+	target := filepath.Join(dir, "target")
+	if err := os.MkdirAll(target, 0755); err != nil {
+		t.Fatal("couldn't create mount target", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(target, "previous"), []byte("previous"), 0644); err != nil {
+		t.Fatal("couldn't write previous content", err)
+	}
+
+	ret, _, stderr := run(s, MountCmd, "-t", "zfs", "rpool/ROOT", target)
+	assert.Equal(t, 1, ret, "mount without zfsutil should fail on non legacy datasets")
+	assert.Contains(t, stderr, "cannot be mounted using 'mount'")
+
+	ret, _, _ = run(s, MountCmd, "-o", "noatime,zfsutil", "-t", "zfs", "rpool/ROOT", target)
+	assert.Equal(t, 0, ret)
+	assertDirContent(t, target, map[string]string{"content": "dataset"})
+
+	dev, ok := s.DeviceOf(filepath.Join(target, "content"))
+	assert.True(t, ok, "mounted path should be backed by a device")
+	assert.Equal(t, filepath.Join(dir, "main.disk"), dev)
+
+	ret, _, _ = run(s, UmountCmd, target)
+	assert.Equal(t, 0, ret)
+	assertDirContent(t, target, map[string]string{"previous": "previous"})
+
+	assert.Equal(t, NotHandled, MountCmd(s, []string{"/dev/sda1", target}, ioutil.Discard, ioutil.Discard),
+		"unknown devices should be delegated to the system mount")
+}
+
+// assertDirContent checks that dir contains exactly the files of want, with their content.
+func assertDirContent(t *testing.T, dir string, want map[string]string) {
+	t.Helper()
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal("couldn't read directory", err)
+	}
+	got := make(map[string]string)
+	for _, e := range entries {
+		b, err := ioutil.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			t.Fatal("couldn't read file", err)
+		}
+		got[e.Name()] = string(b)
+	}
+	assert.Equal(t, want, got)
+}
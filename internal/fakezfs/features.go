@@ -0,0 +1,83 @@
+package fakezfs
+
+import (
+	"fmt"
+	"strings"
+)
+
+const featurePrefix = "feature@"
+
+// poolFeatures are the supported pool features, enabled on pools created without a restricted feature set.
+var poolFeatures = []string{"async_destroy", "empty_bpobj", "lz4_compress", "multi_vdev_crash_dump",
+	"spacemap_histogram", "enabled_txg", "hole_birth", "extensible_dataset", "embedded_data", "bookmarks",
+	"filesystem_limits", "large_blocks", "large_dnode", "sha512", "skein", "edonr", "userobj_accounting", "encryption",
+	"project_quota", "device_removal", "obsolete_counts", "zpool_checkpoint", "spacemap_v2", "allocation_classes",
+	"resilver_defer", "bookmark_v2"}
+
+// compatibilitySets are the features allowed by the values of the compatibility pool property, as listed in
+// /usr/share/zfs/compatibility.d.
+var compatibilitySets = map[string][]string{
+	// grub2 features are the ones GRUB can read.
+	"grub2": {"async_destroy", "bookmarks", "embedded_data", "empty_bpobj", "enabled_txg", "extensible_dataset",
+		"filesystem_limits", "hole_birth", "large_blocks", "lz4_compress", "spacemap_histogram"},
+}
+
+// isFeatureProperty returns if prop is the feature@ property of a supported feature.
+func isFeatureProperty(prop string) bool {
+	return strings.HasPrefix(prop, featurePrefix) && contains(poolFeatures, strings.TrimPrefix(prop, featurePrefix))
+}
+
+// IncompatibleFeatures returns the features which aren't part of the compatibility set.
+func IncompatibleFeatures(compatibility string, features []string) []string {
+	var r []string
+	for _, f := range features {
+		if !contains(compatibilitySets[compatibility], f) {
+			r = append(r, f)
+		}
+	}
+	return r
+}
+
+// EnabledFeatures returns the features enabled on the pool.
+func (p *Pool) EnabledFeatures() []string {
+	if p.Features == nil {
+		return poolFeatures
+	}
+	return p.Features
+}
+
+// SetFeatures restricts the features enabled on the pool, as when it's created with zpool create -d. Without
+// features, the ones allowed by the compatibility property of the pool are enabled, or all of them.
+func (p *Pool) SetFeatures(features []string) error {
+	compatibility := p.Properties["compatibility"]
+	if compatibility == "off" {
+		compatibility = ""
+	} else if _, ok := compatibilitySets[compatibility]; compatibility != "" && !ok {
+		return fmt.Errorf("cannot create '%s': unknown compatibility '%s'", p.Name, compatibility)
+	}
+	if features == nil && compatibility != "" {
+		features = compatibilitySets[compatibility]
+	}
+	if features == nil {
+		p.Features = nil
+		return nil
+	}
+
+	for _, f := range features {
+		if !contains(poolFeatures, f) {
+			return fmt.Errorf("cannot create '%s': invalid feature '%s'", p.Name, f)
+		}
+	}
+	if compatibility != "" {
+		if incompatible := IncompatibleFeatures(compatibility, features); len(incompatible) > 0 {
+			return fmt.Errorf("cannot create '%s': feature '%s' is incompatible with '%s'", p.Name, incompatible[0], compatibility)
+		}
+	}
+	for _, v := range p.Topology {
+		if v.Class == ClassSpecial && !contains(features, "allocation_classes") {
+			return fmt.Errorf("cannot create '%s': special vdevs need feature 'allocation_classes'", p.Name)
+		}
+	}
+	p.Features = append([]string{}, features...)
+	return nil
+}
@@ -0,0 +1,378 @@
+package fakezfs
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// NotHandled is returned by command emulations when the command doesn't target the simulated system and should be
+// delegated to the real binary.
+const NotHandled = -1
+
+// Mount mounts a dataset, snapshot or device on target. If materialize is set, the content is copied to target,
+// hiding what was there before until it is unmounted.
+func (s *State) Mount(source, target string, materialize bool) error {
+	target = filepath.Clean(target)
+	if !s.isMountable(source) {
+		return fmt.Errorf("'%s' does not exist", source)
+	}
+	// Only materialized mounts can't be stacked, as their content would be mixed.
+	if existing := s.mountAt(target); existing != nil && materialize {
+		return fmt.Errorf("%s is already mounted on %s", existing.Source, target)
+	}
+
+	m := &Mount{Source: source, Target: target, Materialized: materialize}
+	if materialize {
+		fi, err := os.Stat(target)
+		if err != nil || !fi.IsDir() {
+			return fmt.Errorf("mount point %s does not exist", target)
+		}
+		shadow, err := ioutil.TempDir(s.dir, "shadow-")
+		if err != nil {
+			return fmt.Errorf("couldn't save content of %s: %v", target, err)
+		}
+		if err := moveContent(target, shadow); err != nil {
+			return fmt.Errorf("couldn't save content of %s: %v", target, err)
+		}
+		m.Shadow = shadow
+		if err := copyTree(s.StorageDir(source), target); err != nil {
+			return fmt.Errorf("couldn't mount %s on %s: %v", source, target, err)
+		}
+	}
+	s.Mounts = append(s.Mounts, m)
+	return nil
+}
+
+// Unmount unmounts the topmost mount on target. It fails if other mounts are nested under it.
+func (s *State) Unmount(target string) error {
+	target = filepath.Clean(target)
+	idx := -1
+	for i, m := range s.Mounts {
+		if m.Target == target {
+			idx = i
+			continue
+		}
+		if strings.HasPrefix(m.Target, target+"/") {
+			return fmt.Errorf("%s: target is busy", target)
+		}
+	}
+	if idx < 0 {
+		return fmt.Errorf("%s: not mounted", target)
+	}
+
+	m := s.Mounts[idx]
+	if m.Materialized {
+		if err := clearDir(m.Target); err != nil {
+			return fmt.Errorf("couldn't unmount %s: %v", target, err)
+		}
+		if err := moveContent(m.Shadow, m.Target); err != nil {
+			return fmt.Errorf("couldn't restore content of %s: %v", target, err)
+		}
+		if err := os.RemoveAll(m.Shadow); err != nil {
+			return fmt.Errorf("couldn't restore content of %s: %v", target, err)
+		}
+	}
+	s.Mounts = append(s.Mounts[:idx], s.Mounts[idx+1:]...)
+	return nil
+}
+
+// UnmountSource unmounts all mounts of source, deepest targets first.
+func (s *State) UnmountSource(source string) error {
+	var targets []string
+	for _, m := range s.Mounts {
+		if m.Source == source {
+			targets = append(targets, m.Target)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(targets)))
+	for _, t := range targets {
+		if err := s.Unmount(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mountOf returns the first mount of source, if any.
+func (s *State) mountOf(source string) *Mount {
+	for _, m := range s.Mounts {
+		if m.Source == source {
+			return m
+		}
+	}
+	return nil
+}
+
+// isMountable returns if source is an existing dataset, snapshot or device.
+func (s *State) isMountable(source string) bool {
+	if d, _ := s.Dataset(source); d != nil {
+		return true
+	}
+	return s.device(source) != nil
+}
+
+// DeviceOf returns the device path backing path, resolved from the longest mount target containing it.
+// For datasets, this is the first vdev of its pool.
+func (s *State) DeviceOf(path string) (string, bool) {
+	path = filepath.Clean(path)
+	var best *Mount
+	for _, m := range s.Mounts {
+		if path != m.Target && !strings.HasPrefix(path, m.Target+"/") && m.Target != "/" {
+			continue
+		}
+		if best == nil || len(m.Target) > len(best.Target) {
+			best = m
+		}
+	}
+	if best == nil {
+		return "", false
+	}
+	if d := s.device(best.Source); d != nil {
+		return d.Name, true
+	}
+	if p := s.Pool(poolName(best.Source)); p != nil && len(p.Vdevs) > 0 {
+		return p.Vdevs[0], true
+	}
+	return "", false
+}
+
+// MountCmd emulates mount(8) for datasets and devices of the state. It returns NotHandled for any other source.
+func MountCmd(s *State, args []string, stdout, stderr io.Writer) int {
+	var fstype string
+	var options []string
+	var positional []string
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		switch {
+		case a == "-t" || a == "-o":
+			if i+1 >= len(args) {
+				return NotHandled
+			}
+			i++
+			if a == "-t" {
+				fstype = args[i]
+			} else {
+				options = append(options, strings.Split(args[i], ",")...)
+			}
+		case strings.HasPrefix(a, "-t"):
+			fstype = a[2:]
+		case strings.HasPrefix(a, "-o"):
+			options = append(options, strings.Split(a[2:], ",")...)
+		case a == "-r" || a == "--read-only" || a == "-w" || a == "-n" || a == "-v":
+		case strings.HasPrefix(a, "-"):
+			return NotHandled
+		default:
+			positional = append(positional, a)
+		}
+	}
+	if len(positional) != 2 {
+		return NotHandled
+	}
+	source, target := positional[0], positional[1]
+
+	if s.device(source) == nil {
+		if fstype != "zfs" {
+			if d, _ := s.Dataset(source); d == nil {
+				return NotHandled
+			}
+		}
+		d, p := s.Dataset(source)
+		if d == nil {
+			fmt.Fprintf(stderr, "filesystem '%s' cannot be mounted, unable to open the dataset\n", source)
+			return 1
+		}
+		if s.keyUnavailable(p, d) {
+			fmt.Fprintf(stderr, "filesystem '%s' can not be mounted: Permission denied\n", source)
+			return 1
+		}
+		if !isSnapshot(source) && !contains(options, "zfsutil") {
+			if mp, _ := s.mountpoint(p, d); mp != "legacy" {
+				fmt.Fprintf(stderr, "filesystem '%s' cannot be mounted using 'mount'.\n"+
+					"Use 'zfs set mountpoint=legacy' or 'zfs mount %s'.\n", source, source)
+				return 1
+			}
+		}
+	}
+
+	if err := s.Mount(source, target, true); err != nil {
+		fmt.Fprintf(stderr, "mount: %v\n", err)
+		return 32
+	}
+	return 0
+}
+
+// UmountCmd emulates umount(8) for targets mounted in the state. It returns NotHandled for any other target.
+func UmountCmd(s *State, args []string, stdout, stderr io.Writer) int {
+	var recursive bool
+	var targets []string
+	for _, a := range args {
+		switch a {
+		case "-R", "--recursive":
+			recursive = true
+		case "-l", "-f", "-n", "-v", "--lazy", "--force":
+		default:
+			if strings.HasPrefix(a, "-") {
+				return NotHandled
+			}
+			targets = append(targets, a)
+		}
+	}
+	if len(targets) == 0 {
+		return NotHandled
+	}
+
+	var resolved []string
+	for _, t := range targets {
+		switch {
+		case s.mountAt(t) != nil:
+			resolved = append(resolved, filepath.Clean(t))
+		case s.mountOf(t) != nil:
+			resolved = append(resolved, s.mountOf(t).Target)
+		default:
+			return NotHandled
+		}
+	}
+
+	ret := 0
+	for _, t := range resolved {
+		if recursive {
+			var nested []string
+			for _, m := range s.Mounts {
+				if strings.HasPrefix(m.Target, t+"/") {
+					nested = append(nested, m.Target)
+				}
+			}
+			sort.Sort(sort.Reverse(sort.StringSlice(nested)))
+			for _, n := range nested {
+				if err := s.Unmount(n); err != nil {
+					fmt.Fprintf(stderr, "umount: %v\n", err)
+					ret = 32
+				}
+			}
+		}
+		if err := s.Unmount(t); err != nil {
+			fmt.Fprintf(stderr, "umount: %v\n", err)
+			ret = 32
+		}
+	}
+	return ret
+}
+
+// mountAt returns the mount on target, if any.
+func (s *State) mountAt(target string) *Mount {
+	target = filepath.Clean(target)
+	for _, m := range s.Mounts {
+		if m.Target == target {
+			return m
+		}
+	}
+	return nil
+}
+
+// copyTree copies src content into dst, preserving modes and access and modification times.
+// Times of src are restored after reading so that copies don't alter them.
+func copyTree(src, dst string) error {
+	type times struct{ atime, mtime time.Time }
+	var dirs []string
+	dirTimes := make(map[string]times)
+
+	err := filepath.Walk(src, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		t := times{atime: atime(fi), mtime: fi.ModTime()}
+
+		switch {
+		case fi.IsDir():
+			if err := os.MkdirAll(target, fi.Mode().Perm()); err != nil {
+				return err
+			}
+			dirs = append(dirs, p)
+			dirTimes[p] = t
+			return nil
+		case fi.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case fi.Mode().IsRegular():
+			b, err := ioutil.ReadFile(p)
+			if err != nil {
+				return err
+			}
+			if err := ioutil.WriteFile(target, b, fi.Mode().Perm()); err != nil {
+				return err
+			}
+			if err := os.Chtimes(target, t.atime, t.mtime); err != nil {
+				return err
+			}
+			return os.Chtimes(p, t.atime, t.mtime)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		rel, err := filepath.Rel(src, dirs[i])
+		if err != nil {
+			return err
+		}
+		t := dirTimes[dirs[i]]
+		if err := os.Chtimes(filepath.Join(dst, rel), t.atime, t.mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// atime returns the access time of a file.
+func atime(fi os.FileInfo) time.Time {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fi.ModTime()
+	}
+	return time.Unix(int64(st.Atim.Sec), int64(st.Atim.Nsec))
+}
+
+// moveContent moves all entries of src into dst.
+func moveContent(src, dst string) error {
+	entries, err := ioutil.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := os.Rename(filepath.Join(src, e.Name()), filepath.Join(dst, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// clearDir removes all entries of dir, keeping dir itself.
+func clearDir(dir string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,423 @@
+package fakezfs
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	sourceLocal   = "local"
+	sourceDefault = "default"
+	sourceNone    = "-"
+	inheritedFrom = "inherited from "
+)
+
+// propDef describes a native property.
+type propDef struct {
+	// inherit is set for properties flowing down from the parent dataset when not set locally.
+	inherit bool
+	// readonly properties can't be changed with zfs set.
+	readonly bool
+	// def and parsable are the default value, in human and parsable (-p) forms.
+	def      string
+	parsable string
+	// fsOnly properties are displayed as "-" on snapshots.
+	fsOnly bool
+}
+
+// datasetProps are the supported native dataset properties. Others are rejected as zfs does.
+var datasetProps = map[string]propDef{
+	"name":           {readonly: true},
+	"type":           {readonly: true},
+	"creation":       {readonly: true},
+	"guid":           {readonly: true},
+	"used":           {readonly: true, def: "96K", parsable: "98304"},
+	"available":      {readonly: true, def: "63.5M", parsable: "66584576", fsOnly: true},
+	"referenced":     {readonly: true, def: "96K", parsable: "98304"},
+	"compressratio":  {readonly: true, def: "1.00x", parsable: "1.00"},
+	"mounted":        {readonly: true, fsOnly: true},
+	"origin":         {readonly: true, def: "-"},
+	"mountpoint":     {inherit: true, fsOnly: true},
+	"canmount":       {def: "on", fsOnly: true},
+	"compression":    {inherit: true, def: "off"},
+	"atime":          {inherit: true, def: "on"},
+	"relatime":       {inherit: true, def: "off"},
+	"readonly":       {inherit: true, def: "off"},
+	"recordsize":     {inherit: true, def: "128K", parsable: "131072", fsOnly: true},
+	"xattr":          {inherit: true, def: "on"},
+	"acltype":        {inherit: true, def: "off"},
+	"devices":        {inherit: true, def: "on"},
+	"exec":           {inherit: true, def: "on"},
+	"setuid":         {inherit: true, def: "on"},
+	"encryption":     {readonly: true, def: "off"},
+	"keyformat":      {readonly: true, def: "none"},
+	"keylocation":    {def: "none"},
+	"keystatus":      {readonly: true, def: "-"},
+	"encryptionroot": {readonly: true, def: "-"},
+}
+
+// lockedProps are the encryption properties of datasets of locked pools, encrypted with a passphrase
+// which wasn't entered.
+var lockedProps = map[string]string{
+	"encryption":  "aes-256-gcm",
+	"keyformat":   "passphrase",
+	"keylocation": "prompt",
+	"keystatus":   "unavailable",
+}
+
+// datasetPropsOrder is the order in which "zfs get all" displays native properties.
+var datasetPropsOrder = []string{"type", "creation", "used", "available", "referenced", "compressratio", "mounted",
+	"origin", "recordsize", "mountpoint", "compression", "atime", "devices", "exec", "setuid", "readonly",
+	"canmount", "xattr", "guid", "relatime", "acltype", "encryption", "keylocation", "keyformat", "encryptionroot",
+	"keystatus"}
+
+// poolProps are the supported pool properties.
+var poolProps = map[string]propDef{
+	"name":          {readonly: true},
+	"size":          {readonly: true, def: "95.5M", parsable: "100139008"},
+	"capacity":      {readonly: true, def: "0%", parsable: "0"},
+	"allocated":     {readonly: true, def: "162K", parsable: "165888"},
+	"free":          {readonly: true, def: "95.3M", parsable: "99973120"},
+	"checkpoint":    {readonly: true, def: "-"},
+	"expandsize":    {readonly: true, def: "-"},
+	"fragmentation": {readonly: true, def: "1%", parsable: "1"},
+	"dedupratio":    {readonly: true, def: "1.00x", parsable: "1.00"},
+	"health":        {readonly: true, def: "ONLINE"},
+	"guid":          {readonly: true},
+	"altroot":       {def: "-"},
+	"readonly":      {def: "off"},
+	"cachefile":     {def: "-"},
+	"bootfs":        {def: "-"},
+	"failmode":      {def: "wait"},
+	"autoexpand":    {def: "off"},
+	"comment":       {def: "-"},
+	"ashift":        {def: "0"},
+	"compatibility": {def: "off"},
+}
+
+// poolPropsOrder is the order in which "zpool get all" displays properties.
+var poolPropsOrder = []string{"size", "capacity", "altroot", "health", "guid", "bootfs", "failmode", "cachefile",
+	"autoexpand", "dedupratio", "free", "allocated", "readonly", "ashift", "comment", "expandsize", "checkpoint",
+	"fragmentation", "compatibility"}
+
+// poolListColumns are the default "zpool list" columns, with their property name.
+var poolListColumns = []struct{ header, prop string }{
+	{"NAME", "name"}, {"SIZE", "size"}, {"ALLOC", "allocated"}, {"FREE", "free"}, {"CKPOINT", "checkpoint"},
+	{"EXPANDSZ", "expandsize"}, {"FRAG", "fragmentation"}, {"CAP", "capacity"}, {"DEDUP", "dedupratio"},
+	{"HEALTH", "health"}, {"ALTROOT", "altroot"},
+}
+
+// poolColumnAliases maps short "zpool list -o" column names to their property.
+var poolColumnAliases = map[string]string{"alloc": "allocated", "cap": "capacity", "frag": "fragmentation",
+	"dedup": "dedupratio", "ckpoint": "checkpoint", "expandsz": "expandsize"}
+
+// isUserProperty returns if prop is a user property (module:property).
+func isUserProperty(prop string) bool {
+	return strings.Contains(prop, ":")
+}
+
+// validDatasetProperty returns if prop can be queried on a dataset.
+func validDatasetProperty(prop string) bool {
+	if isUserProperty(prop) {
+		return true
+	}
+	_, ok := datasetProps[prop]
+	return ok
+}
+
+// parentName returns the name of the dataset prop are inherited from: the filesystem for a snapshot or a bookmark, the parent
+// dataset for a filesystem, or "" for the pool root dataset.
+func parentName(name string) string {
+	if i := strings.IndexAny(name, "@#"); i >= 0 {
+		return name[:i]
+	}
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		return name[:i]
+	}
+	return ""
+}
+
+// isSnapshot returns if name is a snapshot.
+func isSnapshot(name string) bool {
+	return strings.Contains(name, "@")
+}
+
+// isBookmark returns if name is a bookmark.
+func isBookmark(name string) bool {
+	return strings.Contains(name, "#")
+}
+
+// isFilesystem returns if name is neither a snapshot nor a bookmark.
+func isFilesystem(name string) bool {
+	return !isSnapshot(name) && !isBookmark(name)
+}
+
+// bookmarkProps are the only properties of bookmarks. Others are displayed as "-".
+var bookmarkProps = map[string]bool{"name": true, "type": true, "creation": true, "guid": true}
+
+// DatasetProperty returns the value and source of a native or user property of dataset d in pool p.
+// parsable returns raw numbers and timestamps, as zfs get -p does.
+func (s *State) DatasetProperty(p *Pool, d *Dataset, prop string, parsable bool) (value, source string) {
+	if isUserProperty(prop) {
+		return s.userProperty(p, d, prop)
+	}
+
+	def := datasetProps[prop]
+	if def.fsOnly && isSnapshot(d.Name) || isBookmark(d.Name) && !bookmarkProps[prop] {
+		return "-", sourceNone
+	}
+
+	switch prop {
+	case "name":
+		return d.Name, sourceNone
+	case "type":
+		return datasetType(d), sourceNone
+	case "creation":
+		v := d.Properties["creation"]
+		if parsable {
+			return v, sourceNone
+		}
+		sec, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return v, sourceNone
+		}
+		return time.Unix(sec, 0).Format("Mon Jan _2 15:04 2006"), sourceNone
+	case "mounted":
+		if s.mountOf(d.Name) != nil {
+			return "yes", sourceNone
+		}
+		return "no", sourceNone
+	case "mountpoint":
+		v, source := s.mountpoint(p, d)
+		return withAltroot(p, v), source
+	case "encryption", "keyformat", "keylocation", "keystatus", "encryptionroot":
+		return s.encryptionProperty(p, d, prop)
+	}
+
+	if def.readonly {
+		if v, ok := d.Properties[prop]; ok {
+			return v, sourceNone
+		}
+		if parsable && def.parsable != "" {
+			return def.parsable, sourceNone
+		}
+		return def.def, sourceNone
+	}
+
+	v, source, ok := s.lookupLocal(p, d, prop, def.inherit, func(d *Dataset) (string, bool) {
+		v, ok := d.Properties[prop]
+		return v, ok
+	})
+	if !ok {
+		v, source = def.def, sourceDefault
+		if parsable && def.parsable != "" {
+			v = def.parsable
+		}
+	}
+	return v, source
+}
+
+// encryptionProperty returns the value and source of an encryption property of dataset d in pool p, which are
+// defined by its encryption root.
+func (s *State) encryptionProperty(p *Pool, d *Dataset, prop string) (value, source string) {
+	if p.State == PoolLocked {
+		if prop == "encryptionroot" {
+			return p.Name, sourceNone
+		}
+		return lockedProps[prop], sourceNone
+	}
+
+	root := s.encryptionRoot(d)
+	if root == nil {
+		def := datasetProps[prop]
+		if def.readonly {
+			return def.def, sourceNone
+		}
+		return def.def, sourceDefault
+	}
+	switch prop {
+	case "keylocation":
+		if root != d {
+			return "none", sourceDefault
+		}
+		return root.Properties[prop], sourceLocal
+	case "keystatus":
+		if root.KeyLoaded {
+			return "available", sourceNone
+		}
+		return "unavailable", sourceNone
+	case "encryptionroot":
+		return root.Name, sourceNone
+	}
+	return root.Properties[prop], sourceNone
+}
+
+// encryptionRoot returns the dataset d inherits its encryption key from, or nil if d isn't encrypted.
+func (s *State) encryptionRoot(d *Dataset) *Dataset {
+	for cur := d; cur != nil; {
+		if _, ok := cur.Properties["encryption"]; ok {
+			return cur
+		}
+		parent := parentName(cur.Name)
+		if parent == "" {
+			break
+		}
+		cur, _ = s.Dataset(parent)
+	}
+	return nil
+}
+
+// keyUnavailable returns if dataset d in pool p is encrypted and its key isn't loaded.
+func (s *State) keyUnavailable(p *Pool, d *Dataset) bool {
+	v, _ := s.encryptionProperty(p, d, "keystatus")
+	return v == "unavailable"
+}
+
+// userProperty returns the value and source of a user property, which is always inherited.
+func (s *State) userProperty(p *Pool, d *Dataset, prop string) (value, source string) {
+	v, source, ok := s.lookupLocal(p, d, prop, true, func(d *Dataset) (string, bool) {
+		v, ok := d.UserProperties[prop]
+		return v, ok
+	})
+	if !ok {
+		return "-", sourceNone
+	}
+	return v, source
+}
+
+// lookupLocal finds the dataset where prop is locally set, starting from d and walking up its parents if inherit
+// is set.
+func (s *State) lookupLocal(p *Pool, d *Dataset, prop string, inherit bool, get func(*Dataset) (string, bool)) (value, source string, found bool) {
+	for cur := d; cur != nil; {
+		if v, ok := get(cur); ok {
+			if cur == d {
+				return v, sourceLocal, true
+			}
+			return v, inheritedFrom + cur.Name, true
+		}
+		if !inherit {
+			break
+		}
+		parent := parentName(cur.Name)
+		if parent == "" {
+			break
+		}
+		cur, _ = s.Dataset(parent)
+	}
+	return "", "", false
+}
+
+// mountpoint computes the mountpoint of a filesystem, without altroot, appending the relative path to the dataset
+// it was inherited from.
+func (s *State) mountpoint(p *Pool, d *Dataset) (value, source string) {
+	var rel []string
+	for cur := d; cur != nil; {
+		if v, ok := cur.Properties["mountpoint"]; ok {
+			source = sourceLocal
+			if cur != d {
+				source = inheritedFrom + cur.Name
+			}
+			if v == "none" || v == "legacy" {
+				return v, source
+			}
+			return path.Join(append([]string{v}, rel...)...), source
+		}
+		parent := parentName(cur.Name)
+		if parent == "" {
+			return path.Join(append([]string{"/", cur.Name}, rel...)...), sourceDefault
+		}
+		rel = append([]string{path.Base(cur.Name)}, rel...)
+		cur, _ = s.Dataset(parent)
+	}
+	return "-", sourceNone
+}
+
+// withAltroot prefixes absolute mountpoints with the pool altroot, if any.
+func withAltroot(p *Pool, mountpoint string) string {
+	altroot, ok := p.Properties["altroot"]
+	if !ok || altroot == "-" || !strings.HasPrefix(mountpoint, "/") {
+		return mountpoint
+	}
+	return path.Join(altroot, mountpoint)
+}
+
+// SetProperty sets a native or user property locally on a dataset.
+func (s *State) SetProperty(name, prop, value string) error {
+	d, _ := s.Dataset(name)
+	if d == nil {
+		return fmt.Errorf("cannot open '%s': dataset does not exist", name)
+	}
+	if isBookmark(name) {
+		return fmt.Errorf("cannot set property for '%s': bookmarks have no settable properties", name)
+	}
+	if isUserProperty(prop) {
+		d.UserProperties[prop] = value
+		return nil
+	}
+	def, ok := datasetProps[prop]
+	if !ok {
+		return fmt.Errorf("cannot set property for '%s': invalid property '%s'", name, prop)
+	}
+	if def.readonly {
+		return fmt.Errorf("cannot set property for '%s': '%s' is readonly", name, prop)
+	}
+	if def.fsOnly && isSnapshot(name) {
+		return fmt.Errorf("cannot set property for '%s': this property can not be modified for snapshots", name)
+	}
+	d.Properties[prop] = value
+	return nil
+}
+
+// InheritProperty clears a local property so that it's inherited again.
+func (s *State) InheritProperty(name, prop string) error {
+	d, _ := s.Dataset(name)
+	if d == nil {
+		return fmt.Errorf("cannot open '%s': dataset does not exist", name)
+	}
+	if isUserProperty(prop) {
+		delete(d.UserProperties, prop)
+		return nil
+	}
+	if def, ok := datasetProps[prop]; !ok || def.readonly {
+		return fmt.Errorf("invalid property '%s'", prop)
+	}
+	delete(d.Properties, prop)
+	return nil
+}
+
+// PoolProperty returns the value and source of a pool property.
+func (s *State) PoolProperty(p *Pool, prop string, parsable bool) (value, source string) {
+	def := poolProps[prop]
+	switch prop {
+	case "name":
+		return p.Name, sourceNone
+	case "guid":
+		return fmt.Sprintf("%d", guid(p.Name)), sourceNone
+	case "health":
+		health, _ := p.health(nil)
+		return health, sourceNone
+	}
+	if isFeatureProperty(prop) {
+		if contains(p.EnabledFeatures(), strings.TrimPrefix(prop, featurePrefix)) {
+			return "enabled", sourceLocal
+		}
+		return "disabled", sourceLocal
+	}
+	if v, ok := p.Properties[prop]; ok {
+		if def.readonly {
+			return v, sourceNone
+		}
+		return v, sourceLocal
+	}
+	v := def.def
+	if parsable && def.parsable != "" {
+		v = def.parsable
+	}
+	if def.readonly {
+		return v, sourceNone
+	}
+	return v, sourceDefault
+}
@@ -0,0 +1,703 @@
+// Package fakezfs is a userspace simulation of zfs pools, datasets and mounts.
+//
+// The whole simulated system lives in a state directory. The test suite populates it from testcase.yaml
+// definitions, then the zfs, zpool, mount, umount and grub-probe mocks answer 10_linux_zfs queries from it,
+// so that the menu generation runs without the zfs kernel module nor root privileges.
+package fakezfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	stateFile = "state.json"
+	lockFile  = "lock"
+)
+
+// State is the simulated system: pools with their datasets, non zfs block devices and mounts.
+type State struct {
+	Pools   []*Pool
+	Devices []*Device
+	Mounts  []*Mount
+	// Txg is incremented each time a dataset is created, to order snapshots as zfs does.
+	Txg uint64
+
+	dir  string
+	lock *os.File
+}
+
+// Pool is a simulated zpool. Exported pools are kept in the state so that they can be imported again.
+type Pool struct {
+	Name string
+	// Vdevs are the device files of the pool, in creation order.
+	Vdevs []string
+	// Topology groups Vdevs in top level vdevs. Pools without one are striped on all their vdevs.
+	Topology []Vdev
+	// Features are the only features enabled on the pool. All of them are enabled when nil.
+	Features []string
+	Imported bool
+	// Corruption is how the pool vdevs were damaged, like CorruptLabels.
+	Corruption string
+	// State is a condition of the pool which can't be derived from its vdevs, like PoolForeign.
+	State      string
+	Properties map[string]string
+	Datasets   []*Dataset
+}
+
+// Vdev is a top level vdev of a pool, made of some of its device files.
+type Vdev struct {
+	// Type is VdevDisk, VdevMirror or VdevRaidz, optionally followed by its parity, like raidz2.
+	Type string
+	// Class is the allocation class of the vdev: data ones have none.
+	Class   string `json:",omitempty"`
+	Devices []string
+}
+
+// Top level vdev types.
+const (
+	VdevDisk   = "disk"
+	VdevMirror = "mirror"
+	VdevRaidz  = "raidz"
+)
+
+// Allocation classes of top level vdevs, printed in this order after data vdevs.
+const (
+	ClassSpecial = "special"
+	ClassLog     = "logs"
+	ClassCache   = "cache"
+)
+
+// Pool states which can't be derived from the pool vdevs.
+const (
+	// PoolForeign pools were last imported by another system: they are only imported when forced.
+	PoolForeign = "foreign"
+	// PoolReadOnly pools use features only supported for reading: they are only imported read-only.
+	PoolReadOnly = "readonly"
+	// PoolLocked pools are encrypted and their key isn't loaded: their datasets can't be mounted.
+	PoolLocked = "locked"
+)
+
+// Corruptions of the pool vdevs.
+const (
+	// CorruptLabels pools had all their vdev labels wiped: they aren't found anymore.
+	CorruptLabels = "labels"
+	// CorruptUberblocks pools had their uberblock rings scrambled: they are found but their metadata is unreadable.
+	CorruptUberblocks = "uberblocks"
+	// CorruptTruncate pools had their vdevs truncated: they are found but their vdevs are too small.
+	CorruptTruncate = "truncate"
+)
+
+// Pool health, derived from the presence of its vdevs.
+const (
+	healthOnline   = "ONLINE"
+	healthDegraded = "DEGRADED"
+	healthUnavail  = "UNAVAIL"
+	healthFaulted  = "FAULTED"
+)
+
+// Dataset is a filesystem or a snapshot (when its name contains "@") of a pool.
+// Only locally set properties are stored, inherited and default values are computed on request.
+type Dataset struct {
+	Name           string
+	Txg            uint64
+	Properties     map[string]string
+	UserProperties map[string]string
+	// KeyLoaded is set on encryption roots whose key is loaded.
+	KeyLoaded bool
+}
+
+// Device is a non zfs block device, like an ext4 partition, whose content can be mounted.
+type Device struct {
+	Path string
+	Type string
+	// Name is the kernel device name, as reported by grub-probe.
+	Name string
+}
+
+// Mount is an active mount of a dataset or a device on a target directory.
+type Mount struct {
+	Source string
+	Target string
+	// Materialized mounts have their content copied to Target. Mounts done by the test setup or zfs itself are
+	// only recorded, to not write on the paths they point to.
+	Materialized bool
+	// Shadow is where the previous content of Target is saved while the mount hides it.
+	Shadow string
+}
+
+// Open loads the state in dir, creating it if needed, and locks it until Close is called.
+func Open(dir string) (*State, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("couldn't create state directory: %v", err)
+	}
+	lock, err := os.OpenFile(filepath.Join(dir, lockFile), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open state lock: %v", err)
+	}
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		lock.Close()
+		return nil, fmt.Errorf("couldn't lock state: %v", err)
+	}
+
+	s := &State{dir: dir, lock: lock}
+	b, err := ioutil.ReadFile(filepath.Join(dir, stateFile))
+	if err != nil && !os.IsNotExist(err) {
+		s.Close()
+		return nil, fmt.Errorf("couldn't read state: %v", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(b, s); err != nil {
+			s.Close()
+			return nil, fmt.Errorf("couldn't decode state: %v", err)
+		}
+	}
+	return s, nil
+}
+
+// Save atomically writes the state on disk.
+func (s *State) Save() error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("couldn't encode state: %v", err)
+	}
+	tmp := filepath.Join(s.dir, stateFile+".new")
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return fmt.Errorf("couldn't write state: %v", err)
+	}
+	return os.Rename(tmp, filepath.Join(s.dir, stateFile))
+}
+
+// Close releases the state lock. Changes which were not saved are lost.
+func (s *State) Close() error {
+	if s.lock == nil {
+		return nil
+	}
+	defer func() { s.lock = nil }()
+	return s.lock.Close()
+}
+
+// Dir returns the state directory.
+func (s *State) Dir() string {
+	return s.dir
+}
+
+// StorageDir returns the directory holding the content of a dataset or a device.
+func (s *State) StorageDir(name string) string {
+	return filepath.Join(s.dir, "storage", url.PathEscape(name))
+}
+
+// CreatePool creates and imports a pool backed by vdevs, with its root dataset.
+func (s *State) CreatePool(name string, vdevs []string, props map[string]string) (*Pool, error) {
+	if p := s.Pool(name); p != nil {
+		return nil, fmt.Errorf("cannot create '%s': pool already exists", name)
+	}
+	if len(vdevs) == 0 {
+		return nil, fmt.Errorf("cannot create '%s': no vdev specified", name)
+	}
+	p := &Pool{
+		Name:       name,
+		Vdevs:      vdevs,
+		Imported:   true,
+		Properties: make(map[string]string),
+	}
+	for k, v := range props {
+		if _, ok := poolProps[k]; !ok {
+			return nil, fmt.Errorf("cannot create '%s': invalid property '%s'", name, k)
+		}
+		p.Properties[k] = v
+	}
+	s.Pools = append(s.Pools, p)
+	sort.Slice(s.Pools, func(i, j int) bool { return s.Pools[i].Name < s.Pools[j].Name })
+
+	if _, err := s.addDataset(p, name); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Pool returns the pool named name, imported or not, or nil.
+func (s *State) Pool(name string) *Pool {
+	for _, p := range s.Pools {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// Dataset returns the dataset or snapshot named name and its pool, only if the pool is imported.
+func (s *State) Dataset(name string) (*Dataset, *Pool) {
+	p := s.Pool(poolName(name))
+	if p == nil || !p.Imported {
+		return nil, nil
+	}
+	for _, d := range p.Datasets {
+		if d.Name == name {
+			return d, p
+		}
+	}
+	return nil, nil
+}
+
+// CreateDataset creates a filesystem dataset. Its parent must exist.
+func (s *State) CreateDataset(name string) (*Dataset, error) {
+	if strings.Contains(name, "@") {
+		return nil, fmt.Errorf("cannot create '%s': snapshot delimiter '@' is not expected here", name)
+	}
+	i := strings.LastIndex(name, "/")
+	if i < 0 {
+		return nil, fmt.Errorf("cannot create '%s': missing dataset name", name)
+	}
+	parent, p := s.Dataset(name[:i])
+	if parent == nil {
+		return nil, fmt.Errorf("cannot create '%s': parent does not exist", name)
+	}
+	if d, _ := s.Dataset(name); d != nil {
+		return nil, fmt.Errorf("cannot create '%s': dataset already exists", name)
+	}
+	return s.addDataset(p, name)
+}
+
+// CreateEncryptedDataset creates a filesystem dataset which is the root of its own encryption key, loaded.
+// encryption "on" selects the default algorithm.
+func (s *State) CreateEncryptedDataset(name, encryption, keyformat, keylocation string) (*Dataset, error) {
+	if encryption == "on" {
+		encryption = "aes-256-gcm"
+	}
+	switch keyformat {
+	case "passphrase", "hex", "raw":
+	default:
+		return nil, fmt.Errorf("cannot create '%s': invalid keyformat '%s'", name, keyformat)
+	}
+	if keylocation != "prompt" && !strings.HasPrefix(keylocation, "file://") {
+		return nil, fmt.Errorf("cannot create '%s': invalid keylocation '%s'", name, keylocation)
+	}
+	d, err := s.CreateDataset(name)
+	if err != nil {
+		return nil, err
+	}
+	d.Properties["encryption"] = encryption
+	d.Properties["keyformat"] = keyformat
+	d.Properties["keylocation"] = keylocation
+	d.KeyLoaded = true
+	return d, nil
+}
+
+// UnloadKey unloads the key of an encryption root, whose datasets must be unmounted.
+func (s *State) UnloadKey(name string) error {
+	d, p := s.Dataset(name)
+	if d == nil {
+		return fmt.Errorf("cannot open '%s': dataset does not exist", name)
+	}
+	if s.encryptionRoot(d) != d {
+		return fmt.Errorf("Key unload error: '%s' is not an encryption root.", name)
+	}
+	for _, other := range p.Datasets {
+		if s.encryptionRoot(other) == d && s.mountOf(other.Name) != nil {
+			return fmt.Errorf("Key unload error: '%s' is busy.", name)
+		}
+	}
+	d.KeyLoaded = false
+	return nil
+}
+
+// Snapshot creates a snapshot named dataset@snapname, freezing the current content of dataset.
+func (s *State) Snapshot(name string) (*Dataset, error) {
+	i := strings.Index(name, "@")
+	if i < 0 {
+		return nil, fmt.Errorf("cannot create snapshot '%s': missing '@' delimiter in snapshot name", name)
+	}
+	parent, p := s.Dataset(name[:i])
+	if parent == nil {
+		return nil, fmt.Errorf("cannot open '%s': dataset does not exist", name[:i])
+	}
+	if d, _ := s.Dataset(name); d != nil {
+		return nil, fmt.Errorf("cannot create snapshot '%s': dataset already exists", name)
+	}
+	d, err := s.addDataset(p, name)
+	if err != nil {
+		return nil, err
+	}
+	if err := copyTree(s.StorageDir(parent.Name), s.StorageDir(name)); err != nil {
+		return nil, fmt.Errorf("couldn't freeze content of snapshot %q: %v", name, err)
+	}
+	return d, nil
+}
+
+// Clone creates the filesystem name from snapshot, with the content of the snapshot. Its parent must exist.
+func (s *State) Clone(snapshot, name string) (*Dataset, error) {
+	snap, p := s.Dataset(snapshot)
+	if snap == nil || !isSnapshot(snapshot) {
+		return nil, fmt.Errorf("cannot open '%s': snapshot does not exist", snapshot)
+	}
+	if poolName(name) != p.Name {
+		return nil, fmt.Errorf("cannot create '%s': source and target pools differ", name)
+	}
+	d, err := s.CreateDataset(name)
+	if err != nil {
+		return nil, err
+	}
+	d.Properties["origin"] = snapshot
+	if err := copyTree(s.StorageDir(snapshot), s.StorageDir(name)); err != nil {
+		return nil, fmt.Errorf("couldn't copy content of snapshot %q: %v", snapshot, err)
+	}
+	return d, nil
+}
+
+// Promote makes the clone name independent of its origin filesystem: the snapshots of the origin, up to the one it
+// was cloned from, move to the clone, and the origin becomes a clone of it.
+func (s *State) Promote(name string) error {
+	d, p := s.Dataset(name)
+	if d == nil || !isFilesystem(name) {
+		return fmt.Errorf("cannot open '%s': dataset does not exist", name)
+	}
+	origin, ok := d.Properties["origin"]
+	if !ok {
+		return fmt.Errorf("cannot promote '%s': not a cloned filesystem", name)
+	}
+	originSnap, _ := s.Dataset(origin)
+	originFS, _ := s.Dataset(parentName(origin))
+	if originSnap == nil || originFS == nil {
+		return fmt.Errorf("cannot promote '%s': origin %s does not exist", name, origin)
+	}
+
+	var moved []*Dataset
+	for _, snap := range p.Datasets {
+		if !strings.HasPrefix(snap.Name, originFS.Name+"@") || snap.Txg > originSnap.Txg {
+			continue
+		}
+		if d, _ := s.Dataset(name + strings.TrimPrefix(snap.Name, originFS.Name)); d != nil {
+			return fmt.Errorf("cannot promote '%s': snapshot name conflict with %s", name, d.Name)
+		}
+		moved = append(moved, snap)
+	}
+
+	renames := make(map[string]string)
+	for _, snap := range moved {
+		newName := name + strings.TrimPrefix(snap.Name, originFS.Name)
+		if err := os.Rename(s.StorageDir(snap.Name), s.StorageDir(newName)); err != nil {
+			return fmt.Errorf("couldn't move content of snapshot %q: %v", snap.Name, err)
+		}
+		renames[snap.Name] = newName
+		snap.Name = newName
+	}
+
+	// the clone inherits the origin of its former origin, and other clones follow their moved snapshots
+	prevOrigin, hasPrevOrigin := originFS.Properties["origin"]
+	for _, c := range p.Datasets {
+		if n, ok := renames[c.Properties["origin"]]; ok {
+			c.Properties["origin"] = n
+		}
+	}
+	originFS.Properties["origin"] = renames[origin]
+	delete(d.Properties, "origin")
+	if hasPrevOrigin {
+		d.Properties["origin"] = prevOrigin
+	}
+	return nil
+}
+
+// Bookmark creates the bookmark name, like dataset#bookmark, of a snapshot of the same filesystem.
+func (s *State) Bookmark(snapshot, name string) (*Dataset, error) {
+	snap, p := s.Dataset(snapshot)
+	if snap == nil || !isSnapshot(snapshot) {
+		return nil, fmt.Errorf("cannot open '%s': snapshot does not exist", snapshot)
+	}
+	if !isBookmark(name) || parentName(name) != parentName(snapshot) {
+		return nil, fmt.Errorf("cannot create bookmark '%s': bookmarks must be in the same filesystem as their snapshot", name)
+	}
+	if !contains(p.EnabledFeatures(), "bookmarks") {
+		return nil, fmt.Errorf("cannot create bookmark '%s': pool feature 'bookmarks' is disabled", name)
+	}
+	if d, _ := s.Dataset(name); d != nil {
+		return nil, fmt.Errorf("cannot create bookmark '%s': bookmark exists", name)
+	}
+	d, err := s.addDataset(p, name)
+	if err != nil {
+		return nil, err
+	}
+	// a bookmark keeps the identity of its snapshot
+	d.Txg = snap.Txg
+	d.Properties["creation"] = snap.Properties["creation"]
+	d.Properties["guid"] = snap.Properties["guid"]
+	return d, nil
+}
+
+func (s *State) addDataset(p *Pool, name string) (*Dataset, error) {
+	if err := os.MkdirAll(s.StorageDir(name), 0755); err != nil {
+		return nil, fmt.Errorf("couldn't create storage for %q: %v", name, err)
+	}
+	s.Txg++
+	d := &Dataset{
+		Name: name,
+		Txg:  s.Txg,
+		Properties: map[string]string{
+			"creation": fmt.Sprintf("%d", time.Now().Unix()),
+			"guid":     fmt.Sprintf("%d", guid(name)),
+		},
+		UserProperties: make(map[string]string),
+	}
+	p.Datasets = append(p.Datasets, d)
+	return d, nil
+}
+
+// SetCreation overrides the creation time of a dataset, which is read-only for zfs users.
+func (s *State) SetCreation(name string, t time.Time) error {
+	d, _ := s.Dataset(name)
+	if d == nil {
+		return fmt.Errorf("cannot open '%s': dataset does not exist", name)
+	}
+	d.Properties["creation"] = fmt.Sprintf("%d", t.Unix())
+	return nil
+}
+
+// AddDevice registers a non zfs block device whose content is stored in StorageDir(path).
+func (s *State) AddDevice(path, fstype string) (*Device, error) {
+	path = filepath.Clean(path)
+	if s.device(path) != nil {
+		return nil, fmt.Errorf("device %q already exists", path)
+	}
+	if err := os.MkdirAll(s.StorageDir(path), 0755); err != nil {
+		return nil, fmt.Errorf("couldn't create storage for %q: %v", path, err)
+	}
+	d := &Device{
+		Path: path,
+		Type: fstype,
+		Name: fmt.Sprintf("/dev/loop%d", len(s.Devices)),
+	}
+	s.Devices = append(s.Devices, d)
+	return d, nil
+}
+
+func (s *State) device(path string) *Device {
+	path = filepath.Clean(path)
+	for _, d := range s.Devices {
+		if d.Path == path {
+			return d
+		}
+	}
+	return nil
+}
+
+// ImportedPools returns the names of all imported pools.
+func (s *State) ImportedPools() []string {
+	var names []string
+	for _, p := range s.Pools {
+		if p.Imported {
+			names = append(names, p.Name)
+		}
+	}
+	return names
+}
+
+// ExportPool unmounts all datasets of an imported pool and exports it.
+func (s *State) ExportPool(name string) error {
+	p := s.Pool(name)
+	if p == nil || !p.Imported {
+		return fmt.Errorf("cannot open '%s': no such pool", name)
+	}
+	for _, d := range p.Datasets {
+		if err := s.UnmountSource(d.Name); err != nil {
+			return fmt.Errorf("cannot export '%s': %v", name, err)
+		}
+	}
+	p.Imported = false
+	for _, d := range p.Datasets {
+		// keys are unloaded with the pool
+		d.KeyLoaded = false
+	}
+	delete(p.Properties, "altroot")
+	delete(p.Properties, "readonly")
+	return nil
+}
+
+// health returns the health of the pool from its corruption and the presence of its vdevs in one of dirs, or anywhere if dirs is
+// empty. found is false if none of its vdevs is present.
+func (p *Pool) health(dirs []string) (health string, found bool) {
+	switch p.Corruption {
+	case CorruptLabels:
+		return healthUnavail, false
+	case CorruptUberblocks:
+		return healthFaulted, true
+	case CorruptTruncate:
+		return healthUnavail, true
+	}
+
+	var present int
+	for _, v := range p.Vdevs {
+		if vdevPresent(v, dirs) {
+			present++
+		}
+	}
+	if present == 0 {
+		return healthUnavail, false
+	}
+	health = healthOnline
+	for _, v := range p.topology() {
+		switch v.health(dirs) {
+		case healthUnavail:
+			// pools don't need their cache devices
+			if v.Class != ClassCache {
+				return healthUnavail, true
+			}
+		case healthDegraded:
+			health = healthDegraded
+		}
+	}
+	return health, true
+}
+
+// topology returns the top level vdevs of the pool.
+func (p *Pool) topology() []Vdev {
+	if len(p.Topology) > 0 {
+		return p.Topology
+	}
+	var r []Vdev
+	for _, v := range p.Vdevs {
+		r = append(r, Vdev{Type: VdevDisk, Devices: []string{v}})
+	}
+	return r
+}
+
+// health returns the health of the vdev from the presence of its devices in one of dirs, or anywhere if dirs is empty.
+// It stays available while it has no more missing devices than its redundancy.
+func (v Vdev) health(dirs []string) string {
+	var missing int
+	for _, d := range v.Devices {
+		if !vdevPresent(d, dirs) {
+			missing++
+		}
+	}
+	switch {
+	case missing == 0:
+		return healthOnline
+	case missing < len(v.Devices) && missing <= v.redundancy():
+		return healthDegraded
+	default:
+		return healthUnavail
+	}
+}
+
+// redundancy returns the number of devices the vdev can lose.
+func (v Vdev) redundancy() int {
+	switch {
+	case v.Type == VdevMirror:
+		return len(v.Devices) - 1
+	case v.Type == VdevRaidz:
+		return 1
+	case strings.HasPrefix(v.Type, VdevRaidz):
+		parity, err := strconv.Atoi(strings.TrimPrefix(v.Type, VdevRaidz))
+		if err != nil {
+			return 0
+		}
+		return parity
+	}
+	return 0
+}
+
+// SetTopology groups the vdevs of the pool in top level vdevs. Each vdev must be part of exactly one of them.
+func (p *Pool) SetTopology(topology []Vdev) error {
+	seen := make(map[string]bool)
+	for _, d := range p.Vdevs {
+		seen[d] = false
+	}
+	var data bool
+	for _, v := range topology {
+		switch {
+		case v.Type == VdevDisk && len(v.Devices) != 1:
+			return fmt.Errorf("invalid vdev specification: disk vdevs have one device, got %d", len(v.Devices))
+		case v.Type == VdevMirror && len(v.Devices) < 2:
+			return fmt.Errorf("invalid vdev specification: mirror requires at least 2 devices")
+		case strings.HasPrefix(v.Type, VdevRaidz):
+			if n := v.redundancy(); n < 1 || n > 3 || len(v.Devices) < n+1 {
+				return fmt.Errorf("invalid vdev specification: %s requires at least %d devices", v.Type, n+1)
+			}
+		case v.Type != VdevDisk && v.Type != VdevMirror:
+			return fmt.Errorf("invalid vdev specification: unknown vdev type '%s'", v.Type)
+		}
+		switch v.Class {
+		case "":
+			data = true
+		case ClassCache:
+			if v.Type != VdevDisk {
+				return fmt.Errorf("invalid vdev specification: cache devices can't be %s", v.Type)
+			}
+		case ClassLog, ClassSpecial:
+		default:
+			return fmt.Errorf("invalid vdev specification: unknown allocation class '%s'", v.Class)
+		}
+		for _, d := range v.Devices {
+			used, ok := seen[d]
+			if !ok {
+				return fmt.Errorf("invalid vdev specification: %s isn't a vdev of pool '%s'", d, p.Name)
+			} else if used {
+				return fmt.Errorf("invalid vdev specification: %s is part of several vdevs", d)
+			}
+			seen[d] = true
+		}
+	}
+	if !data {
+		return fmt.Errorf("invalid vdev specification: at least one data vdev is required")
+	}
+	for _, d := range p.Vdevs {
+		if !seen[d] {
+			return fmt.Errorf("invalid vdev specification: %s isn't part of any vdev", d)
+		}
+	}
+	p.Topology = topology
+	return nil
+}
+
+// vdevPresent returns if the vdev exists and is located in one of dirs, or anywhere if dirs is empty.
+func vdevPresent(vdev string, dirs []string) bool {
+	if _, err := os.Stat(vdev); err != nil {
+		return false
+	}
+	if len(dirs) == 0 {
+		return true
+	}
+	for _, d := range dirs {
+		if filepath.Clean(filepath.Dir(vdev)) == filepath.Clean(d) {
+			return true
+		}
+	}
+	return false
+}
+
+// poolName returns the pool part of a dataset, snapshot or bookmark name.
+func poolName(name string) string {
+	if i := strings.IndexAny(name, "/@#"); i >= 0 {
+		return name[:i]
+	}
+	return name
+}
+
+// contains returns if s is one of values.
+func contains(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// guid derives a stable identifier from a name.
+func guid(name string) uint64 {
+	var h uint64 = 14695981039346656037
+	for _, c := range []byte(name) {
+		h ^= uint64(c)
+		h *= 1099511628211
+	}
+	return h
+}
@@ -0,0 +1,661 @@
+package fakezfs
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// entry is a dataset with its pool.
+type entry struct {
+	p *Pool
+	d *Dataset
+}
+
+// datasetListColumns are the default "zfs list" columns.
+var datasetListColumns = []string{"name", "used", "available", "referenced", "mountpoint"}
+
+// datasetColumnAliases maps short column names to their property.
+var datasetColumnAliases = map[string]string{"avail": "available", "refer": "referenced", "ratio": "compressratio",
+	"compress": "compression", "rdonly": "readonly", "recsize": "recordsize"}
+
+// datasetColumnHeaders are the headers of columns which aren't the uppercased property name.
+var datasetColumnHeaders = map[string]string{"available": "AVAIL", "referenced": "REFER", "compressratio": "RATIO",
+	"compression": "COMPRESS", "readonly": "RDONLY", "recordsize": "RECSIZE"}
+
+// Zfs emulates the zfs command on the state and returns its exit code.
+func Zfs(s *State, args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprintln(stderr, "missing command")
+		return 2
+	}
+
+	switch cmd, args := args[0], args[1:]; cmd {
+	case "list":
+		return zfsList(s, args, stdout, stderr)
+	case "get":
+		return zfsGet(s, args, stdout, stderr)
+	case "set":
+		return zfsSet(s, args, stdout, stderr)
+	case "inherit":
+		return zfsInherit(s, args, stdout, stderr)
+	case "mount":
+		return zfsMount(s, args, stdout, stderr)
+	case "unmount", "umount":
+		return zfsUnmount(s, args, stdout, stderr)
+	case "snapshot", "snap":
+		return zfsSnapshot(s, args, stdout, stderr)
+	default:
+		fmt.Fprintf(stderr, "fake zfs: unsupported command '%s'\n", cmd)
+		return 2
+	}
+}
+
+// sortedDatasets returns all datasets of imported pools in zfs order: by filesystem name, a filesystem before its
+// snapshots, and snapshots in creation order.
+func (s *State) sortedDatasets() []entry {
+	var r []entry
+	for _, p := range s.Pools {
+		if !p.Imported {
+			continue
+		}
+		for _, d := range p.Datasets {
+			r = append(r, entry{p, d})
+		}
+	}
+	sort.SliceStable(r, func(i, j int) bool { return zfsLess(r[i].d, r[j].d) })
+	return r
+}
+
+// zfsLess compares two datasets as zfs does when no sort column is requested: a filesystem comes before its
+// snapshots, then its bookmarks, each in creation order.
+func zfsLess(a, b *Dataset) bool {
+	fsA, fsB := a.Name, b.Name
+	if i := strings.IndexAny(fsA, "@#"); i >= 0 {
+		fsA = fsA[:i]
+	}
+	if i := strings.IndexAny(fsB, "@#"); i >= 0 {
+		fsB = fsB[:i]
+	}
+	if fsA != fsB {
+		return fsA < fsB
+	}
+	rank := map[string]int{"filesystem": 0, "snapshot": 1, "bookmark": 2}
+	if rankA, rankB := rank[datasetType(a)], rank[datasetType(b)]; rankA != rankB {
+		return rankA < rankB
+	}
+	return a.Txg < b.Txg
+}
+
+// datasetType returns the zfs type name of a dataset.
+func datasetType(d *Dataset) string {
+	switch {
+	case isSnapshot(d.Name):
+		return "snapshot"
+	case isBookmark(d.Name):
+		return "bookmark"
+	}
+	return "filesystem"
+}
+
+// depth returns the number of levels between base and d.
+func depth(base, name string) int {
+	rel := strings.TrimPrefix(name, base)
+	n := strings.Count(rel, "/")
+	if strings.Contains(rel, "@") {
+		n++
+	}
+	return n
+}
+
+// isDescendant returns if name is a child dataset, a snapshot or a bookmark of base, or of one of its children.
+func isDescendant(base, name string) bool {
+	return strings.HasPrefix(name, base+"/") || strings.HasPrefix(name, base+"@") || strings.HasPrefix(name, base+"#")
+}
+
+// parseTypes returns the set of requested dataset types.
+func parseTypes(types []string) (map[string]bool, error) {
+	r := make(map[string]bool)
+	for _, t := range types {
+		switch t {
+		case "all":
+			r["filesystem"], r["snapshot"], r["volume"], r["bookmark"] = true, true, true, true
+		case "filesystem", "snapshot", "volume", "bookmark":
+			r[t] = true
+		case "fs":
+			r["filesystem"] = true
+		case "snap":
+			r["snapshot"] = true
+		case "vol":
+			r["volume"] = true
+		default:
+			return nil, fmt.Errorf("invalid type '%s'", t)
+		}
+	}
+	return r, nil
+}
+
+// selectDatasets returns the datasets matching names, or all datasets if none is given, optionally with their
+// descendants up to maxDepth (-1 for unlimited). Named datasets are always returned if types is nil.
+func (s *State) selectDatasets(names []string, recursive bool, maxDepth int, types map[string]bool, stderr io.Writer) ([]entry, int) {
+	all := s.sortedDatasets()
+	match := func(d *Dataset) bool { return types == nil || types[datasetType(d)] }
+
+	if len(names) == 0 {
+		var r []entry
+		for _, e := range all {
+			if types == nil && !isFilesystem(e.d.Name) {
+				continue
+			}
+			if match(e.d) {
+				r = append(r, e)
+			}
+		}
+		return r, 0
+	}
+
+	ret := 0
+	selected := make(map[*Dataset]bool)
+	for _, name := range names {
+		d, _ := s.Dataset(name)
+		if d == nil {
+			fmt.Fprintf(stderr, "cannot open '%s': dataset does not exist\n", name)
+			ret = 1
+			continue
+		}
+		if match(d) {
+			selected[d] = true
+		}
+		if !recursive {
+			continue
+		}
+		for _, e := range all {
+			if !isDescendant(name, e.d.Name) || (maxDepth >= 0 && depth(name, e.d.Name) > maxDepth) {
+				continue
+			}
+			if types == nil && !isFilesystem(e.d.Name) {
+				continue
+			}
+			if match(e.d) {
+				selected[e.d] = true
+			}
+		}
+	}
+
+	var r []entry
+	for _, e := range all {
+		if selected[e.d] {
+			r = append(r, e)
+		}
+	}
+	return r, ret
+}
+
+// recursionOptions returns recursion and max depth from -r and -d options.
+func recursionOptions(o options) (recursive bool, maxDepth int, err error) {
+	maxDepth = -1
+	if o.has('d') {
+		maxDepth, err = strconv.Atoi(o.last('d'))
+		if err != nil || maxDepth < 0 {
+			return false, 0, fmt.Errorf("invalid depth '%s'", o.last('d'))
+		}
+		return true, maxDepth, nil
+	}
+	return o.has('r'), -1, nil
+}
+
+func zfsList(s *State, args []string, stdout, stderr io.Writer) int {
+	o, err := parseOptions(args, "rHp", "odsSt")
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	recursive, maxDepth, err := recursionOptions(o)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+
+	var types map[string]bool
+	if o.has('t') {
+		if types, err = parseTypes(o.list('t')); err != nil {
+			fmt.Fprintln(stderr, err)
+			return 2
+		}
+		// "zfs list -t snapshot <filesystem>" lists snapshots of that filesystem.
+		if len(types) == 1 && types["snapshot"] && len(o.args) > 0 && !recursive {
+			recursive, maxDepth = true, 1
+		}
+	} else if len(o.args) == 0 || recursive {
+		types = map[string]bool{"filesystem": true, "volume": true}
+	}
+
+	columns := datasetListColumns
+	if o.has('o') {
+		columns = nil
+		for _, c := range o.list('o') {
+			columns = append(columns, strings.ToLower(c))
+		}
+	}
+	var props, headers []string
+	for _, c := range columns {
+		prop := c
+		if alias, ok := datasetColumnAliases[c]; ok {
+			prop = alias
+		}
+		if !validDatasetProperty(prop) {
+			fmt.Fprintf(stderr, "bad property list: invalid property '%s'\n", c)
+			return 2
+		}
+		props = append(props, prop)
+		h, ok := datasetColumnHeaders[prop]
+		if !ok {
+			h = strings.ToUpper(prop)
+		}
+		headers = append(headers, h)
+	}
+
+	entries, ret := s.selectDatasets(o.args, recursive, maxDepth, types, stderr)
+	if err := s.sortEntries(entries, o); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+
+	var rows [][]string
+	for _, e := range entries {
+		var row []string
+		for _, prop := range props {
+			v, _ := s.DatasetProperty(e.p, e.d, prop, o.has('p'))
+			row = append(row, v)
+		}
+		rows = append(rows, row)
+	}
+	if len(rows) == 0 && len(o.args) == 0 {
+		fmt.Fprintln(stderr, "no datasets available")
+		return ret
+	}
+	printTable(stdout, headers, rows, o.has('H'))
+	return ret
+}
+
+// sortEntries sorts entries by -s (ascending) and -S (descending) columns, in order, falling back to zfs order.
+func (s *State) sortEntries(entries []entry, o options) error {
+	type sortKey struct {
+		prop       string
+		descending bool
+	}
+	var keys []sortKey
+	for _, flag := range []byte{'s', 'S'} {
+		for _, prop := range o.flags[flag] {
+			if alias, ok := datasetColumnAliases[prop]; ok {
+				prop = alias
+			}
+			if !validDatasetProperty(prop) {
+				return fmt.Errorf("invalid property '%s'", prop)
+			}
+			keys = append(keys, sortKey{prop, flag == 'S'})
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		for _, k := range keys {
+			a, _ := s.DatasetProperty(entries[i].p, entries[i].d, k.prop, true)
+			b, _ := s.DatasetProperty(entries[j].p, entries[j].d, k.prop, true)
+			if a == b {
+				continue
+			}
+			less := a < b
+			na, errA := strconv.ParseFloat(a, 64)
+			nb, errB := strconv.ParseFloat(b, 64)
+			if errA == nil && errB == nil {
+				less = na < nb
+			}
+			if k.descending {
+				return !less
+			}
+			return less
+		}
+		return zfsLess(entries[i].d, entries[j].d)
+	})
+	return nil
+}
+
+func zfsGet(s *State, args []string, stdout, stderr io.Writer) int {
+	o, err := parseOptions(args, "rHp", "dost")
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	if len(o.args) == 0 {
+		fmt.Fprintln(stderr, "missing property argument")
+		return 2
+	}
+	recursive, maxDepth, err := recursionOptions(o)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+
+	types := map[string]bool{"filesystem": true, "snapshot": true, "volume": true, "bookmark": true}
+	if o.has('t') {
+		if types, err = parseTypes(o.list('t')); err != nil {
+			fmt.Fprintln(stderr, err)
+			return 2
+		}
+	}
+
+	fields := []string{"name", "property", "value", "source"}
+	if o.has('o') {
+		fields = o.list('o')
+	}
+	var headers []string
+	for _, f := range fields {
+		switch f {
+		case "name", "property", "value", "source", "received":
+			headers = append(headers, strings.ToUpper(f))
+		default:
+			fmt.Fprintf(stderr, "invalid field '%s'\n", f)
+			return 2
+		}
+	}
+
+	sources := make(map[string]bool)
+	for _, src := range o.list('s') {
+		switch src {
+		case "local", "default", "inherited", "temporary", "received", "none":
+			sources[src] = true
+		default:
+			fmt.Fprintf(stderr, "invalid source '%s'\n", src)
+			return 2
+		}
+	}
+
+	requested := strings.Split(o.args[0], ",")
+	for _, prop := range requested {
+		if prop != "all" && !validDatasetProperty(prop) {
+			fmt.Fprintf(stderr, "bad property list: invalid property '%s'\n", prop)
+			return 2
+		}
+	}
+
+	entries, ret := s.selectDatasets(o.args[1:], recursive, maxDepth, types, stderr)
+	var rows [][]string
+	for _, e := range entries {
+		props := requested
+		if len(requested) == 1 && requested[0] == "all" {
+			props = s.allDatasetProperties(e.d)
+		}
+		for _, prop := range props {
+			v, source := s.DatasetProperty(e.p, e.d, prop, o.has('p'))
+			if len(sources) > 0 && !sources[sourceKind(source)] {
+				continue
+			}
+			var row []string
+			for _, f := range fields {
+				switch f {
+				case "name":
+					row = append(row, e.d.Name)
+				case "property":
+					row = append(row, prop)
+				case "value":
+					row = append(row, v)
+				case "source":
+					row = append(row, source)
+				case "received":
+					row = append(row, "-")
+				}
+			}
+			rows = append(rows, row)
+		}
+	}
+	printTable(stdout, headers, rows, o.has('H'))
+	return ret
+}
+
+// allDatasetProperties returns native properties of d followed by user properties set on it or its parents.
+func (s *State) allDatasetProperties(d *Dataset) []string {
+	var r []string
+	for _, prop := range datasetPropsOrder {
+		if datasetProps[prop].fsOnly && isSnapshot(d.Name) {
+			continue
+		}
+		r = append(r, prop)
+	}
+
+	user := make(map[string]bool)
+	for cur := d; cur != nil; {
+		for prop := range cur.UserProperties {
+			user[prop] = true
+		}
+		parent := parentName(cur.Name)
+		if parent == "" {
+			break
+		}
+		cur, _ = s.Dataset(parent)
+	}
+	var userProps []string
+	for prop := range user {
+		userProps = append(userProps, prop)
+	}
+	sort.Strings(userProps)
+	return append(r, userProps...)
+}
+
+// sourceKind returns the "zfs get -s" category of a property source.
+func sourceKind(source string) string {
+	switch {
+	case source == sourceNone:
+		return "none"
+	case strings.HasPrefix(source, inheritedFrom):
+		return "inherited"
+	}
+	return source
+}
+
+func zfsSet(s *State, args []string, stdout, stderr io.Writer) int {
+	if len(args) < 2 {
+		fmt.Fprintln(stderr, "missing property=value or dataset argument")
+		return 2
+	}
+	var assignments [][2]string
+	var names []string
+	for _, a := range args {
+		if i := strings.Index(a, "="); i > 0 && len(names) == 0 {
+			assignments = append(assignments, [2]string{a[:i], a[i+1:]})
+			continue
+		}
+		names = append(names, a)
+	}
+
+	ret := 0
+	for _, name := range names {
+		for _, kv := range assignments {
+			if err := s.SetProperty(name, kv[0], kv[1]); err != nil {
+				fmt.Fprintln(stderr, err)
+				ret = 1
+			}
+		}
+	}
+	return ret
+}
+
+func zfsInherit(s *State, args []string, stdout, stderr io.Writer) int {
+	o, err := parseOptions(args, "rS", "")
+	if err != nil || len(o.args) < 2 {
+		fmt.Fprintln(stderr, "usage: inherit [-rS] <property> <filesystem|volume|snapshot> ...")
+		return 2
+	}
+	ret := 0
+	for _, name := range o.args[1:] {
+		targets := []string{name}
+		if o.has('r') {
+			for _, e := range s.sortedDatasets() {
+				if isDescendant(name, e.d.Name) {
+					targets = append(targets, e.d.Name)
+				}
+			}
+		}
+		for _, t := range targets {
+			if err := s.InheritProperty(t, o.args[0]); err != nil {
+				fmt.Fprintln(stderr, err)
+				ret = 1
+			}
+		}
+	}
+	return ret
+}
+
+func zfsMount(s *State, args []string, stdout, stderr io.Writer) int {
+	o, err := parseOptions(args, "avlfO", "o")
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+
+	if len(o.args) == 0 && !o.has('a') {
+		for _, m := range s.Mounts {
+			if d, _ := s.Dataset(m.Source); d != nil {
+				fmt.Fprintf(stdout, "%-30s  %s\n", m.Source, m.Target)
+			}
+		}
+		return 0
+	}
+
+	names := o.args
+	if o.has('a') {
+		names = nil
+		for _, e := range s.sortedDatasets() {
+			if !isFilesystem(e.d.Name) {
+				continue
+			}
+			canmount, _ := s.DatasetProperty(e.p, e.d, "canmount", false)
+			mp, _ := s.mountpoint(e.p, e.d)
+			if canmount != "on" || mp == "none" || mp == "legacy" || s.mountOf(e.d.Name) != nil {
+				continue
+			}
+			names = append(names, e.d.Name)
+		}
+	}
+
+	ret := 0
+	for _, name := range names {
+		if err := s.MountDataset(name); err != nil {
+			fmt.Fprintf(stderr, "cannot mount '%s': %v\n", name, err)
+			ret = 1
+		}
+	}
+	return ret
+}
+
+// MountDataset mounts a filesystem on its mountpoint, as zfs mount does. The mount is only recorded.
+func (s *State) MountDataset(name string) error {
+	d, p := s.Dataset(name)
+	if d == nil || !isFilesystem(name) {
+		return fmt.Errorf("filesystem does not exist")
+	}
+	if canmount, _ := s.DatasetProperty(p, d, "canmount", false); canmount == "off" {
+		return fmt.Errorf("'canmount' property is set to 'off'")
+	}
+	if s.keyUnavailable(p, d) {
+		return fmt.Errorf("encryption key not loaded")
+	}
+	mp, _ := s.mountpoint(p, d)
+	switch mp {
+	case "legacy":
+		return fmt.Errorf("legacy mountpoint\nuse mount(8) to mount this filesystem")
+	case "none":
+		return fmt.Errorf("no mountpoint set")
+	}
+	if s.mountOf(name) != nil {
+		return fmt.Errorf("filesystem already mounted")
+	}
+	return s.Mount(name, withAltroot(p, mp), false)
+}
+
+func zfsUnmount(s *State, args []string, stdout, stderr io.Writer) int {
+	o, err := parseOptions(args, "afu", "")
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+
+	ret := 0
+	if o.has('a') {
+		for _, e := range s.sortedDatasets() {
+			if err := s.UnmountSource(e.d.Name); err != nil {
+				fmt.Fprintf(stderr, "cannot unmount '%s': %v\n", e.d.Name, err)
+				ret = 1
+			}
+		}
+		return ret
+	}
+
+	for _, name := range o.args {
+		var err error
+		if m := s.mountAt(name); m != nil {
+			err = s.Unmount(name)
+		} else if d, _ := s.Dataset(name); d != nil {
+			if s.mountOf(name) == nil {
+				err = fmt.Errorf("not currently mounted")
+			} else {
+				err = s.UnmountSource(name)
+			}
+		} else {
+			err = fmt.Errorf("no such pool or dataset")
+		}
+		if err != nil {
+			fmt.Fprintf(stderr, "cannot unmount '%s': %v\n", name, err)
+			ret = 1
+		}
+	}
+	return ret
+}
+
+func zfsSnapshot(s *State, args []string, stdout, stderr io.Writer) int {
+	o, err := parseOptions(args, "r", "o")
+	if err != nil || len(o.args) == 0 {
+		fmt.Fprintln(stderr, "usage: snapshot [-r] [-o property=value] ... <filesystem|volume>@<snap> ...")
+		return 2
+	}
+
+	ret := 0
+	for _, name := range o.args {
+		names := []string{name}
+		if o.has('r') {
+			i := strings.Index(name, "@")
+			if i < 0 {
+				fmt.Fprintf(stderr, "cannot create snapshot '%s': missing '@' delimiter in snapshot name\n", name)
+				ret = 1
+				continue
+			}
+			for _, e := range s.sortedDatasets() {
+				if isFilesystem(e.d.Name) && isDescendant(name[:i], e.d.Name) {
+					names = append(names, e.d.Name+name[i:])
+				}
+			}
+		}
+		for _, n := range names {
+			if _, err := s.Snapshot(n); err != nil {
+				fmt.Fprintln(stderr, err)
+				ret = 1
+				continue
+			}
+			for _, kv := range o.flags['o'] {
+				i := strings.Index(kv, "=")
+				if i < 0 {
+					continue
+				}
+				if err := s.SetProperty(n, kv[:i], kv[i+1:]); err != nil {
+					fmt.Fprintln(stderr, err)
+					ret = 1
+				}
+			}
+		}
+	}
+	return ret
+}
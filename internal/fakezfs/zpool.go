@@ -0,0 +1,452 @@
+package fakezfs
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Zpool emulates the zpool command on the state and returns its exit code.
+func Zpool(s *State, args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprintln(stderr, "missing command")
+		return 2
+	}
+
+	switch cmd, args := args[0], args[1:]; cmd {
+	case "list":
+		return zpoolList(s, args, stdout, stderr)
+	case "get":
+		return zpoolGet(s, args, stdout, stderr)
+	case "set":
+		return zpoolSet(s, args, stdout, stderr)
+	case "import":
+		return zpoolImport(s, args, stdout, stderr)
+	case "export":
+		return zpoolExport(s, args, stdout, stderr)
+	case "status":
+		return zpoolStatus(s, args, stdout, stderr)
+	default:
+		fmt.Fprintf(stderr, "fake zpool: unsupported command '%s'\n", cmd)
+		return 2
+	}
+}
+
+// selectPools returns the imported pools named names, or all imported pools if none is given.
+func (s *State) selectPools(names []string, stderr io.Writer) ([]*Pool, int) {
+	if len(names) == 0 {
+		var r []*Pool
+		for _, p := range s.Pools {
+			if p.Imported {
+				r = append(r, p)
+			}
+		}
+		return r, 0
+	}
+
+	ret := 0
+	var r []*Pool
+	for _, name := range names {
+		p := s.Pool(name)
+		if p == nil || !p.Imported {
+			fmt.Fprintf(stderr, "cannot open '%s': no such pool\n", name)
+			ret = 1
+			continue
+		}
+		r = append(r, p)
+	}
+	return r, ret
+}
+
+// validPoolProperty returns if prop can be queried on a pool.
+func validPoolProperty(prop string) bool {
+	_, ok := poolProps[prop]
+	return ok || isFeatureProperty(prop)
+}
+
+func zpoolList(s *State, args []string, stdout, stderr io.Writer) int {
+	o, err := parseOptions(args, "HpPgLv", "oT")
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+
+	var headers, props []string
+	if o.has('o') {
+		for _, c := range o.list('o') {
+			prop := strings.ToLower(c)
+			if alias, ok := poolColumnAliases[prop]; ok {
+				prop = alias
+			}
+			if !validPoolProperty(prop) {
+				fmt.Fprintf(stderr, "property '%s' is not a valid pool property\n", c)
+				return 2
+			}
+			headers = append(headers, strings.ToUpper(c))
+			props = append(props, prop)
+		}
+	} else {
+		for _, c := range poolListColumns {
+			headers = append(headers, c.header)
+			props = append(props, c.prop)
+		}
+	}
+
+	pools, ret := s.selectPools(o.args, stderr)
+	if len(pools) == 0 && len(o.args) == 0 {
+		fmt.Fprintln(stdout, "no pools available")
+		return 0
+	}
+	var rows [][]string
+	for _, p := range pools {
+		var row []string
+		for _, prop := range props {
+			v, _ := s.PoolProperty(p, prop, o.has('p'))
+			row = append(row, v)
+		}
+		rows = append(rows, row)
+	}
+	printTable(stdout, headers, rows, o.has('H'))
+	return ret
+}
+
+func zpoolGet(s *State, args []string, stdout, stderr io.Writer) int {
+	o, err := parseOptions(args, "Hp", "o")
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	if len(o.args) == 0 {
+		fmt.Fprintln(stderr, "missing property argument")
+		return 2
+	}
+
+	fields := []string{"name", "property", "value", "source"}
+	if o.has('o') {
+		fields = o.list('o')
+	}
+	var headers []string
+	for _, f := range fields {
+		switch f {
+		case "name", "property", "value", "source":
+			headers = append(headers, strings.ToUpper(f))
+		default:
+			fmt.Fprintf(stderr, "invalid field '%s'\n", f)
+			return 2
+		}
+	}
+
+	requested := strings.Split(o.args[0], ",")
+	if len(requested) == 1 && requested[0] == "all" {
+		requested = poolPropsOrder
+	}
+	for _, prop := range requested {
+		if !validPoolProperty(prop) {
+			fmt.Fprintf(stderr, "bad property list: invalid property '%s'\n", prop)
+			return 2
+		}
+	}
+
+	pools, ret := s.selectPools(o.args[1:], stderr)
+	var rows [][]string
+	for _, p := range pools {
+		for _, prop := range requested {
+			v, source := s.PoolProperty(p, prop, o.has('p'))
+			var row []string
+			for _, f := range fields {
+				switch f {
+				case "name":
+					row = append(row, p.Name)
+				case "property":
+					row = append(row, prop)
+				case "value":
+					row = append(row, v)
+				case "source":
+					row = append(row, source)
+				}
+			}
+			rows = append(rows, row)
+		}
+	}
+	printTable(stdout, headers, rows, o.has('H'))
+	return ret
+}
+
+func zpoolSet(s *State, args []string, stdout, stderr io.Writer) int {
+	if len(args) != 2 || !strings.Contains(args[0], "=") {
+		fmt.Fprintln(stderr, "usage: set <property=value> <pool>")
+		return 2
+	}
+	kv := strings.SplitN(args[0], "=", 2)
+	p := s.Pool(args[1])
+	if p == nil || !p.Imported {
+		fmt.Fprintf(stderr, "cannot open '%s': no such pool\n", args[1])
+		return 1
+	}
+	def, ok := poolProps[kv[0]]
+	if !ok {
+		fmt.Fprintf(stderr, "property '%s' is not a valid pool property\n", kv[0])
+		return 2
+	}
+	if def.readonly {
+		fmt.Fprintf(stderr, "cannot set property for '%s': property '%s' is readonly\n", p.Name, kv[0])
+		return 1
+	}
+	p.Properties[kv[0]] = kv[1]
+	return 0
+}
+
+// importable returns exported pools which have at least one vdev in dirs and valid labels, with their health.
+// Unavailable and faulted ones are listed but can't be imported.
+func (s *State) importable(dirs []string) ([]*Pool, map[*Pool]string) {
+	var r []*Pool
+	healths := make(map[*Pool]string)
+	for _, p := range s.Pools {
+		if p.Imported {
+			continue
+		}
+		health, found := p.health(dirs)
+		if !found {
+			continue
+		}
+		r = append(r, p)
+		healths[p] = health
+	}
+	return r, healths
+}
+
+// importError returns why the pool, with health, can't be imported with the given force flag and properties.
+func importError(p *Pool, health string, force bool, props map[string]string) error {
+	switch {
+	case health == healthFaulted:
+		return fmt.Errorf("cannot import '%s': I/O error\n\tDestroy and re-create the pool from\n\ta backup source.", p.Name)
+	case health == healthUnavail:
+		return fmt.Errorf("cannot import '%s': one or more devices is currently unavailable", p.Name)
+	case p.State == PoolForeign && !force:
+		return fmt.Errorf("cannot import '%s': pool was previously in use from another system.\n"+
+			"Last accessed by otherhost (hostid=deadbeef) at Thu Jan  1 00:00:00 1970\n"+
+			"The pool can be imported, use 'zpool import -f' to import the pool.", p.Name)
+	case p.State == PoolReadOnly && props["readonly"] != "on":
+		return fmt.Errorf("This pool uses the following feature(s) not supported by this system:\n"+
+			"\tcom.example:unsupported\n"+
+			"All unsupported features are only required for writing to the pool.\n"+
+			"The pool can be imported using '-o readonly=on'.\n"+
+			"cannot import '%s': unsupported version or feature", p.Name)
+	}
+	return nil
+}
+
+// importStatus returns the status and action lines describing why a pool found by zpool import needs attention.
+func importStatus(p *Pool, health string) string {
+	switch {
+	case health == healthFaulted:
+		return " status: The pool metadata is corrupted.\n" +
+			" action: The pool cannot be imported due to damaged devices or data.\n"
+	case p.Corruption == CorruptTruncate:
+		return " status: One or more devices contains corrupted data.\n" +
+			" action: The pool cannot be imported due to damaged devices or data.\n"
+	case health == healthUnavail:
+		return " status: One or more devices are missing from the system.\n" +
+			" action: The pool cannot be imported. Attach the missing\n\tdevices and try again.\n"
+	case health == healthDegraded:
+		return " status: One or more devices are missing from the system.\n" +
+			" action: The pool can be imported despite missing or damaged devices.  The\n\tfault tolerance of the pool may be compromised if imported.\n"
+	case p.State == PoolForeign:
+		return " status: The pool was last accessed by another system.\n" +
+			" action: The pool can be imported using its name or numeric identifier and\n\tthe '-f' flag.\n"
+	case p.State == PoolReadOnly:
+		return " status: The pool can only be accessed in read-only mode on this system. It\n\tcannot be accessed in read-write mode because it uses the following\n\tfeature(s) not supported on this system:\n\tcom.example:unsupported\n" +
+			" action: The pool cannot be imported in read-write mode. Import the pool with\n\t\"-o readonly=on\", access the pool on a system that supports the\n\trequired feature(s), or recreate the pool from backup.\n"
+	}
+	return " action: The pool can be imported using its name or numeric identifier.\n"
+}
+
+// vdevState returns the state of a vdev of an imported or importable pool.
+func vdevState(p *Pool, vdev string) string {
+	if _, err := os.Stat(vdev); err != nil {
+		return healthUnavail
+	}
+	switch p.Corruption {
+	case CorruptUberblocks:
+		return "FAULTED\tcorrupted data"
+	case CorruptTruncate:
+		return "UNAVAIL\tcorrupted data"
+	}
+	return healthOnline
+}
+
+// printConfig prints the vdev tree of a pool below its name, as zpool import and status do: data vdevs, then the
+// other allocation classes. Grouping vdevs are named after their type and position.
+func printConfig(w io.Writer, p *Pool) {
+	topology := p.topology()
+	for _, class := range []string{"", ClassSpecial, ClassLog, ClassCache} {
+		var header bool
+		for i, v := range topology {
+			if v.Class != class {
+				continue
+			}
+			if class != "" && !header {
+				fmt.Fprintf(w, "\t%s\n", class)
+				header = true
+			}
+			if v.Type == VdevDisk {
+				fmt.Fprintf(w, "\t  %s\t%s\n", v.Devices[0], vdevState(p, v.Devices[0]))
+				continue
+			}
+			fmt.Fprintf(w, "\t  %s-%d\t%s\n", v.Type, i, v.health(nil))
+			for _, d := range v.Devices {
+				fmt.Fprintf(w, "\t    %s\t%s\n", d, vdevState(p, d))
+			}
+		}
+	}
+}
+
+func zpoolImport(s *State, args []string, stdout, stderr io.Writer) int {
+	o, err := parseOptions(args, "aDfFmNnlsX", "dcoRt")
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+
+	props := make(map[string]string)
+	for _, opt := range o.flags['o'] {
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 {
+			// mount options
+			continue
+		}
+		if !validPoolProperty(kv[0]) {
+			fmt.Fprintf(stderr, "property '%s' is not a valid pool property\n", kv[0])
+			return 2
+		}
+		props[kv[0]] = kv[1]
+	}
+	if o.has('R') {
+		props["altroot"] = o.last('R')
+		props["cachefile"] = "none"
+	}
+
+	dirs := o.flags['d']
+	if len(dirs) == 0 {
+		dirs = []string{"/dev/disk/by-id", "/dev"}
+	}
+	candidates, healths := s.importable(dirs)
+
+	if !o.has('a') && len(o.args) == 0 {
+		if len(candidates) == 0 {
+			fmt.Fprintln(stderr, "no pools available to import")
+			return 1
+		}
+		for _, p := range candidates {
+			fmt.Fprintf(stdout, "   pool: %s\n     id: %d\n  state: %s\n%s config:\n\n\t%s\t%s\n",
+				p.Name, guid(p.Name), healths[p], importStatus(p, healths[p]), p.Name, healths[p])
+			printConfig(stdout, p)
+			fmt.Fprintln(stdout)
+		}
+		return 0
+	}
+
+	var toImport []*Pool
+	ret := 0
+	if o.has('a') {
+		toImport = candidates
+		if len(toImport) == 0 {
+			fmt.Fprintln(stderr, "no pools available to import")
+		}
+	} else {
+		name := o.args[0]
+		if p := s.Pool(name); p != nil && p.Imported {
+			fmt.Fprintf(stderr, "cannot import '%s': a pool with that name already exists\n", name)
+			return 1
+		}
+		for _, p := range candidates {
+			if p.Name == name || fmt.Sprintf("%d", guid(p.Name)) == name {
+				toImport = append(toImport, p)
+			}
+		}
+		if len(toImport) == 0 {
+			fmt.Fprintf(stderr, "cannot import '%s': no such pool available\n", name)
+			return 1
+		}
+	}
+
+	for _, p := range toImport {
+		if err := importError(p, healths[p], o.has('f'), props); err != nil {
+			fmt.Fprintln(stderr, err)
+			ret = 1
+			continue
+		}
+		p.Imported = true
+		if p.State == PoolForeign {
+			// the pool now belongs to this system
+			p.State = ""
+		}
+		for k, v := range props {
+			p.Properties[k] = v
+		}
+		if o.has('N') {
+			continue
+		}
+		for _, e := range s.sortedDatasets() {
+			if e.p != p || isSnapshot(e.d.Name) {
+				continue
+			}
+			canmount, _ := s.DatasetProperty(e.p, e.d, "canmount", false)
+			mp, _ := s.mountpoint(e.p, e.d)
+			if canmount != "on" || mp == "none" || mp == "legacy" {
+				continue
+			}
+			if err := s.MountDataset(e.d.Name); err != nil {
+				fmt.Fprintf(stderr, "cannot mount '%s': %v\n", e.d.Name, err)
+				ret = 1
+			}
+		}
+	}
+	return ret
+}
+
+func zpoolExport(s *State, args []string, stdout, stderr io.Writer) int {
+	o, err := parseOptions(args, "af", "")
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	names := o.args
+	if o.has('a') {
+		names = s.ImportedPools()
+	}
+	if len(names) == 0 {
+		fmt.Fprintln(stderr, "missing pool argument")
+		return 2
+	}
+
+	ret := 0
+	for _, name := range names {
+		if err := s.ExportPool(name); err != nil {
+			fmt.Fprintln(stderr, err)
+			ret = 1
+		}
+	}
+	return ret
+}
+
+func zpoolStatus(s *State, args []string, stdout, stderr io.Writer) int {
+	o, err := parseOptions(args, "xvpPgLD", "T")
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	pools, ret := s.selectPools(o.args, stderr)
+	if len(pools) == 0 && len(o.args) == 0 {
+		fmt.Fprintln(stdout, "no pools available")
+		return 0
+	}
+	for _, p := range pools {
+		health, _ := p.health(nil)
+		fmt.Fprintf(stdout, "  pool: %s\n state: %s\nconfig:\n\n\tNAME\tSTATE\n\t%s\t%s\n", p.Name, health, p.Name, health)
+		printConfig(stdout, p)
+		fmt.Fprintln(stdout, "\nerrors: No known data errors")
+	}
+	return ret
+}
@@ -0,0 +1,251 @@
+// Package faults injects faults in mock invocations, as declared by a test case.
+//
+// The test suite writes the faults of a test case in a file, which mocks wrapped by Inject read. Each fault matches
+// invocations of a command by their arguments, and makes them fail, return garbage, hang or report property values
+// as unset ("-").
+package faults
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/ubuntu/grubmenugen-zfs-tests/internal/trace"
+)
+
+// Env is the environment variable pointing mocks to the faults file.
+const Env = "TEST_MOCK_FAULTS"
+
+// Kinds of faults.
+const (
+	// Fail makes the invocation exit with an error, without running the command.
+	Fail = "fail"
+	// Garbage replaces the output of the invocation by meaningless content.
+	Garbage = "garbage"
+	// Hang delays the invocation.
+	Hang = "hang"
+	// Unset reports property values as "-".
+	Unset = "unset"
+)
+
+// garbageOutput is the output of garbage faults which don't set any.
+const garbageOutput = "\x01\x7f%%garbage\toutput%%\n"
+
+// Fault alters the invocations of a command.
+type Fault struct {
+	Command string `json:"command" yaml:"command"`
+	// Args is a regular expression which must match the invocation arguments, separated by spaces.
+	Args string `json:"args" yaml:"args"`
+	// Dataset restricts garbage and unset faults to the output lines of this dataset.
+	Dataset string `json:"dataset,omitempty" yaml:"dataset"`
+	Kind    string `json:"kind" yaml:"kind"`
+	// ExitCode is the exit code of fail faults, 1 by default.
+	ExitCode int `json:"exit_code,omitempty" yaml:"exit_code"`
+	// Output replaces the output of garbage faults.
+	Output string `json:"output,omitempty" yaml:"output"`
+	// Duration is how long hang faults delay the invocation, before running it. It's required, so that a hang can't
+	// stall the test suite.
+	Duration string `json:"duration,omitempty" yaml:"duration"`
+}
+
+// Validate returns an error if the fault can't be injected.
+func (f Fault) Validate() error {
+	if f.Command == "" {
+		return fmt.Errorf("fault without command")
+	}
+	if _, err := regexp.Compile(f.Args); err != nil {
+		return fmt.Errorf("invalid arguments pattern %q: %v", f.Args, err)
+	}
+	switch f.Kind {
+	case Fail, Garbage, Unset:
+	case Hang:
+		if f.Duration == "" {
+			return fmt.Errorf("hang fault without duration")
+		}
+		if _, err := time.ParseDuration(f.Duration); err != nil {
+			return fmt.Errorf("invalid hang duration %q: %v", f.Duration, err)
+		}
+	default:
+		return fmt.Errorf("unknown fault kind %q", f.Kind)
+	}
+	return nil
+}
+
+// Write saves faults in path.
+func Write(path string, faults []Fault) error {
+	for _, f := range faults {
+		if err := f.Validate(); err != nil {
+			return err
+		}
+	}
+	b, err := json.MarshalIndent(faults, "", "  ")
+	if err != nil {
+		return fmt.Errorf("couldn't encode faults: %v", err)
+	}
+	return ioutil.WriteFile(path, b, 0644)
+}
+
+// load reads the faults in path. A missing file has no fault.
+func load(path string) ([]Fault, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("couldn't read faults: %v", err)
+	}
+	var faults []Fault
+	if err := json.Unmarshal(b, &faults); err != nil {
+		return nil, fmt.Errorf("couldn't decode faults: %v", err)
+	}
+	return faults, nil
+}
+
+// Inject returns run, altered by the first fault of the faults file matching the invocation of command.
+func Inject(command string, run trace.Run) trace.Run {
+	return func(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+		path := os.Getenv(Env)
+		if path == "" {
+			return run(args, stdin, stdout, stderr)
+		}
+		faults, err := load(path)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 2
+		}
+
+		for _, f := range faults {
+			if !f.Matches(command, args[1:]) {
+				continue
+			}
+			return f.inject(args, stdin, stdout, stderr, run)
+		}
+		return run(args, stdin, stdout, stderr)
+	}
+}
+
+// Matches returns if the fault applies to the invocation of command with args, which don't include the command name.
+func (f Fault) Matches(command string, args []string) bool {
+	if f.Command != command {
+		return false
+	}
+	ok, _ := regexp.MatchString(f.Args, strings.Join(args, " "))
+	return ok
+}
+
+func (f Fault) inject(args []string, stdin io.Reader, stdout, stderr io.Writer, run trace.Run) int {
+	switch f.Kind {
+	case Fail:
+		fmt.Fprintf(stderr, "%s: injected failure\n", f.Command)
+		if f.ExitCode == 0 {
+			return 1
+		}
+		return f.ExitCode
+	case Hang:
+		d, _ := time.ParseDuration(f.Duration)
+		time.Sleep(d)
+		return run(args, stdin, stdout, stderr)
+	}
+
+	var out strings.Builder
+	ret := run(args, stdin, &out, stderr)
+	cols := columns(args[1:])
+	var b strings.Builder
+	for _, l := range strings.SplitAfter(out.String(), "\n") {
+		if l == "" || !f.concerns(l, cols, args[1:]) {
+			b.WriteString(l)
+			continue
+		}
+		if f.Kind == Unset {
+			b.WriteString(unset(l, cols))
+			continue
+		}
+		output := f.Output
+		if output == "" {
+			output = garbageOutput
+		}
+		b.WriteString(output)
+		if f.Dataset == "" {
+			// the whole output is replaced
+			break
+		}
+	}
+	if _, err := io.WriteString(stdout, b.String()); err != nil {
+		return 2
+	}
+	return ret
+}
+
+// concerns returns if the output line l of the invocation with args is altered by the fault.
+// Lines are identified by their name column, or by the dataset arguments if the output has none.
+func (f Fault) concerns(l string, cols, args []string) bool {
+	if f.Dataset == "" {
+		return true
+	}
+	for i, c := range cols {
+		if c != "name" {
+			continue
+		}
+		fields := splitLine(l)
+		return i < len(fields) && fields[i] == f.Dataset
+	}
+	for _, a := range args {
+		if a == f.Dataset {
+			return true
+		}
+	}
+	return false
+}
+
+// columns returns the output columns of zfs get, list and mount invocations.
+func columns(args []string) []string {
+	if len(args) == 0 {
+		return nil
+	}
+	var cols []string
+	switch args[0] {
+	case "get":
+		cols = []string{"name", "property", "value", "source"}
+	case "list":
+		cols = []string{"name", "used", "avail", "refer", "mountpoint"}
+	case "mount":
+		return []string{"name", "mountpoint"}
+	default:
+		return nil
+	}
+	for i, a := range args {
+		if a == "-o" && i+1 < len(args) {
+			cols = strings.Split(args[i+1], ",")
+		}
+	}
+	return cols
+}
+
+// unset replaces all values of the output line l by "-", keeping names and property names.
+func unset(l string, cols []string) string {
+	fields := splitLine(l)
+	for i := range fields {
+		if i < len(cols) && (cols[i] == "name" || cols[i] == "property") {
+			continue
+		}
+		fields[i] = "-"
+	}
+	sep := " "
+	if strings.Contains(l, "\t") {
+		sep = "\t"
+	}
+	return strings.Join(fields, sep) + "\n"
+}
+
+// splitLine returns the fields of an output line, separated by tabs for scripted outputs or spaces.
+func splitLine(l string) []string {
+	l = strings.TrimSuffix(l, "\n")
+	if strings.Contains(l, "\t") {
+		return strings.Split(l, "\t")
+	}
+	return strings.Fields(l)
+}
@@ -0,0 +1,189 @@
+package faults_test
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/ubuntu/grubmenugen-zfs-tests/internal/faults"
+)
+
+// zfs answers a few invocations like zfs would, in scripted mode.
+func zfs(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	switch strings.Join(args[1:], " ") {
+	case "get -H -o value mountpoint rpool/ROOT/ubuntu":
+		fmt.Fprintln(stdout, "/")
+	case "get -pH creation rpool/ROOT/ubuntu":
+		fmt.Fprintln(stdout, "rpool/ROOT/ubuntu\tcreation\t1588888888\t-")
+	case "list -H -o name,canmount,mountpoint":
+		fmt.Fprintln(stdout, "rpool/ROOT/ubuntu\ton\t/")
+		fmt.Fprintln(stdout, "rpool/ROOT/other\tnoauto\t/")
+	case "mount":
+		fmt.Fprintln(stdout, "rpool/ROOT/ubuntu  /")
+	default:
+		fmt.Fprintln(stderr, "unexpected invocation")
+		return 2
+	}
+	return 0
+}
+
+func TestInject(t *testing.T) {
+	testCases := map[string]struct {
+		faults []faults.Fault
+		args   string
+
+		wantStdout string
+		wantExit   int
+	}{
+		"no fault": {args: "get -H -o value mountpoint rpool/ROOT/ubuntu", wantStdout: "/\n"},
+		"fault on another invocation": {
+			faults:     []faults.Fault{{Command: "zfs", Args: "^list ", Kind: faults.Fail}},
+			args:       "get -H -o value mountpoint rpool/ROOT/ubuntu",
+			wantStdout: "/\n"},
+		"fault on another command": {
+			faults:     []faults.Fault{{Command: "zpool", Args: "", Kind: faults.Fail}},
+			args:       "get -H -o value mountpoint rpool/ROOT/ubuntu",
+			wantStdout: "/\n"},
+
+		"fail": {
+			faults:   []faults.Fault{{Command: "zfs", Args: "^get .* rpool/ROOT/ubuntu$", Kind: faults.Fail}},
+			args:     "get -H -o value mountpoint rpool/ROOT/ubuntu",
+			wantExit: 1},
+		"fail with exit code": {
+			faults:   []faults.Fault{{Command: "zfs", Args: "^get", Kind: faults.Fail, ExitCode: 42}},
+			args:     "get -H -o value mountpoint rpool/ROOT/ubuntu",
+			wantExit: 42},
+		"first matching fault": {
+			faults: []faults.Fault{
+				{Command: "zfs", Args: "^list", Kind: faults.Fail, ExitCode: 3},
+				{Command: "zfs", Args: "^get", Kind: faults.Fail, ExitCode: 4},
+				{Command: "zfs", Args: "^get", Kind: faults.Fail, ExitCode: 5}},
+			args:     "get -H -o value mountpoint rpool/ROOT/ubuntu",
+			wantExit: 4},
+
+		"garbage": {
+			faults:     []faults.Fault{{Command: "zfs", Args: "^get", Kind: faults.Garbage}},
+			args:       "get -H -o value mountpoint rpool/ROOT/ubuntu",
+			wantStdout: "\x01\x7f%%garbage\toutput%%\n"},
+		"garbage with output": {
+			faults:     []faults.Fault{{Command: "zfs", Args: "^list", Kind: faults.Garbage, Output: "nonsense\n"}},
+			args:       "list -H -o name,canmount,mountpoint",
+			wantStdout: "nonsense\n"},
+		"garbage on dataset lines": {
+			faults:     []faults.Fault{{Command: "zfs", Args: "^list", Dataset: "rpool/ROOT/other", Kind: faults.Garbage, Output: "nonsense\n"}},
+			args:       "list -H -o name,canmount,mountpoint",
+			wantStdout: "rpool/ROOT/ubuntu\ton\t/\nnonsense\n"},
+
+		"unset value": {
+			faults:     []faults.Fault{{Command: "zfs", Args: "mountpoint", Kind: faults.Unset}},
+			args:       "get -H -o value mountpoint rpool/ROOT/ubuntu",
+			wantStdout: "-\n"},
+		"unset value of dataset argument": {
+			faults:     []faults.Fault{{Command: "zfs", Args: "mountpoint", Dataset: "rpool/ROOT/ubuntu", Kind: faults.Unset}},
+			args:       "get -H -o value mountpoint rpool/ROOT/ubuntu",
+			wantStdout: "-\n"},
+		"unset value of another dataset argument": {
+			faults:     []faults.Fault{{Command: "zfs", Args: "mountpoint", Dataset: "rpool/ROOT/other", Kind: faults.Unset}},
+			args:       "get -H -o value mountpoint rpool/ROOT/ubuntu",
+			wantStdout: "/\n"},
+		"unset keeps names and properties": {
+			faults:     []faults.Fault{{Command: "zfs", Args: "creation", Kind: faults.Unset}},
+			args:       "get -pH creation rpool/ROOT/ubuntu",
+			wantStdout: "rpool/ROOT/ubuntu\tcreation\t-\t-\n"},
+		"unset on dataset lines": {
+			faults:     []faults.Fault{{Command: "zfs", Args: "^list", Dataset: "rpool/ROOT/other", Kind: faults.Unset}},
+			args:       "list -H -o name,canmount,mountpoint",
+			wantStdout: "rpool/ROOT/ubuntu\ton\t/\nrpool/ROOT/other\t-\t-\n"},
+		"unset mounts": {
+			faults:     []faults.Fault{{Command: "zfs", Args: "^mount$", Kind: faults.Unset}},
+			args:       "mount",
+			wantStdout: "rpool/ROOT/ubuntu -\n"},
+
+		"hang for a duration": {
+			faults:     []faults.Fault{{Command: "zfs", Args: "^get", Kind: faults.Hang, Duration: "10ms"}},
+			args:       "get -H -o value mountpoint rpool/ROOT/ubuntu",
+			wantStdout: "/\n"},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "faults-test-")
+			require.NoError(t, err, "couldn't create temporary directory")
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "faults.json")
+			require.NoError(t, faults.Write(path, tc.faults), "couldn't write faults")
+			defer setEnv(t, faults.Env, path)()
+
+			var stdout, stderr strings.Builder
+			args := append([]string{"zfs"}, strings.Fields(tc.args)...)
+			got := faults.Inject("zfs", zfs)(args, nil, &stdout, &stderr)
+
+			assert.Equal(t, tc.wantExit, got, "exit code")
+			assert.Equal(t, tc.wantStdout, stdout.String(), "standard output")
+		})
+	}
+}
+
+func TestInjectWithoutFaultsFile(t *testing.T) {
+	defer setEnv(t, faults.Env, "")()
+
+	var stdout, stderr strings.Builder
+	got := faults.Inject("zfs", zfs)([]string{"zfs", "mount"}, nil, &stdout, &stderr)
+
+	assert.Equal(t, 0, got, "exit code")
+	assert.Equal(t, "rpool/ROOT/ubuntu  /\n", stdout.String(), "standard output")
+}
+
+func TestMatches(t *testing.T) {
+	t.Parallel()
+
+	f := faults.Fault{Command: "zfs", Args: " rpool/ROOT/ubuntu_2$", Kind: faults.Fail}
+
+	assert.True(t, f.Matches("zfs", []string{"get", "-pH", "creation", "rpool/ROOT/ubuntu_2"}), "matching arguments")
+	assert.False(t, f.Matches("zfs", []string{"get", "-pH", "creation", "rpool/ROOT/ubuntu"}), "other arguments")
+	assert.False(t, f.Matches("zpool", []string{"get", "-pH", "creation", "rpool/ROOT/ubuntu_2"}), "other command")
+}
+
+func TestWriteInvalidFaults(t *testing.T) {
+	testCases := map[string]faults.Fault{
+		"no command":       {Args: "^get", Kind: faults.Fail},
+		"invalid pattern":  {Command: "zfs", Args: "(get", Kind: faults.Fail},
+		"unknown kind":     {Command: "zfs", Args: "^get", Kind: "explode"},
+		"invalid duration": {Command: "zfs", Args: "^get", Kind: faults.Hang, Duration: "forever"},
+		"missing duration": {Command: "zfs", Args: "^get", Kind: faults.Hang},
+	}
+
+	for name, f := range testCases {
+		f := f
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "faults-test-")
+			require.NoError(t, err, "couldn't create temporary directory")
+			defer os.RemoveAll(dir)
+
+			err = faults.Write(filepath.Join(dir, "faults.json"), []faults.Fault{f})
+			assert.Error(t, err, "invalid faults should not be written")
+		})
+	}
+}
+
+// setEnv sets the environment variable name to value and returns a function restoring it.
+func setEnv(t *testing.T, name, value string) func() {
+	t.Helper()
+
+	orig, set := os.LookupEnv(name)
+	require.NoError(t, os.Setenv(name, value), "couldn't set environment variable")
+	return func() {
+		if !set {
+			os.Unsetenv(name)
+			return
+		}
+		os.Setenv(name, orig)
+	}
+}
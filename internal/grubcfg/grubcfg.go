@@ -0,0 +1,262 @@
+// Package grubcfg parses the subset of GRUB script generated by 10_linux_zfs into a tree of menus.
+//
+// Functions defined in the script are expanded where they are called, with their positional parameters and the
+// variables they set substituted in the entries they create. This gives history entries created by
+// zsyshistorymenu their real root dataset and kernel. Other variables are kept verbatim, like ${vt_handoff}.
+// if/else blocks are not evaluated: all commands of an entry are listed, whatever their condition, and variables
+// set in conditional blocks are ignored.
+package grubcfg
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// Menu is the tree of entries and submenus of a grub configuration.
+type Menu struct {
+	Items []*Item
+}
+
+// Item is a menuentry or a submenu.
+type Item struct {
+	Submenu bool
+	Title   string
+	ID      string
+	Classes []string
+	Line    int
+
+	// Items are the entries and submenus of a submenu.
+	Items []*Item
+
+	// Commands are all commands of a menuentry, expanded.
+	Commands []Command
+	// Kernel, KernelArgs and Initrds are extracted from the linux and initrd commands of a menuentry.
+	Kernel      string
+	KernelArgs  []string
+	Initrds     []string
+	RootDataset string
+}
+
+// Command is a command of a menuentry.
+type Command struct {
+	Name string
+	Args []string
+}
+
+func (c Command) String() string {
+	return strings.TrimSpace(c.Name + " " + strings.Join(c.Args, " "))
+}
+
+// Parse parses a grub configuration.
+func Parse(r io.Reader) (*Menu, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read grub configuration: %v", err)
+	}
+	tokens, err := lex(string(b))
+	if err != nil {
+		return nil, err
+	}
+	stmts, err := parse(tokens)
+	if err != nil {
+		return nil, err
+	}
+
+	e := evaluator{functions: make(map[string][]statement)}
+	items, err := e.menu(stmts, make(map[string]string), 0)
+	if err != nil {
+		return nil, err
+	}
+	return &Menu{Items: items}, nil
+}
+
+// maxCallDepth prevents infinite recursion in functions calling themselves.
+const maxCallDepth = 32
+
+type evaluator struct {
+	functions map[string][]statement
+}
+
+// menu evaluates statements at menu level, returning the entries and submenus they create.
+func (e evaluator) menu(stmts []statement, env map[string]string, depth int) ([]*Item, error) {
+	var items []*Item
+	var cond int
+	for _, s := range stmts {
+		name := s.words[0].expand(env)
+		if isKeyword(name) {
+			cond = nesting(name, cond)
+			continue
+		}
+		switch {
+		case name == "function" && s.block:
+			if len(s.words) != 2 {
+				return nil, fmt.Errorf("line %d: invalid function definition", s.line)
+			}
+			e.functions[s.words[1].raw()] = s.body
+
+		case (name == "menuentry" || name == "submenu") && s.block:
+			it, err := newItem(name == "submenu", s, env)
+			if err != nil {
+				return nil, err
+			}
+			if it.Submenu {
+				if it.Items, err = e.menu(s.body, copyEnv(env), depth); err != nil {
+					return nil, err
+				}
+			} else {
+				e.entry(it, s.body, copyEnv(env))
+			}
+			items = append(items, it)
+
+		case name == "set":
+			if cond == 0 {
+				set(s.words, env)
+			}
+
+		default:
+			body, ok := e.functions[name]
+			if !ok {
+				continue
+			}
+			if depth >= maxCallDepth {
+				return nil, fmt.Errorf("line %d: too many nested calls to %q", s.line, name)
+			}
+			callEnv := copyEnv(env)
+			for i, w := range s.words[1:] {
+				callEnv[fmt.Sprint(i+1)] = w.expand(env)
+			}
+			called, err := e.menu(body, callEnv, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, called...)
+		}
+	}
+	return items, nil
+}
+
+// entry evaluates the body of a menuentry.
+func (e evaluator) entry(it *Item, stmts []statement, env map[string]string) {
+	var cond int
+	for _, s := range stmts {
+		if name := s.words[0].raw(); isKeyword(name) {
+			cond = nesting(name, cond)
+			if len(s.words) == 1 {
+				continue
+			}
+			// if and elif conditions are commands
+			s.words = s.words[1:]
+		}
+		var args []string
+		for _, w := range s.words {
+			args = append(args, w.expand(env))
+		}
+		c := Command{Name: args[0], Args: args[1:]}
+		it.Commands = append(it.Commands, c)
+
+		switch c.Name {
+		case "set":
+			if cond == 0 {
+				set(s.words, env)
+			}
+		case "linux", "linux16", "linuxefi":
+			if len(c.Args) == 0 {
+				continue
+			}
+			it.Kernel = c.Args[0]
+			it.KernelArgs = c.Args[1:]
+			for _, a := range it.KernelArgs {
+				if strings.HasPrefix(a, "root=ZFS=") {
+					it.RootDataset = strings.TrimPrefix(a, "root=ZFS=")
+				}
+			}
+		case "initrd", "initrd16", "initrdefi":
+			it.Initrds = c.Args
+		}
+		// nested blocks, like if bodies on multiple lines, are flattened
+		if len(s.body) > 0 {
+			e.entry(it, s.body, env)
+		}
+	}
+}
+
+// newItem creates an entry or a submenu from its declaration arguments.
+func newItem(submenu bool, s statement, env map[string]string) (*Item, error) {
+	it := &Item{Submenu: submenu, Line: s.line}
+	kind := s.words[0].raw()
+
+	var titleSet bool
+	args := s.words[1:]
+	for i := 0; i < len(args); i++ {
+		a := args[i].expand(env)
+		// options taking a value
+		switch a {
+		case "--class", "--id", "${menuentry_id_option}", "--users", "--hotkey":
+			if i+1 >= len(args) {
+				return nil, fmt.Errorf("line %d: missing value for %s option of %s", s.line, a, kind)
+			}
+			i++
+			v := args[i].expand(env)
+			switch a {
+			case "--class":
+				it.Classes = append(it.Classes, v)
+			case "--id", "${menuentry_id_option}":
+				it.ID = v
+			}
+			continue
+		}
+		if strings.HasPrefix(a, "--") {
+			continue
+		}
+		if titleSet {
+			return nil, fmt.Errorf("line %d: unexpected argument %q for %s", s.line, a, kind)
+		}
+		it.Title = a
+		titleSet = true
+	}
+	if !titleSet {
+		return nil, fmt.Errorf("line %d: missing title for %s", s.line, kind)
+	}
+	return it, nil
+}
+
+// isKeyword returns if name is a control flow keyword.
+func isKeyword(name string) bool {
+	switch name {
+	case "if", "elif", "then", "else", "fi", "while", "until", "for", "do", "done":
+		return true
+	}
+	return false
+}
+
+// nesting returns the conditional nesting level after keyword.
+func nesting(keyword string, cond int) int {
+	switch keyword {
+	case "if", "while", "until", "for":
+		return cond + 1
+	case "fi", "done":
+		return cond - 1
+	}
+	return cond
+}
+
+// set assigns a variable from a set command.
+func set(words []word, env map[string]string) {
+	for _, w := range words[1:] {
+		kv := strings.SplitN(w.expand(env), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		env[kv[0]] = kv[1]
+	}
+}
+
+func copyEnv(env map[string]string) map[string]string {
+	r := make(map[string]string)
+	for k, v := range env {
+		r[k] = v
+	}
+	return r
+}
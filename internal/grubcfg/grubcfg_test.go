@@ -0,0 +1,161 @@
+package grubcfg_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ubuntu/grubmenugen-zfs-tests/internal/grubcfg"
+)
+
+const config = `function gfxmode {
+	set gfxpayload="${1}"
+}
+function historymenu {
+	# $1: root dataset
+	set root_dataset="${1}"
+	set kernel="${2}"
+
+	menuentry 'Revert system only' --class ubuntu ${menuentry_id_option} 'gnulinux-${root_dataset}' {
+		if [ "${grub_platform}" = xen ]; then insmod xzio; fi
+		linux	"${kernel}" root=ZFS="${root_dataset}" ro quiet splash ${vt_handoff}
+		initrd	"/initrd.img"
+	}
+}
+if [ "${recordfail}" != 1 ]; then
+  set linux_gfx_mode=keep
+else
+  set linux_gfx_mode=text
+fi
+
+menuentry 'Ubuntu 19.04' --class ubuntu --class os ${menuentry_id_option} 'gnulinux-rpool/ROOT/ubuntu' {
+	gfxmode ${linux_gfx_mode}
+	linux	"/ROOT/ubuntu@/boot/vmlinuz" root=ZFS="rpool/ROOT/ubuntu" ro
+	initrd	"/ROOT/ubuntu@/boot/initrd.img"
+}
+submenu 'History for Ubuntu 19.04' ${menuentry_id_option} 'gnulinux-history-rpool/ROOT/ubuntu' {
+	submenu 'Revert to snap1' ${menuentry_id_option} 'gnulinux-history-rpool/ROOT/ubuntu@snap1' {
+		historymenu "rpool/ROOT/ubuntu@snap1" "/ROOT/ubuntu@snap1/boot/vmlinuz"
+	}
+}
+`
+
+func TestParse(t *testing.T) {
+	m, err := grubcfg.Parse(strings.NewReader(config))
+	if err != nil {
+		t.Fatal("got error, expected none", err)
+	}
+
+	main := m.Find("Ubuntu 19.04")
+	if main == nil {
+		t.Fatal("main entry not found")
+	}
+	assert.Equal(t, "gnulinux-rpool/ROOT/ubuntu", main.ID)
+	assert.Equal(t, []string{"ubuntu", "os"}, main.Classes)
+	assert.Equal(t, "/ROOT/ubuntu@/boot/vmlinuz", main.Kernel)
+	assert.Equal(t, []string{"root=ZFS=rpool/ROOT/ubuntu", "ro"}, main.KernelArgs)
+	assert.Equal(t, []string{"/ROOT/ubuntu@/boot/initrd.img"}, main.Initrds)
+	assert.Equal(t, "rpool/ROOT/ubuntu", main.RootDataset)
+	// variables set in conditional blocks are kept verbatim
+	assert.Equal(t, "gfxmode ${linux_gfx_mode}", main.Commands[0].String())
+
+	revert := m.Find("History for Ubuntu 19.04", "Revert to snap1", "Revert system only")
+	if revert == nil {
+		t.Fatal("history entry not found")
+	}
+	// single quoted strings are not expanded
+	assert.Equal(t, "gnulinux-${root_dataset}", revert.ID)
+	assert.Equal(t, "/ROOT/ubuntu@snap1/boot/vmlinuz", revert.Kernel)
+	assert.Equal(t, "rpool/ROOT/ubuntu@snap1", revert.RootDataset)
+	assert.Equal(t, []string{"root=ZFS=rpool/ROOT/ubuntu@snap1", "ro", "quiet", "splash", "${vt_handoff}"}, revert.KernelArgs)
+	// conditions and conditional commands are listed
+	assert.Equal(t, "[ ${grub_platform} = xen ]", revert.Commands[0].String())
+	assert.Equal(t, "insmod xzio", revert.Commands[1].String())
+
+	assert.Len(t, m.Entries(), 2)
+}
+
+func TestParseErrors(t *testing.T) {
+	testCases := map[string]struct {
+		content string
+		wantErr string
+	}{
+		"unterminated quote":    {content: "menuentry 'Ubuntu {\n}\n", wantErr: "line 1: unterminated ' quote"},
+		"missing brace":         {content: "menuentry 'Ubuntu' {\n\tlinux /vmlinuz\n", wantErr: "line 1: missing \"}\" for \"menuentry\""},
+		"unexpected brace":      {content: "set a=b\n}\n", wantErr: "line 2: unexpected \"}\""},
+		"missing title":         {content: "menuentry --class ubuntu {\n}\n", wantErr: "line 1: missing title for menuentry"},
+		"missing class value":   {content: "menuentry 'Ubuntu' --class {\n}\n", wantErr: "line 1: missing value for --class option of menuentry"},
+		"recursive function":    {content: "function f {\n\tf\n}\nf\n", wantErr: "too many nested calls to \"f\""},
+		"lone brace":            {content: "{\n}\n", wantErr: "line 1: missing command before \"{\""},
+		"lone brace in entry":   {content: "menuentry 'a' {\n{\n}\n}\n", wantErr: "line 2: missing command before \"{\""},
+		"lone brace in submenu": {content: "submenu 'x' {\n {\n}\n}\n", wantErr: "line 2: missing command before \"{\""},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			_, err := grubcfg.Parse(strings.NewReader(tc.content))
+			if err == nil {
+				t.Fatal("expected an error, got none")
+			}
+			assert.Contains(t, err.Error(), tc.wantErr)
+		})
+	}
+}
+
+func TestDiff(t *testing.T) {
+	want, err := grubcfg.Parse(strings.NewReader(config))
+	if err != nil {
+		t.Fatal("couldn't parse grub config", err)
+	}
+	got, err := grubcfg.Parse(strings.NewReader(strings.Replace(config, `historymenu "rpool/ROOT/ubuntu@snap1"`, `historymenu "rpool/ROOT/ubuntu"`, 1)))
+	if err != nil {
+		t.Fatal("couldn't parse grub config", err)
+	}
+
+	assert.Empty(t, grubcfg.Diff(want, want))
+	assert.Equal(t, []string{
+		`History for Ubuntu 19.04 > Revert to snap1 > Revert system only: kernel command line differs: got "root=ZFS=rpool/ROOT/ubuntu ro quiet splash ${vt_handoff}", want "root=ZFS=rpool/ROOT/ubuntu@snap1 ro quiet splash ${vt_handoff}"`,
+		`History for Ubuntu 19.04 > Revert to snap1 > Revert system only: root dataset differs: got "rpool/ROOT/ubuntu", want "rpool/ROOT/ubuntu@snap1"`,
+		`History for Ubuntu 19.04 > Revert to snap1 > Revert system only: commands differ`,
+	}, grubcfg.Diff(got, want))
+}
+
+// TestReferenceMenus parses all reference grub menus and checks that history entries boot the snapshot or clone
+// of their revert submenu.
+func TestReferenceMenus(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("..", "..", "testdata", "definitions", "*", "*", "grubmenu"))
+	if err != nil {
+		t.Fatal("couldn't list reference grub menus", err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no reference grub menu found")
+	}
+
+	for _, f := range files {
+		f := f
+		t.Run(f, func(t *testing.T) {
+			r, err := os.Open(f)
+			if err != nil {
+				t.Fatal("couldn't open grub menu", err)
+			}
+			defer r.Close()
+
+			m, err := grubcfg.Parse(r)
+			if err != nil {
+				t.Fatal("got error, expected none", err)
+			}
+
+			m.Walk(func(parents []*grubcfg.Item, it *grubcfg.Item) {
+				if it.Submenu || len(parents) < 2 || !strings.HasPrefix(parents[0].Title, "History for ") {
+					return
+				}
+				revert := parents[len(parents)-1]
+				assert.Equal(t, strings.TrimPrefix(revert.ID, "gnulinux-history-"), it.RootDataset,
+					"%s: should boot the dataset of its revert submenu", grubcfg.Path(parents, it))
+			})
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package grubcfg
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// part is a piece of a word, with its quoting. Only unquoted and double quoted parts are subject to variable
+// expansion.
+type part struct {
+	text  string
+	quote byte
+}
+
+// word is a shell-like word, made of adjacent parts, like foo"bar"'baz'.
+type word struct {
+	parts []part
+	line  int
+}
+
+// raw returns the word without quotes and before any expansion.
+func (w word) raw() string {
+	var b strings.Builder
+	for _, p := range w.parts {
+		b.WriteString(p.text)
+	}
+	return b.String()
+}
+
+// is returns if the word is the unquoted literal s.
+func (w word) is(s string) bool {
+	return len(w.parts) == 1 && w.parts[0].quote == 0 && w.parts[0].text == s
+}
+
+var variableRe = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*|[0-9]+)\}|\$([A-Za-z_][A-Za-z0-9_]*|[0-9])`)
+
+// expand returns the word value, with variables defined in env substituted. Unknown variables are kept verbatim.
+func (w word) expand(env map[string]string) string {
+	var b strings.Builder
+	for _, p := range w.parts {
+		if p.quote == '\'' {
+			b.WriteString(p.text)
+			continue
+		}
+		b.WriteString(variableRe.ReplaceAllStringFunc(p.text, func(v string) string {
+			m := variableRe.FindStringSubmatch(v)
+			name := m[1] + m[2]
+			if val, ok := env[name]; ok {
+				return val
+			}
+			return v
+		}))
+	}
+	return b.String()
+}
+
+// token kinds
+const (
+	tokWord = iota
+	tokSeparator
+)
+
+type token struct {
+	kind int
+	word word
+	line int
+}
+
+// lex splits a grub script in words and command separators (newlines and semicolons).
+func lex(content string) ([]token, error) {
+	var tokens []token
+	line := 1
+
+	var cur *word
+	var buf strings.Builder
+	flushPart := func(quote byte) {
+		if cur == nil {
+			cur = &word{line: line}
+		}
+		cur.parts = append(cur.parts, part{text: buf.String(), quote: quote})
+		buf.Reset()
+	}
+	endWord := func() {
+		if buf.Len() > 0 {
+			flushPart(0)
+		}
+		if cur != nil {
+			tokens = append(tokens, token{kind: tokWord, word: *cur, line: cur.line})
+			cur = nil
+		}
+	}
+
+	for i := 0; i < len(content); i++ {
+		c := content[i]
+		switch c {
+		case ' ', '\t', '\r':
+			endWord()
+		case '\n', ';':
+			endWord()
+			tokens = append(tokens, token{kind: tokSeparator, line: line})
+			if c == '\n' {
+				line++
+			}
+		case '#':
+			if cur != nil || buf.Len() > 0 {
+				buf.WriteByte(c)
+				continue
+			}
+			for i < len(content)-1 && content[i+1] != '\n' {
+				i++
+			}
+		case '\\':
+			if i+1 >= len(content) {
+				return nil, fmt.Errorf("line %d: unexpected end of file after escape character", line)
+			}
+			i++
+			if content[i] == '\n' {
+				line++
+				continue
+			}
+			buf.WriteByte(content[i])
+		case '\'', '"':
+			if buf.Len() > 0 {
+				flushPart(0)
+			}
+			if cur == nil {
+				cur = &word{line: line}
+			}
+			start := line
+			closed := false
+			for i++; i < len(content); i++ {
+				if content[i] == c {
+					closed = true
+					break
+				}
+				if content[i] == '\n' {
+					line++
+				}
+				if c == '"' && content[i] == '\\' && i+1 < len(content) && strings.IndexByte(`"\`, content[i+1]) >= 0 {
+					i++
+				}
+				buf.WriteByte(content[i])
+			}
+			if !closed {
+				return nil, fmt.Errorf("line %d: unterminated %c quote", start, c)
+			}
+			flushPart(c)
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	endWord()
+	return tokens, nil
+}
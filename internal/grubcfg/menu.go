@@ -0,0 +1,122 @@
+package grubcfg
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Walk calls fn for each item of the menu, depth first, with the submenus leading to it.
+func (m *Menu) Walk(fn func(parents []*Item, it *Item)) {
+	var walk func(parents []*Item, items []*Item)
+	walk = func(parents []*Item, items []*Item) {
+		for _, it := range items {
+			fn(parents, it)
+			if it.Submenu {
+				walk(append(parents[:len(parents):len(parents)], it), it.Items)
+			}
+		}
+	}
+	walk(nil, m.Items)
+}
+
+// Entries returns all menuentries, in menu order, whatever their submenu.
+func (m *Menu) Entries() []*Item {
+	var entries []*Item
+	m.Walk(func(_ []*Item, it *Item) {
+		if !it.Submenu {
+			entries = append(entries, it)
+		}
+	})
+	return entries
+}
+
+// Find returns the item reached by following titles from the top level menu, or nil.
+func (m *Menu) Find(titles ...string) *Item {
+	items := m.Items
+	var found *Item
+	for _, title := range titles {
+		found = nil
+		for _, it := range items {
+			if it.Title == title {
+				found = it
+				break
+			}
+		}
+		if found == nil {
+			return nil
+		}
+		items = found.Items
+	}
+	return found
+}
+
+// Path returns the titles leading to an item, separated by " > ".
+func Path(parents []*Item, it *Item) string {
+	var titles []string
+	for _, p := range parents {
+		titles = append(titles, p.Title)
+	}
+	return strings.Join(append(titles, it.Title), " > ")
+}
+
+// Diff returns human readable differences between got and want menus, item by item in menu order.
+// It is empty when both trees are identical.
+func Diff(got, want *Menu) []string {
+	return diffItems(nil, got.Items, want.Items)
+}
+
+func diffItems(parents []*Item, got, want []*Item) []string {
+	var diffs []string
+	for i := 0; i < len(got) || i < len(want); i++ {
+		switch {
+		case i >= len(got):
+			diffs = append(diffs, fmt.Sprintf("%s: missing %s", Path(parents, want[i]), kind(want[i])))
+			continue
+		case i >= len(want):
+			diffs = append(diffs, fmt.Sprintf("%s: unexpected %s", Path(parents, got[i]), kind(got[i])))
+			continue
+		}
+
+		g, w := got[i], want[i]
+		path := Path(parents, w)
+		if g.Title != w.Title || g.Submenu != w.Submenu {
+			diffs = append(diffs, fmt.Sprintf("%s: got %s %q at this position", path, kind(g), g.Title))
+			continue
+		}
+		for _, f := range []struct {
+			name      string
+			got, want interface{}
+		}{
+			{"id", g.ID, w.ID},
+			{"classes", g.Classes, w.Classes},
+			{"kernel", g.Kernel, w.Kernel},
+			{"kernel command line", g.KernelArgs, w.KernelArgs},
+			{"initrd", g.Initrds, w.Initrds},
+			{"root dataset", g.RootDataset, w.RootDataset},
+		} {
+			if !reflect.DeepEqual(f.got, f.want) {
+				diffs = append(diffs, fmt.Sprintf("%s: %s differs: got %q, want %q", path, f.name, format(f.got), format(f.want)))
+			}
+		}
+		if !w.Submenu && !reflect.DeepEqual(g.Commands, w.Commands) {
+			diffs = append(diffs, fmt.Sprintf("%s: commands differ", path))
+		}
+		diffs = append(diffs, diffItems(append(parents[:len(parents):len(parents)], w), g.Items, w.Items)...)
+	}
+	return diffs
+}
+
+func kind(it *Item) string {
+	if it.Submenu {
+		return "submenu"
+	}
+	return "menuentry"
+}
+
+func format(v interface{}) string {
+	if l, ok := v.([]string); ok {
+		return strings.Join(l, " ")
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,93 @@
+package grubcfg
+
+import (
+	"fmt"
+)
+
+// statement is a command with its words. Commands ending with "{" (function, menuentry and submenu) have a body.
+type statement struct {
+	words []word
+	body  []statement
+	block bool
+	line  int
+}
+
+// parse builds the statements tree from tokens.
+func parse(tokens []token) ([]statement, error) {
+	p := parser{tokens: tokens}
+	stmts, closed, err := p.block()
+	if err != nil {
+		return nil, err
+	}
+	if closed {
+		return nil, fmt.Errorf("line %d: unexpected \"}\"", p.line)
+	}
+	return stmts, nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+	line   int
+}
+
+// block parses statements until a closing brace or the end of file. closed reports if a brace ended the block.
+func (p *parser) block() (stmts []statement, closed bool, err error) {
+	for {
+		words, ok := p.command()
+		if !ok {
+			return stmts, false, nil
+		}
+		if len(words) == 0 {
+			continue
+		}
+		if words[0].is("}") {
+			if len(words) > 1 {
+				return nil, false, fmt.Errorf("line %d: unexpected %q after \"}\"", words[1].line, words[1].raw())
+			}
+			return stmts, true, nil
+		}
+
+		// "then foo" and "else foo" are a keyword followed by a command
+		if len(words) > 1 && (words[0].is("then") || words[0].is("else") || words[0].is("do")) {
+			stmts = append(stmts, statement{words: words[:1], line: words[0].line})
+			words = words[1:]
+		}
+
+		if len(words) == 1 && words[0].is("{") {
+			return nil, false, fmt.Errorf("line %d: missing command before \"{\"", words[0].line)
+		}
+
+		s := statement{words: words, line: words[0].line}
+		if last := words[len(words)-1]; last.is("{") {
+			s.words = words[:len(words)-1]
+			s.block = true
+			body, closed, err := p.block()
+			if err != nil {
+				return nil, false, err
+			}
+			if !closed {
+				return nil, false, fmt.Errorf("line %d: missing \"}\" for %q", s.line, s.words[0].raw())
+			}
+			s.body = body
+		}
+		stmts = append(stmts, s)
+	}
+}
+
+// command returns the words up to the next separator. ok is false at the end of file.
+func (p *parser) command() (words []word, ok bool) {
+	if p.pos >= len(p.tokens) {
+		return nil, false
+	}
+	for ; p.pos < len(p.tokens); p.pos++ {
+		t := p.tokens[p.pos]
+		p.line = t.line
+		if t.kind == tokSeparator {
+			p.pos++
+			return words, true
+		}
+		words = append(words, t.word)
+	}
+	return words, true
+}
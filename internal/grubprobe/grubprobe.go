@@ -0,0 +1,144 @@
+// Package grubprobe answers grub-probe queries from the table of the fake devices of a test case.
+//
+// The test suite writes the table when creating the devices described in testcase.yaml, with their optional
+// grub-probe answers, and the grub-probe mock reads it. Devices without declared answers, or unknown to the table,
+// get default answers derived from their name.
+package grubprobe
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// DevicesEnv is the environment variable pointing the grub-probe mock to the device table.
+const DevicesEnv = "TEST_GRUBPROBE_DEVICES"
+
+// Answers are the grub-probe answers of a device, per target. Empty ones are replaced by default answers.
+type Answers struct {
+	FS                string `json:"fs,omitempty" yaml:"fs"`
+	FSUUID            string `json:"fs_uuid,omitempty" yaml:"fs_uuid"`
+	Partmap           string `json:"partmap,omitempty" yaml:"partmap"`
+	Abstraction       string `json:"abstraction,omitempty" yaml:"abstraction"`
+	Hints             string `json:"hints_string,omitempty" yaml:"hints_string"`
+	CompatibilityHint string `json:"compatibility_hint,omitempty" yaml:"compatibility_hint"`
+	// Error makes targets reading the filesystem fail, like "unknown filesystem" for pools GRUB can't read.
+	Error string `json:"error,omitempty" yaml:"error"`
+}
+
+// Or returns the answers of a, completed by the ones of defaults where empty.
+func (a Answers) Or(defaults Answers) Answers {
+	for _, f := range []struct{ v, def *string }{
+		{&a.FS, &defaults.FS},
+		{&a.FSUUID, &defaults.FSUUID},
+		{&a.Partmap, &defaults.Partmap},
+		{&a.Abstraction, &defaults.Abstraction},
+		{&a.Hints, &defaults.Hints},
+		{&a.CompatibilityHint, &defaults.CompatibilityHint},
+		{&a.Error, &defaults.Error},
+	} {
+		if *f.v == "" {
+			*f.v = *f.def
+		}
+	}
+	return a
+}
+
+// Device is a device file of a test case.
+type Device struct {
+	Path string `json:"path"`
+	// Pool is the name of the pool the device is a vdev of. It is empty for partitions.
+	Pool    string  `json:"pool,omitempty"`
+	Answers Answers `json:"answers"`
+}
+
+// Table lists the devices of a test case.
+type Table struct {
+	Devices []Device `json:"devices"`
+}
+
+// Load reads the table at path. A missing table is empty.
+func Load(path string) (Table, error) {
+	var t Table
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return t, nil
+	} else if err != nil {
+		return t, fmt.Errorf("couldn't read device table: %v", err)
+	}
+	if err := json.Unmarshal(b, &t); err != nil {
+		return t, fmt.Errorf("couldn't decode device table: %v", err)
+	}
+	return t, nil
+}
+
+// Write saves the table at path.
+func (t Table) Write(path string) error {
+	b, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		return fmt.Errorf("couldn't encode device table: %v", err)
+	}
+	return ioutil.WriteFile(path, b, 0644)
+}
+
+// Lookup returns the device named name.
+// Loop devices backing partitions are renamed /dev/loop00 by the test setup: they match the partition of the table
+// if there is only one.
+func (t Table) Lookup(name string) (Device, bool) {
+	var partitions []Device
+	for _, d := range t.Devices {
+		if d.Path == name {
+			return d, true
+		}
+		if d.Pool == "" {
+			partitions = append(partitions, d)
+		}
+	}
+	if strings.HasPrefix(name, "/dev/loop") && len(partitions) == 1 {
+		return partitions[0], true
+	}
+	return Device{}, false
+}
+
+// PoolDevice returns the device reported for the datasets of pool: its first vdev.
+func (t Table) PoolDevice(pool string) (string, bool) {
+	for _, d := range t.Devices {
+		if d.Pool == pool {
+			return d.Path, true
+		}
+	}
+	return "", false
+}
+
+// Error returns the error grub-probe fails with for target on the device named name, if any.
+func (t Table) Error(name, target string) string {
+	d, _ := t.Lookup(name)
+	if target != "fs" && target != "fs_uuid" {
+		return ""
+	}
+	return d.Answers.Error
+}
+
+// Answer returns what grub-probe prints for target on the device named name.
+func (t Table) Answer(name, target string) (string, error) {
+	d, _ := t.Lookup(name)
+	a := d.Answers
+	answers := map[string][2]string{
+		"fs":                 {a.FS, "ext2"},
+		"fs_uuid":            {a.FSUUID, "UUID-" + name},
+		"partmap":            {a.Partmap, "gpt"},
+		"abstraction":        {a.Abstraction, "modfor_" + name},
+		"hints_string":       {a.Hints, "--hint-bios=hd0,gpt2 --hint-efi=hd0,gpt2"},
+		"compatibility_hint": {a.CompatibilityHint, "hd0,gpt2"},
+	}
+	v, ok := answers[target]
+	if !ok {
+		return "", fmt.Errorf("unknown target: %s", target)
+	}
+	if v[0] != "" {
+		return v[0], nil
+	}
+	return v[1], nil
+}
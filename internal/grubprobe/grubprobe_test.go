@@ -0,0 +1,153 @@
+package grubprobe_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ubuntu/grubmenugen-zfs-tests/internal/grubprobe"
+)
+
+var table = grubprobe.Table{
+	Devices: []grubprobe.Device{
+		{Path: "/tmp/test/bpool1.disk", Pool: "bpool", Answers: grubprobe.Answers{
+			FS:          "zfs",
+			FSUUID:      "1234abcd",
+			Abstraction: "mdraid1x",
+			Partmap:     "msdos",
+		}},
+		{Path: "/tmp/test/bpool2.disk", Pool: "bpool"},
+		{Path: "/tmp/test/main.disk", Pool: "rpool"},
+		{Path: "/tmp/test/special.disk", Pool: "tank", Answers: grubprobe.Answers{
+			FS:          "zfs",
+			Abstraction: "raidz2",
+			Error:       "unknown filesystem",
+		}},
+		{Path: "/tmp/test/boot.disk", Answers: grubprobe.Answers{
+			CompatibilityHint: "hd1,msdos1",
+			Hints:             "--hint=hd1,msdos1",
+		}},
+	},
+}
+
+func TestAnswer(t *testing.T) {
+	testCases := map[string]struct {
+		device string
+		target string
+
+		want    string
+		wantErr bool
+	}{
+		"declared fs":                 {device: "/tmp/test/bpool1.disk", target: "fs", want: "zfs"},
+		"declared fs uuid":            {device: "/tmp/test/bpool1.disk", target: "fs_uuid", want: "1234abcd"},
+		"declared abstraction":        {device: "/tmp/test/bpool1.disk", target: "abstraction", want: "mdraid1x"},
+		"declared partmap":            {device: "/tmp/test/bpool1.disk", target: "partmap", want: "msdos"},
+		"default hints":               {device: "/tmp/test/bpool1.disk", target: "hints_string", want: "--hint-bios=hd0,gpt2 --hint-efi=hd0,gpt2"},
+		"default compatibility hint":  {device: "/tmp/test/bpool1.disk", target: "compatibility_hint", want: "hd0,gpt2"},
+		"default fs":                  {device: "/tmp/test/main.disk", target: "fs", want: "ext2"},
+		"default fs uuid":             {device: "/tmp/test/main.disk", target: "fs_uuid", want: "UUID-/tmp/test/main.disk"},
+		"default abstraction":         {device: "/tmp/test/main.disk", target: "abstraction", want: "modfor_/tmp/test/main.disk"},
+		"default partmap":             {device: "/tmp/test/main.disk", target: "partmap", want: "gpt"},
+		"vdevs are distinct devices":  {device: "/tmp/test/bpool2.disk", target: "fs", want: "ext2"},
+		"unknown device":              {device: "/dev/sda1", target: "fs_uuid", want: "UUID-/dev/sda1"},
+		"anonymized loop device":      {device: "/dev/loop00", target: "compatibility_hint", want: "hd1,msdos1"},
+		"anonymized loop device hint": {device: "/dev/loop00", target: "hints_string", want: "--hint=hd1,msdos1"},
+
+		"error on unknown target": {device: "/tmp/test/main.disk", target: "cryptodisk_uuid", wantErr: true},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			got, err := table.Answer(tc.device, tc.target)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			if err != nil {
+				t.Fatal("unexpected error", err)
+			}
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestError(t *testing.T) {
+	testCases := map[string]struct {
+		device string
+		target string
+
+		want string
+	}{
+		"fs of unreadable device":          {device: "/tmp/test/special.disk", target: "fs", want: "unknown filesystem"},
+		"fs uuid of unreadable device":     {device: "/tmp/test/special.disk", target: "fs_uuid", want: "unknown filesystem"},
+		"abstraction of unreadable device": {device: "/tmp/test/special.disk", target: "abstraction"},
+		"fs of readable device":            {device: "/tmp/test/bpool1.disk", target: "fs"},
+		"unknown device":                   {device: "/dev/sda1", target: "fs"},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.want, table.Error(tc.device, tc.target))
+		})
+	}
+}
+
+func TestOr(t *testing.T) {
+	t.Parallel()
+
+	declared := grubprobe.Answers{FS: "zfs", Partmap: "msdos"}
+	defaults := grubprobe.Answers{FS: "ext2", Abstraction: "mirror", Error: "unknown filesystem"}
+
+	assert.Equal(t, grubprobe.Answers{FS: "zfs", Partmap: "msdos", Abstraction: "mirror", Error: "unknown filesystem"},
+		declared.Or(defaults), "declared answers should take precedence")
+	assert.Equal(t, grubprobe.Answers{FS: "zfs", Partmap: "msdos"}, declared, "receiver shouldn't be modified")
+}
+
+func TestLookupAmbiguousLoopDevice(t *testing.T) {
+	t.Parallel()
+
+	tbl := grubprobe.Table{Devices: []grubprobe.Device{{Path: "/tmp/test/boot.disk"}, {Path: "/tmp/test/home.disk"}}}
+	_, ok := tbl.Lookup("/dev/loop00")
+	assert.False(t, ok, "loop device can't be matched to one of multiple partitions")
+}
+
+func TestPoolDevice(t *testing.T) {
+	t.Parallel()
+
+	dev, ok := table.PoolDevice("bpool")
+	assert.True(t, ok)
+	assert.Equal(t, "/tmp/test/bpool1.disk", dev, "datasets are on the first vdev")
+
+	_, ok = table.PoolDevice("doesnotexist")
+	assert.False(t, ok)
+}
+
+func TestWriteAndLoad(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "grubprobe-")
+	if err != nil {
+		t.Fatal("couldn't create temporary directory", err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := filepath.Join(dir, "devices.json")
+	if err := table.Write(p); err != nil {
+		t.Fatal("couldn't write table", err)
+	}
+	got, err := grubprobe.Load(p)
+	if err != nil {
+		t.Fatal("couldn't load table", err)
+	}
+	assert.Equal(t, table, got)
+
+	got, err = grubprobe.Load(filepath.Join(dir, "doesnotexist"))
+	if err != nil {
+		t.Fatal("missing table should be empty", err)
+	}
+	assert.Empty(t, got.Devices)
+}
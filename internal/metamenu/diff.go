@@ -0,0 +1,226 @@
+package metamenu
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+// MachineDiff lists the differences between the entries of one machine.
+type MachineDiff struct {
+	MachineID string
+	Changes   []string
+}
+
+func (d MachineDiff) String() string {
+	return fmt.Sprintf("machine %s:\n\t%s", d.MachineID, strings.Join(d.Changes, "\n\t"))
+}
+
+// Diff returns added, removed, reordered and changed entries between got and want, grouped per machine.
+// It is empty when both menus are semantically identical.
+func Diff(got, want []Entry) []MachineDiff {
+	gotOrder, gotByMachine := byMachine(got)
+	wantOrder, wantByMachine := byMachine(want)
+
+	changes := make(map[string][]string)
+	for _, id := range wantOrder {
+		if _, ok := gotByMachine[id]; !ok {
+			changes[id] = append(changes[id], "machine removed")
+			continue
+		}
+		changes[id] = append(changes[id], diffMachine(gotByMachine[id], wantByMachine[id])...)
+	}
+	for _, id := range gotOrder {
+		if _, ok := wantByMachine[id]; !ok {
+			changes[id] = append(changes[id], "machine added")
+		}
+	}
+	for _, m := range moved(gotOrder, wantOrder) {
+		changes[m.key] = append([]string{fmt.Sprintf("machine moved from position %d to %d", m.from, m.to)}, changes[m.key]...)
+	}
+
+	var diffs []MachineDiff
+	for _, id := range append(wantOrder, gotOrder...) {
+		if len(changes[id]) == 0 {
+			continue
+		}
+		diffs = append(diffs, MachineDiff{MachineID: id, Changes: changes[id]})
+		delete(changes, id)
+	}
+	return diffs
+}
+
+// byMachine groups entries per machine, returning machine ids in order of first appearance.
+func byMachine(entries []Entry) ([]string, map[string][]Entry) {
+	var order []string
+	groups := make(map[string][]Entry)
+	for _, e := range entries {
+		if _, ok := groups[e.MachineID]; !ok {
+			order = append(order, e.MachineID)
+		}
+		groups[e.MachineID] = append(groups[e.MachineID], e)
+	}
+	return order, groups
+}
+
+// diffMachine compares the entries of a machine, kind by kind.
+func diffMachine(got, want []Entry) []string {
+	var changes []string
+	for _, kind := range []Kind{Main, Advanced, History} {
+		g, w := ofKind(got, kind), ofKind(want, kind)
+
+		gotByKey := make(map[string]Entry)
+		var gotKeys []string
+		for _, e := range g {
+			gotByKey[e.key()] = e
+			gotKeys = append(gotKeys, e.key())
+		}
+		wantByKey := make(map[string]Entry)
+		var wantKeys []string
+		for _, e := range w {
+			wantByKey[e.key()] = e
+			wantKeys = append(wantKeys, e.key())
+		}
+
+		for _, e := range w {
+			if _, ok := gotByKey[e.key()]; !ok {
+				changes = append(changes, fmt.Sprintf("%s entry %s removed", kind, e.label()))
+			}
+		}
+		for _, e := range g {
+			if _, ok := wantByKey[e.key()]; !ok {
+				changes = append(changes, fmt.Sprintf("%s entry %s added", kind, e.label()))
+			}
+		}
+		for _, m := range moved(gotKeys, wantKeys) {
+			changes = append(changes, fmt.Sprintf("%s entry %s moved from position %d to %d", kind, wantByKey[m.key].label(), m.from, m.to))
+		}
+		for _, e := range w {
+			if ge, ok := gotByKey[e.key()]; ok {
+				changes = append(changes, diffEntry(ge, e)...)
+			}
+		}
+	}
+	return changes
+}
+
+// ofKind returns entries of kind k.
+func ofKind(entries []Entry, k Kind) []Entry {
+	var r []Entry
+	for _, e := range entries {
+		if e.Kind == k {
+			r = append(r, e)
+		}
+	}
+	return r
+}
+
+// key identifies an entry among entries of the same kind for a machine.
+func (e Entry) key() string {
+	if e.Kind == Advanced {
+		return e.Dataset + " " + e.Kernel
+	}
+	return e.Dataset
+}
+
+// label is how an entry is designated in diff messages.
+func (e Entry) label() string {
+	switch e.Kind {
+	case Advanced:
+		return filepath.Base(e.Kernel)
+	case History:
+		return strings.SplitN(e.Name, " on ", 2)[0]
+	default:
+		return e.Dataset
+	}
+}
+
+// diffEntry compares each field, other than machine and kind, of two matching entries.
+// Entry fields are in the same order than fields.
+func diffEntry(got, want Entry) []string {
+	var diffs []string
+	gv, wv := reflect.ValueOf(got), reflect.ValueOf(want)
+	for i := range fields {
+		if fields[i] == "machine-id" || fields[i] == "kind" {
+			continue
+		}
+		g, w := gv.Field(i).Interface(), wv.Field(i).Interface()
+		if reflect.DeepEqual(g, w) {
+			continue
+		}
+		diffs = append(diffs, fmt.Sprintf("%s entry %s: %s differs: got %q, want %q", want.Kind, want.label(), fields[i], fmt.Sprint(g), fmt.Sprint(w)))
+	}
+	return diffs
+}
+
+// move is an element found at a different position. Positions are 1-based.
+type move struct {
+	key      string
+	from, to int
+}
+
+// moved returns elements common to got and want which are out of order. Elements of the longest common
+// subsequence are considered in place, so that a single moved element doesn't shift all others.
+func moved(got, want []string) []move {
+	gotPos := make(map[string]int)
+	for i, k := range got {
+		gotPos[k] = i
+	}
+	wantSet := make(map[string]bool)
+	for _, k := range want {
+		wantSet[k] = true
+	}
+	var g, w []string
+	for _, k := range got {
+		if wantSet[k] {
+			g = append(g, k)
+		}
+	}
+	for _, k := range want {
+		if _, ok := gotPos[k]; ok {
+			w = append(w, k)
+		}
+	}
+
+	// lcs[i][j] is the length of the longest common subsequence of w[i:] and g[j:].
+	lcs := make([][]int, len(w)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(g)+1)
+	}
+	for i := len(w) - 1; i >= 0; i-- {
+		for j := len(g) - 1; j >= 0; j-- {
+			switch {
+			case w[i] == g[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	inPlace := make(map[string]bool)
+	for i, j := 0, 0; i < len(w) && j < len(g); {
+		switch {
+		case w[i] == g[j]:
+			inPlace[w[i]] = true
+			i++
+			j++
+		// On ties, keep earlier wanted elements in place.
+		case lcs[i+1][j] > lcs[i][j+1]:
+			i++
+		default:
+			j++
+		}
+	}
+
+	var r []move
+	for i, k := range want {
+		if _, ok := gotPos[k]; !ok || inPlace[k] {
+			continue
+		}
+		r = append(r, move{key: k, from: i + 1, to: gotPos[k] + 1})
+	}
+	return r
+}
@@ -0,0 +1,170 @@
+// Package metamenu parses and serializes the metamenu intermediate format generated by 10_linux_zfs.
+//
+// A metamenu has one tab separated record per line, grouped by machine:
+// machine-id, zsys flag, kind, name, dataset, device, initrd and kernel.
+// Advanced entries have an additional field, set to "true" when the kernel is the last booted one.
+package metamenu
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	fieldSeparator = "\t"
+	unset          = "-"
+)
+
+// Kind is the kind of menu entry.
+type Kind string
+
+// Entry kinds, in the order they appear for a machine.
+const (
+	Main     Kind = "main"
+	Advanced Kind = "advanced"
+	History  Kind = "history"
+)
+
+// fields are the names of the record fields, in order.
+var fields = []string{
+	"machine-id",
+	"zsys",
+	"kind",
+	"name",
+	"dataset",
+	"device",
+	"initrd",
+	"kernel",
+	"last-booted",
+}
+
+// Entry is one menu entry of a machine.
+type Entry struct {
+	MachineID string
+	Zsys      bool
+	Kind      Kind
+	// Name is the OS name for main and advanced entries, and the snapshot or clone name and date for history.
+	Name    string
+	Dataset string
+	Device  string
+	Initrd  string
+	Kernel  string
+	// LastBooted is only set for advanced entries.
+	LastBooted bool
+}
+
+// ParseError is a malformed record. Column is the 1-based index of the faulty field.
+type ParseError struct {
+	Line   int
+	Column int
+	Msg    string
+}
+
+func (e ParseError) Error() string {
+	if e.Column == 0 {
+		return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+	}
+	return fmt.Sprintf("line %d, column %d (%s): %s", e.Line, e.Column, fields[e.Column-1], e.Msg)
+}
+
+// Parse reads all records of a metamenu.
+func Parse(r io.Reader) ([]Entry, error) {
+	var entries []Entry
+
+	s := bufio.NewScanner(r)
+	line := 0
+	for s.Scan() {
+		line++
+		e, err := parseLine(s.Text(), line)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("couldn't read metamenu: %v", err)
+	}
+	return entries, nil
+}
+
+// parseLine parses and validates a single record.
+func parseLine(l string, line int) (Entry, error) {
+	var e Entry
+	values := strings.Split(l, fieldSeparator)
+	if len(values) < 3 {
+		return e, ParseError{Line: line, Msg: fmt.Sprintf("expected at least 3 fields, got %d", len(values))}
+	}
+	errAt := func(col int, format string, a ...interface{}) error {
+		return ParseError{Line: line, Column: col + 1, Msg: fmt.Sprintf(format, a...)}
+	}
+
+	e.Kind = Kind(values[2])
+	want := len(fields) - 1
+	switch e.Kind {
+	case Main, History:
+	case Advanced:
+		want = len(fields)
+	default:
+		return e, errAt(2, "unknown entry kind %q", values[2])
+	}
+	if len(values) != want {
+		return e, ParseError{Line: line, Msg: fmt.Sprintf("expected %d fields for %s entry, got %d", want, e.Kind, len(values))}
+	}
+
+	for i, v := range values {
+		if v == "" {
+			return e, errAt(i, "empty value")
+		}
+	}
+
+	e.MachineID = values[0]
+	switch values[1] {
+	case "yes":
+		e.Zsys = true
+	case unset:
+	default:
+		return e, errAt(1, "expected %q or %q, got %q", "yes", unset, values[1])
+	}
+	e.Name = values[3]
+	e.Dataset = values[4]
+	e.Device = values[5]
+	e.Initrd = values[6]
+	e.Kernel = values[7]
+
+	if e.Kind == Advanced {
+		switch values[8] {
+		case "true":
+			e.LastBooted = true
+		case "false":
+		default:
+			return e, errAt(8, "expected %q or %q, got %q", "true", "false", values[8])
+		}
+	}
+
+	return e, nil
+}
+
+// String serializes the entry as a metamenu record, without trailing newline.
+func (e Entry) String() string {
+	zsys := unset
+	if e.Zsys {
+		zsys = "yes"
+	}
+	values := []string{e.MachineID, zsys, string(e.Kind), e.Name, e.Dataset, e.Device, e.Initrd, e.Kernel}
+	if e.Kind == Advanced {
+		values = append(values, fmt.Sprint(e.LastBooted))
+	}
+	return strings.Join(values, fieldSeparator)
+}
+
+// Write serializes entries as a metamenu.
+func Write(w io.Writer, entries []Entry) error {
+	for _, e := range entries {
+		if _, err := fmt.Fprintln(w, e.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package metamenu_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ubuntu/grubmenugen-zfs-tests/internal/metamenu"
+)
+
+const menu = `11111111111111111111111111111111	-	main	Ubuntu 19.04	rpool/ROOT/ubuntu	main.disk	/ROOT/ubuntu@/boot/initrd.img-5.0.0-13-generic	/ROOT/ubuntu@/boot/vmlinuz-5.0.0-13-generic
+11111111111111111111111111111111	-	advanced	Ubuntu 19.04	rpool/ROOT/ubuntu	main.disk	/ROOT/ubuntu@/boot/initrd.img-5.0.0-13-generic	/ROOT/ubuntu@/boot/vmlinuz-5.0.0-13-generic	false
+11111111111111111111111111111111	-	advanced	Ubuntu 19.04	rpool/ROOT/ubuntu	main.disk	/ROOT/ubuntu@/boot/initrd.img-4.15.0-13-generic	/ROOT/ubuntu@/boot/vmlinuz-4.15.0-13-generic	true
+11111111111111111111111111111111	-	history	snap2 on 12/31/19 @ 08:36	rpool/ROOT/ubuntu@snap2	main.disk	/ROOT/ubuntu@snap2/boot/initrd.img-4.15.0-13-generic	/ROOT/ubuntu@snap2/boot/vmlinuz-4.15.0-13-generic
+11111111111111111111111111111111	-	history	snap1 on 12/10/18 @ 13:20	rpool/ROOT/ubuntu@snap1	main.disk	/ROOT/ubuntu@snap1/boot/initrd.img-4.15.0-13-generic	/ROOT/ubuntu@snap1/boot/vmlinuz-4.15.0-13-generic
+22222222222222222222222222222222	yes	main	Ubuntu 18.10	rpool/ROOT/ubuntu_2	main.disk	/ROOT/ubuntu_2@/boot/initrd.img-5.0.0-13-generic	/ROOT/ubuntu_2@/boot/vmlinuz-5.0.0-13-generic
+`
+
+func TestParse(t *testing.T) {
+	entries, err := metamenu.Parse(strings.NewReader(menu))
+	if err != nil {
+		t.Fatal("got error, expected none", err)
+	}
+	assert.Len(t, entries, 6)
+	assert.Equal(t, metamenu.Entry{
+		MachineID:  "11111111111111111111111111111111",
+		Kind:       metamenu.Advanced,
+		Name:       "Ubuntu 19.04",
+		Dataset:    "rpool/ROOT/ubuntu",
+		Device:     "main.disk",
+		Initrd:     "/ROOT/ubuntu@/boot/initrd.img-4.15.0-13-generic",
+		Kernel:     "/ROOT/ubuntu@/boot/vmlinuz-4.15.0-13-generic",
+		LastBooted: true,
+	}, entries[2])
+	assert.True(t, entries[5].Zsys, "zsys flag should be set")
+}
+
+func TestParseErrors(t *testing.T) {
+	testCases := map[string]struct {
+		content string
+		wantErr string
+	}{
+		"unknown kind":               {content: "id\tyes\tother\tname\tds\tdev\tinitrd\tkernel\n", wantErr: "line 1, column 3 (kind): unknown entry kind"},
+		"missing last booted":        {content: "id\tyes\tadvanced\tname\tds\tdev\tinitrd\tkernel\n", wantErr: "line 1: expected 9 fields for advanced entry, got 8"},
+		"extra field":                {content: "id\tyes\tmain\tname\tds\tdev\tinitrd\tkernel\ttrue\n", wantErr: "line 1: expected 8 fields for main entry, got 9"},
+		"invalid zsys":               {content: "id\tno\tmain\tname\tds\tdev\tinitrd\tkernel\n", wantErr: "line 1, column 2 (zsys)"},
+		"invalid last booted":        {content: "id\tyes\tadvanced\tname\tds\tdev\tinitrd\tkernel\tyes\n", wantErr: "line 1, column 9 (last-booted)"},
+		"empty value on second line": {content: "id\tyes\tmain\tname\tds\tdev\tinitrd\tkernel\nid\tyes\thistory\t\tds\tdev\tinitrd\tkernel\n", wantErr: "line 2, column 4 (name): empty value"},
+		"too few fields":             {content: "id\n", wantErr: "line 1: expected at least 3 fields, got 1"},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			_, err := metamenu.Parse(strings.NewReader(tc.content))
+			if err == nil {
+				t.Fatal("expected an error, got none")
+			}
+			assert.Contains(t, err.Error(), tc.wantErr)
+		})
+	}
+}
+
+// TestRoundTrip ensures that all reference metamenus are valid and serialized back identically.
+func TestRoundTrip(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("..", "..", "testdata", "definitions", "*", "*", "metamenu"))
+	if err != nil {
+		t.Fatal("couldn't list reference metamenus", err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no reference metamenu found")
+	}
+
+	for _, f := range files {
+		f := f
+		t.Run(f, func(t *testing.T) {
+			content, err := ioutil.ReadFile(f)
+			if err != nil {
+				t.Fatal("couldn't read metamenu", err)
+			}
+			entries, err := metamenu.Parse(bytes.NewReader(content))
+			if err != nil {
+				t.Fatal("got error, expected none", err)
+			}
+
+			var out bytes.Buffer
+			if err := metamenu.Write(&out, entries); err != nil {
+				t.Fatal("couldn't write metamenu", err)
+			}
+			assert.Equal(t, string(content), out.String())
+		})
+	}
+}
+
+func TestDiff(t *testing.T) {
+	want, err := metamenu.Parse(strings.NewReader(menu))
+	if err != nil {
+		t.Fatal("couldn't parse metamenu", err)
+	}
+	const m1, m2 = "11111111111111111111111111111111", "22222222222222222222222222222222"
+
+	testCases := map[string]struct {
+		alter func(entries []metamenu.Entry) []metamenu.Entry
+		want  []metamenu.MachineDiff
+	}{
+		"identical": {alter: func(e []metamenu.Entry) []metamenu.Entry { return e }},
+		"history reordered": {
+			alter: func(e []metamenu.Entry) []metamenu.Entry {
+				e[3], e[4] = e[4], e[3]
+				return e
+			},
+			want: []metamenu.MachineDiff{{MachineID: m1, Changes: []string{"history entry snap1 moved from position 2 to 1"}}},
+		},
+		"history removed": {
+			alter: func(e []metamenu.Entry) []metamenu.Entry { return append(e[:3], e[4:]...) },
+			want:  []metamenu.MachineDiff{{MachineID: m1, Changes: []string{"history entry snap2 removed"}}},
+		},
+		"advanced added": {
+			alter: func(e []metamenu.Entry) []metamenu.Entry {
+				added := e[2]
+				added.Kernel = "/ROOT/ubuntu@/boot/vmlinuz-4.0.0-13-generic"
+				added.LastBooted = false
+				return append(e[:3], append([]metamenu.Entry{added}, e[3:]...)...)
+			},
+			want: []metamenu.MachineDiff{{MachineID: m1, Changes: []string{"advanced entry vmlinuz-4.0.0-13-generic added"}}},
+		},
+		"entry changed": {
+			alter: func(e []metamenu.Entry) []metamenu.Entry {
+				e[2].LastBooted = false
+				e[5].Initrd = "/ROOT/ubuntu_2@/boot/initrd.img-4.15.0-13-generic"
+				return e
+			},
+			want: []metamenu.MachineDiff{
+				{MachineID: m1, Changes: []string{`advanced entry vmlinuz-4.15.0-13-generic: last-booted differs: got "false", want "true"`}},
+				{MachineID: m2, Changes: []string{`main entry rpool/ROOT/ubuntu_2: initrd differs: got "/ROOT/ubuntu_2@/boot/initrd.img-4.15.0-13-generic", want "/ROOT/ubuntu_2@/boot/initrd.img-5.0.0-13-generic"`}},
+			},
+		},
+		"machines reordered": {
+			alter: func(e []metamenu.Entry) []metamenu.Entry { return append([]metamenu.Entry{e[5]}, e[:5]...) },
+			want:  []metamenu.MachineDiff{{MachineID: m2, Changes: []string{"machine moved from position 2 to 1"}}},
+		},
+		"machine removed": {
+			alter: func(e []metamenu.Entry) []metamenu.Entry { return e[:5] },
+			want:  []metamenu.MachineDiff{{MachineID: m2, Changes: []string{"machine removed"}}},
+		},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			got := tc.alter(append([]metamenu.Entry(nil), want...))
+			assert.Equal(t, tc.want, metamenu.Diff(got, want))
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package trace
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// maxFileSize is the maximum size of a recorded file content. Test systems only have small files, bigger ones are
+// recorded empty.
+const maxFileSize = 1024 * 1024
+
+// File is a file of a recorded target directory.
+type File struct {
+	Dir     bool   `json:"dir,omitempty"`
+	Link    string `json:"link,omitempty"`
+	Content string `json:"content,omitempty"`
+}
+
+// readFiles returns all files under dir, indexed by their path relative to dir.
+func readFiles(dir string) (map[string]File, error) {
+	files := make(map[string]File)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		switch {
+		case info.IsDir():
+			files[rel] = File{Dir: true}
+		case info.Mode()&os.ModeSymlink != 0:
+			l, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			files[rel] = File{Link: l}
+		case info.Mode().IsRegular():
+			if info.Size() > maxFileSize {
+				// only the file presence is recorded
+				files[rel] = File{}
+				return nil
+			}
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			files[rel] = File{Content: string(b)}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// writeFiles recreates files under dir.
+func writeFiles(dir string, files map[string]File) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for rel, f := range files {
+		p := filepath.Join(dir, rel)
+		if f.Dir {
+			if err := os.MkdirAll(p, 0755); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return err
+		}
+		if f.Link != "" {
+			if err := os.Symlink(f.Link, p); err != nil && !os.IsExist(err) {
+				return err
+			}
+			continue
+		}
+		if err := ioutil.WriteFile(p, []byte(f.Content), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// clearDir removes all content of dir, keeping dir itself. Anything else than a directory is ignored.
+func clearDir(dir string) error {
+	if !isDir(dir) {
+		return nil
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
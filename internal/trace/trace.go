@@ -0,0 +1,350 @@
+// Package trace records every invocation of the mocks in a trace file and can replay them from a recorded trace.
+//
+// Each mock main function is wrapped by Main. When RecordEnv points to a file, one JSON record per invocation is
+// appended to it: arguments, relevant environment, exit code, outputs with their digest and duration.
+// When ReplayEnv points to a recorded trace, mocks don't run at all and answer with the recorded outputs and exit
+// code of the matching invocation. The n-th identical invocation is answered by the n-th matching record, so that
+// commands changing the system state, like zpool import, are replayed in order.
+package trace
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Environment variables driving the mocks.
+const (
+	// RecordEnv is the trace file records are appended to.
+	RecordEnv = "TEST_MOCK_TRACE"
+	// ReplayEnv is the recorded trace mocks answer from.
+	ReplayEnv = "TEST_MOCK_REPLAY"
+)
+
+// poolDirEnv is the per test directory. It is stored as a placeholder in records so that they can be replayed
+// from any directory.
+const poolDirEnv = "TEST_POOL_DIR"
+
+// Record is one invocation of a mock.
+type Record struct {
+	Command      string            `json:"command"`
+	Args         []string          `json:"args"`
+	Env          map[string]string `json:"env,omitempty"`
+	ExitCode     int               `json:"exit_code"`
+	Stdout       string            `json:"stdout,omitempty"`
+	StdoutDigest string            `json:"stdout_sha256"`
+	Stderr       string            `json:"stderr,omitempty"`
+	Duration     time.Duration     `json:"duration_ns"`
+	// Files are the files of the target directory after the command ran, for commands with the WithTargetFiles
+	// option.
+	Files map[string]File `json:"files,omitempty"`
+	// Replayed is set when the invocation was answered from a recorded trace.
+	Replayed bool `json:"replayed,omitempty"`
+}
+
+// Run is the implementation of a mock. args are the command line arguments, including the command name.
+type Run func(args []string, stdin io.Reader, stdout, stderr io.Writer) int
+
+// Option changes how an invocation is recorded and replayed.
+type Option func(*options)
+
+type options struct {
+	targetFiles bool
+	clearTarget bool
+}
+
+// WithTargetFiles records the content of the target directory, the last argument, after the command ran.
+// The content is recreated on replay. This is used by mount.
+func WithTargetFiles() Option {
+	return func(o *options) {
+		o.targetFiles = true
+	}
+}
+
+// WithClearedTarget empties the target directory, the last argument, on successful replay. This is used by umount.
+func WithClearedTarget() Option {
+	return func(o *options) {
+		o.clearTarget = true
+	}
+}
+
+// Main runs the mock named name with run, recording or replaying it depending on the environment, and exits.
+func Main(name string, run Run, opts ...Option) {
+	os.Exit(Execute(name, os.Args, os.Stdin, os.Stdout, os.Stderr, run, opts...))
+}
+
+// Execute runs the mock named name with run, recording or replaying it depending on the environment.
+// It returns the exit code of the mock.
+func Execute(name string, args []string, stdin io.Reader, stdout, stderr io.Writer, run Run, opts ...Option) int {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if replay := os.Getenv(ReplayEnv); replay != "" {
+		return doReplay(name, args, stdout, stderr, replay, o)
+	}
+
+	traceFile := os.Getenv(RecordEnv)
+	if traceFile == "" {
+		return run(args, stdin, stdout, stderr)
+	}
+
+	// stdin is passed as is: commands like awk can share it with the calling script loops
+	var outBuf, errBuf bytes.Buffer
+	start := time.Now()
+	ret := run(args, stdin, io.MultiWriter(stdout, &outBuf), io.MultiWriter(stderr, &errBuf))
+
+	r := newRecord(name, args, ret, outBuf.String(), errBuf.String())
+	r.Duration = time.Since(start)
+	if target := args[len(args)-1]; o.targetFiles && ret == 0 && len(args) > 1 && isDir(target) {
+		files, err := readFiles(target)
+		if err != nil {
+			fmt.Fprintf(stderr, "couldn't record target files: %v\n", err)
+			return 2
+		}
+		r.Files = files
+	}
+
+	if err := appendRecord(traceFile, r, nil); err != nil {
+		fmt.Fprintf(stderr, "couldn't record %s invocation: %v\n", name, err)
+		return 2
+	}
+	return ret
+}
+
+// doReplay answers from the recorded trace at path.
+func doReplay(name string, args []string, stdout, stderr io.Writer, path string, o options) int {
+	start := time.Now()
+	records, err := Load(path)
+	if err != nil {
+		fmt.Fprintf(stderr, "couldn't load recorded trace: %v\n", err)
+		return 2
+	}
+
+	r := newRecord(name, args, 0, "", "")
+	r.Replayed = true
+	k := r.key()
+
+	var matching []Record
+	for _, rec := range records {
+		if rec.key() == k {
+			matching = append(matching, rec)
+		}
+	}
+
+	// the n-th identical invocation is answered by the n-th matching record, or the last one if there are less
+	var answer *Record
+	pick := func(previous []Record) {
+		if len(matching) == 0 {
+			return
+		}
+		var n int
+		for _, p := range previous {
+			if p.key() == k {
+				n++
+			}
+		}
+		if n >= len(matching) {
+			n = len(matching) - 1
+		}
+		answer = &matching[n]
+	}
+
+	if traceFile := os.Getenv(RecordEnv); traceFile != "" {
+		// the pick and record of this invocation are atomic for concurrent invocations to be answered in order
+		err = appendRecord(traceFile, r, func(previous []Record) *Record {
+			pick(previous)
+			if answer != nil {
+				r.ExitCode, r.Stdout, r.StdoutDigest, r.Stderr = answer.ExitCode, answer.Stdout, answer.StdoutDigest, answer.Stderr
+				r.Files = answer.Files
+			} else {
+				r.ExitCode = 2
+			}
+			r.Duration = time.Since(start)
+			return &r
+		})
+		if err != nil {
+			fmt.Fprintf(stderr, "couldn't record %s invocation: %v\n", name, err)
+			return 2
+		}
+	} else {
+		pick(nil)
+	}
+
+	if answer == nil {
+		fmt.Fprintf(stderr, "no recorded invocation for %s\n", strings.Join(append([]string{name}, args[1:]...), " "))
+		return 2
+	}
+
+	dir := os.Getenv(poolDirEnv)
+	if answer.ExitCode == 0 && len(args) > 1 {
+		target := args[len(args)-1]
+		if o.targetFiles && answer.Files != nil {
+			if err := writeFiles(target, answer.Files); err != nil {
+				fmt.Fprintf(stderr, "couldn't replay target files: %v\n", err)
+				return 2
+			}
+		}
+		if o.clearTarget {
+			if err := clearDir(target); err != nil {
+				fmt.Fprintf(stderr, "couldn't replay target removal: %v\n", err)
+				return 2
+			}
+		}
+	}
+	if _, err := io.WriteString(stdout, expand(answer.Stdout, dir)); err != nil {
+		return 2
+	}
+	if _, err := io.WriteString(stderr, expand(answer.Stderr, dir)); err != nil {
+		return 2
+	}
+	return answer.ExitCode
+}
+
+// newRecord returns the record of an invocation, with paths relative to the test directory anonymized.
+func newRecord(name string, args []string, ret int, stdout, stderr string) Record {
+	dir := os.Getenv(poolDirEnv)
+	r := Record{
+		Command:      name,
+		ExitCode:     ret,
+		Stdout:       anonymize(stdout, dir),
+		StdoutDigest: digest([]byte(stdout)),
+		Stderr:       anonymize(stderr, dir),
+		Env:          make(map[string]string),
+	}
+	for _, a := range args[1:] {
+		r.Args = append(r.Args, anonymize(a, dir))
+	}
+	if r.Args == nil {
+		r.Args = []string{}
+	}
+	for _, e := range os.Environ() {
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) != 2 || !isTracedEnv(kv[0]) {
+			continue
+		}
+		r.Env[kv[0]] = anonymize(kv[1], dir)
+	}
+	return r
+}
+
+// isTracedEnv returns if the environment variable can change a mock behavior.
+func isTracedEnv(name string) bool {
+	if name == RecordEnv || name == ReplayEnv {
+		return false
+	}
+	switch name {
+	case "LC_ALL", "LANG", "TZ":
+		return true
+	}
+	return strings.HasPrefix(name, "TEST_") || strings.HasPrefix(name, "GRUB_LINUX_ZFS_TEST")
+}
+
+// tempDirRe matches temporary directories, like the ones created by mktemp, whose name change on each run.
+var tempDirRe = regexp.MustCompile(regexp.QuoteMeta(os.TempDir()) + `/[^/\s'"]+`)
+
+// key identifies identical invocations, independently of the temporary directories they target.
+func (r Record) key() string {
+	var b strings.Builder
+	b.WriteString(r.Command)
+	for _, a := range r.Args {
+		b.WriteString("\x00")
+		b.WriteString(tempDirRe.ReplaceAllString(a, os.TempDir()+"/*"))
+	}
+	return b.String()
+}
+
+// String returns the command line of the invocation.
+func (r Record) String() string {
+	return strings.Join(append([]string{r.Command}, r.Args...), " ")
+}
+
+// Load reads all records of a trace file.
+func Load(path string) ([]Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return decode(f)
+}
+
+func decode(r io.Reader) ([]Record, error) {
+	var records []Record
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	line := 0
+	for s.Scan() {
+		line++
+		if len(bytes.TrimSpace(s.Bytes())) == 0 {
+			continue
+		}
+		var rec Record
+		if err := json.Unmarshal(s.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("line %d: invalid record: %v", line, err)
+		}
+		records = append(records, rec)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// appendRecord appends r to the trace file at path, locked for concurrent mocks.
+// If build is not nil, it is called with the existing records while the file is locked and returns the record
+// to append instead of r.
+func appendRecord(path string, r Record, build func(previous []Record) *Record) error {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("couldn't lock trace file: %v", err)
+	}
+	defer syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+
+	if build != nil {
+		previous, err := decode(f)
+		if err != nil {
+			return err
+		}
+		r = *build(previous)
+	}
+
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(b, '\n'))
+	return err
+}
+
+// anonymize replaces the test directory by a placeholder.
+func anonymize(s, dir string) string {
+	if dir == "" {
+		return s
+	}
+	return strings.Replace(s, dir, "${"+poolDirEnv+"}", -1)
+}
+
+// expand replaces the test directory placeholder by dir.
+func expand(s, dir string) string {
+	return strings.Replace(s, "${"+poolDirEnv+"}", dir, -1)
+}
+
+func digest(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
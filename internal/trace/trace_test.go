@@ -0,0 +1,217 @@
+package trace_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ubuntu/grubmenugen-zfs-tests/internal/trace"
+)
+
+func TestRecord(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	traceFile := filepath.Join(dir, "trace")
+	defer setEnv(t, map[string]string{
+		trace.RecordEnv:  traceFile,
+		trace.ReplayEnv:  "",
+		"TEST_POOL_DIR":  dir,
+		"TEST_SOMETHING": "value",
+	})()
+
+	var stdout, stderr bytes.Buffer
+	ret := trace.Execute("zpool", []string{"zpool", "import", "-d", dir}, nil, &stdout, &stderr,
+		func(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+			fmt.Fprintf(stdout, "imported from %s\n", args[3])
+			fmt.Fprint(stderr, "warning")
+			return 3
+		})
+
+	assert.Equal(t, 3, ret)
+	assert.Equal(t, fmt.Sprintf("imported from %s\n", dir), stdout.String(), "output is passed through")
+	assert.Equal(t, "warning", stderr.String(), "error output is passed through")
+
+	records, err := trace.Load(traceFile)
+	if err != nil {
+		t.Fatal("couldn't load trace", err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("expected 1 record, got %d", len(records))
+	}
+	r := records[0]
+	assert.Equal(t, "zpool import -d ${TEST_POOL_DIR}", r.String())
+	assert.Equal(t, 3, r.ExitCode)
+	assert.Equal(t, "imported from ${TEST_POOL_DIR}\n", r.Stdout)
+	assert.Len(t, r.StdoutDigest, 64)
+	assert.Equal(t, "warning", r.Stderr)
+	assert.Equal(t, "value", r.Env["TEST_SOMETHING"])
+	assert.Equal(t, "${TEST_POOL_DIR}", r.Env["TEST_POOL_DIR"])
+	assert.NotContains(t, r.Env, trace.RecordEnv)
+	assert.False(t, r.Replayed)
+}
+
+func TestReplay(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	recorded := filepath.Join(dir, "recorded")
+	replayDir := filepath.Join(dir, "replay")
+
+	// each call to zpool list returns one more pool
+	var pools []string
+	zpool := func(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+		if args[1] == "import" {
+			pools = append(pools, args[2])
+			return 0
+		}
+		fmt.Fprintln(stdout, strings.Join(pools, ",")+" "+os.Getenv("TEST_POOL_DIR"))
+		return 0
+	}
+	restore := setEnv(t, map[string]string{trace.RecordEnv: recorded, trace.ReplayEnv: "", "TEST_POOL_DIR": dir})
+	for _, args := range [][]string{{"zpool", "list"}, {"zpool", "import", "rpool"}, {"zpool", "list"},
+		{"zpool", "import", "bpool"}, {"zpool", "list"}} {
+		trace.Execute("zpool", args, nil, ioutil.Discard, ioutil.Discard, zpool)
+	}
+	restore()
+
+	defer setEnv(t, map[string]string{
+		trace.RecordEnv: filepath.Join(dir, "replayed"),
+		trace.ReplayEnv: recorded,
+		"TEST_POOL_DIR": replayDir,
+	})()
+	failingRun := func(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+		t.Error("mock shouldn't run in replay mode")
+		return 1
+	}
+
+	var outputs []string
+	for i := 0; i < 4; i++ {
+		var out bytes.Buffer
+		ret := trace.Execute("zpool", []string{"zpool", "list"}, nil, &out, ioutil.Discard, failingRun)
+		assert.Equal(t, 0, ret)
+		outputs = append(outputs, out.String())
+	}
+	assert.Equal(t, []string{
+		" " + replayDir + "\n",
+		"rpool " + replayDir + "\n",
+		"rpool,bpool " + replayDir + "\n",
+		// the last answer is repeated once all recorded invocations are replayed
+		"rpool,bpool " + replayDir + "\n",
+	}, outputs)
+
+	var stderr bytes.Buffer
+	ret := trace.Execute("zpool", []string{"zpool", "export", "rpool"}, nil, ioutil.Discard, &stderr, failingRun)
+	assert.Equal(t, 2, ret, "unknown invocation fails")
+	assert.Equal(t, "no recorded invocation for zpool export rpool\n", stderr.String())
+
+	records, err := trace.Load(filepath.Join(dir, "replayed"))
+	if err != nil {
+		t.Fatal("couldn't load trace", err)
+	}
+	assert.Len(t, records, 5)
+	for _, r := range records {
+		assert.True(t, r.Replayed, "%s: should be marked as replayed", r)
+	}
+}
+
+func TestReplayTargetFiles(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	recorded := filepath.Join(dir, "recorded")
+
+	mount := func(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+		target := args[len(args)-1]
+		if err := os.MkdirAll(filepath.Join(target, "etc"), 0755); err != nil {
+			t.Fatal("couldn't create directory", err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(target, "etc", "machine-id"), []byte("1111\n"), 0644); err != nil {
+			t.Fatal("couldn't create file", err)
+		}
+		return 0
+	}
+
+	// mount target are temporary directories, whose name changes on each run
+	recordTarget, err := ioutil.TempDir("", "zfsmnt.")
+	if err != nil {
+		t.Fatal("couldn't create mount target", err)
+	}
+	defer os.RemoveAll(recordTarget)
+	restore := setEnv(t, map[string]string{trace.RecordEnv: recorded, trace.ReplayEnv: ""})
+	trace.Execute("mount", []string{"mount", "rpool/ROOT/ubuntu", recordTarget}, nil, ioutil.Discard, ioutil.Discard,
+		mount, trace.WithTargetFiles())
+	restore()
+
+	replayTarget, err := ioutil.TempDir("", "zfsmnt.")
+	if err != nil {
+		t.Fatal("couldn't create mount target", err)
+	}
+	defer os.RemoveAll(replayTarget)
+	defer setEnv(t, map[string]string{trace.RecordEnv: "", trace.ReplayEnv: recorded})()
+	ret := trace.Execute("mount", []string{"mount", "rpool/ROOT/ubuntu", replayTarget}, nil, ioutil.Discard, ioutil.Discard,
+		nil, trace.WithTargetFiles())
+	assert.Equal(t, 0, ret)
+
+	b, err := ioutil.ReadFile(filepath.Join(replayTarget, "etc", "machine-id"))
+	if err != nil {
+		t.Fatal("replayed mount didn't create target files", err)
+	}
+	assert.Equal(t, "1111\n", string(b))
+}
+
+func TestReplayMissingTrace(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	defer setEnv(t, map[string]string{trace.RecordEnv: "", trace.ReplayEnv: filepath.Join(dir, "doesnotexist")})()
+
+	var stderr bytes.Buffer
+	ret := trace.Execute("date", []string{"date"}, nil, ioutil.Discard, &stderr, nil)
+	assert.Equal(t, 2, ret)
+	assert.Contains(t, stderr.String(), "couldn't load recorded trace")
+}
+
+func tempDir(t *testing.T) (string, func()) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "trace-")
+	if err != nil {
+		t.Fatal("couldn't create temporary directory", err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+// setEnv sets environment variables, unsetting empty ones, and returns a function restoring previous values.
+func setEnv(t *testing.T, env map[string]string) func() {
+	t.Helper()
+
+	previous := make(map[string]*string)
+	for k, v := range env {
+		if old, ok := os.LookupEnv(k); ok {
+			previous[k] = &old
+		} else {
+			previous[k] = nil
+		}
+		var err error
+		if v == "" {
+			err = os.Unsetenv(k)
+		} else {
+			err = os.Setenv(k, v)
+		}
+		if err != nil {
+			t.Fatalf("couldn't set %s: %v", k, err)
+		}
+	}
+	return func() {
+		for k, v := range previous {
+			if v == nil {
+				os.Unsetenv(k)
+				continue
+			}
+			os.Setenv(k, *v)
+		}
+	}
+}
@@ -2,7 +2,6 @@ package main_test
 
 import (
 	"flag"
-	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
@@ -10,13 +9,15 @@ import (
 	"path/filepath"
 	"testing"
 	"time"
+
+	"github.com/ubuntu/grubmenugen-zfs-tests/internal/faults"
+	"github.com/ubuntu/grubmenugen-zfs-tests/internal/grubprobe"
+	"github.com/ubuntu/grubmenugen-zfs-tests/internal/trace"
 )
 
 var (
-	dangerous = flag.Bool("dangerous", false, "execute dangerous tests which may alter the system state")
-	update    = flag.Bool("update", false, "update golden files")
-	slow      = flag.Bool("slow", false, "sleep between tests interacting with zfs kernel module to avoid spamming it")
-	awk       = flag.String("awk", "", "select a different awk binary (default to system one)")
+	update = flag.Bool("update", false, "update golden files")
+	slow   = flag.Bool("slow", false, "sleep between tests interacting with zfs kernel module to avoid spamming it")
 
 	// Test data and mock dir are generally <current test dir>/{testdata;mocks}. However, when we ship a binary
 	// test package, cwd can be != binary dir and the binary (contrary to `go test`) doesn't cd you into the current
@@ -62,54 +63,39 @@ func init() {
 	if !found {
 		log.Fatalf("no mocks source and binary directories found (cmd/ or mocks/)")
 	}
-
-	// Set global variable for awk implementation
-	fmt.Println(*awk)
-	if err := os.Setenv("TEST_AWK_BIN", *awk); err != nil {
-		log.Fatalf("couldn't set mock awk environment variable")
-	}
 }
 
 func TestBootlist(t *testing.T) {
 	t.Parallel()
 	defer registerTest(t)()
-	skipOnZFSPermissionDenied(t)
+	if *kernelZFS {
+		skipOnZFSPermissionDenied(t)
+	}
 
 	ensureBinaryMocks(t)
 
-	testCases := newTestCases(t)
+	testCases := withAwks(t, newTestCases(t))
 	for name, tc := range testCases {
 		tc := tc
-		name := name
 		t.Run(name, func(t *testing.T) {
-			secureBootState := filepath.Base(filepath.Dir(tc.path))
-			if secureBootState == "no-mokutil" {
-				if !*dangerous {
-					t.Skipf("don't run %q: dangerous is not set", name)
-				}
-
-				// remove mokutil from PATH
-				if _, err := os.Stat("/usr/bin/mokutil"); os.IsExist(err) {
-					if err := os.Rename("/usr/bin/mokutil", "/usr/bin/mokutil.bak"); err != nil {
-						t.Fatal("couldn't rename mokutil to its backup", err)
-					}
-					defer os.Rename("/usr/bin/mokutil.bak", "/usr/bin/mokutil")
-				}
-			}
+			devices := newFakeDevices(t, filepath.Join(tc.path, "testcase.yaml"))
+			secureBootState := devices.Mokutil.secureBootState(t)
 
 			testDir, cleanUp := tempDir(t)
 			defer cleanUp()
 
-			devices := newFakeDevices(t, filepath.Join(tc.path, "testcase.yaml"))
 			systemRootDataset := devices.create(testDir)
 
 			out := filepath.Join(testDir, "bootlist")
-			path := fmt.Sprintf("PATH=%s/zpool:%s/zfs:%s/date:%s/awk:%s", mockDir, mockDir, mockDir, mockDir, os.Getenv("PATH"))
-			var securebootEnv string
-			if secureBootState != "no-mokutil" {
-				path = fmt.Sprintf("PATH=%s/mokutil:%s/zpool:%s/zfs:%s/date:%s/awk:%s", mockDir, mockDir, mockDir, mockDir, mockDir, os.Getenv("PATH"))
-				securebootEnv = "TEST_MOKUTIL_SECUREBOOT=" + secureBootState
+			mocks := []string{"zpool", "zfs", "date", "grub-probe", "awk"}
+			// mokutil isn't reachable at all on systems without it
+			var hidden []string
+			if secureBootState == noMokutil {
+				hidden = append(hidden, "mokutil")
+			} else {
+				mocks = append([]string{"mokutil"}, mocks...)
 			}
+			path := hermeticPath(t, hostBinDir(testDir), append(mocks, devices.backend.mocks()...), hidden...)
 
 			var mockZFSDatasetEnv string
 			if systemRootDataset != "" {
@@ -118,25 +104,38 @@ func TestBootlist(t *testing.T) {
 
 			env := append(os.Environ(),
 				path,
+				tc.awkEnv(),
 				"LC_ALL=C",
 				"TEST_POOL_DIR="+testDir,
 				"GRUB_LINUX_ZFS_TEST=bootlist",
 				"GRUB_LINUX_ZFS_TEST_OUTPUT="+out,
-				securebootEnv,
+				grubprobe.DevicesEnv+"="+grubProbeDevicesFile(testDir),
+				devices.clockEnv(),
+				faults.Env+"="+faultsFile(testDir),
 				mockZFSDatasetEnv)
+			env = append(env, devices.Mokutil.env(secureBootState)...)
+			env = append(env, devices.backend.env()...)
+
+			output, err := runGrubMkConfig(t, env, testDir)
+			devices.assertFaultsFired(output.trace)
+			devices.Expect.assertTrace(t, output.trace)
+			if devices.Expect.assertRun(t, output, err) {
+				reference := filepath.Join(tc.path, "bootlist")
+				if *update && hasReference(reference, devices.Expect) {
+					if err := ioutil.WriteFile(reference, []byte(anonymizeTempDirNames(t, out)), 0644); err != nil {
+						t.Fatal("couldn't update reference file", err)
+					}
+				}
+				if *review {
+					writeCandidate(t, out, reference)
+				}
 
-			if err := runGrubMkConfig(t, env, testDir); err != nil {
-				t.Fatal("got error, expected none", err)
-			}
-
-			reference := filepath.Join(tc.path, "bootlist")
-			if *update {
-				if err := ioutil.WriteFile(reference, []byte(anonymizeTempDirNames(t, out)), 0644); err != nil {
-					t.Fatal("couldn't update reference file", err)
+				if hasReference(reference, devices.Expect) {
+					assertBootlistEquals(t, out, reference)
 				}
+				devices.Expect.assertBootlist(t, out)
+				tc.assertSameAwkOutputs(t, out)
 			}
-
-			assertFileContentAlmostEquals(t, out, reference, "generated and reference files are different.")
 			devices.assertExistingPoolsAndCleanup()
 
 			if *slow {
@@ -151,7 +150,9 @@ func TestMetaMenu(t *testing.T) {
 	defer registerTest(t)()
 	waitForTest(t, "TestBootlist")
 
-	testCases := newTestCases(t)
+	ensureBinaryMocks(t)
+
+	testCases := withAwks(t, withEnvironments(t, newTestCases(t)))
 	for name, tc := range testCases {
 		tc := tc
 		t.Run(name, func(t *testing.T) {
@@ -161,26 +162,37 @@ func TestMetaMenu(t *testing.T) {
 			if !(*update) {
 				t.Parallel()
 			}
+			input := filepath.Join(tc.path, "bootlist")
+			if _, err := os.Stat(input); os.IsNotExist(err) {
+				t.Skip("no reference bootlist to use as input: test case only declares expectations")
+			}
+
 			testDir, cleanUp := tempDir(t)
 			defer cleanUp()
 
-			path := fmt.Sprintf("PATH=%s/awk:%s", mockDir, os.Getenv("PATH"))
+			devices := newFakeDevices(t, filepath.Join(tc.path, "testcase.yaml"))
+			path := hermeticPath(t, hostBinDir(testDir), []string{"date", "awk"})
 			out := getTempOrReferenceFile(t, *update,
 				filepath.Join(testDir, "metamenu"),
-				filepath.Join(tc.path, "metamenu"))
+				tc.reference("metamenu"))
 			env := append(os.Environ(),
 				path,
-				"LC_ALL=C",
-				"TZ=Europe/Paris", // we want to ensure user's timezone is taken into account
+				tc.awkEnv(),
+				devices.clockEnv(),
 				"GRUB_LINUX_ZFS_TEST=metamenu",
-				"GRUB_LINUX_ZFS_TEST_INPUT="+filepath.Join(tc.path, "bootlist"),
+				"GRUB_LINUX_ZFS_TEST_INPUT="+input,
 				"GRUB_LINUX_ZFS_TEST_OUTPUT="+out)
+			env = append(env, tc.env.vars()...)
 
-			if err := runGrubMkConfig(t, env, testDir); err != nil {
+			if _, err := runGrubMkConfig(t, env, testDir); err != nil {
 				t.Fatal("got error, expected none", err)
 			}
+			if *review {
+				writeCandidate(t, out, tc.reference("metamenu"))
+			}
 
-			assertFileContentAlmostEquals(t, out, filepath.Join(tc.path, "metamenu"), "generated and reference files are different.")
+			tc.assertEquals(t, out, "metamenu", assertMetaMenuEquals)
+			tc.assertSameAwkOutputs(t, out)
 		})
 	}
 }
@@ -192,7 +204,7 @@ func TestGrubMenu(t *testing.T) {
 
 	ensureBinaryMocks(t)
 
-	testCases := newTestCases(t)
+	testCases := withAwks(t, newTestCases(t))
 	for name, tc := range testCases {
 		tc := tc
 		t.Run(name, func(t *testing.T) {
@@ -202,30 +214,40 @@ func TestGrubMenu(t *testing.T) {
 			if !(*update) {
 				t.Parallel()
 			}
+			input := filepath.Join(tc.path, "metamenu")
+			if _, err := os.Stat(input); os.IsNotExist(err) {
+				t.Skip("no reference metamenu to use as input: test case only declares expectations")
+			}
+
 			testDir, cleanUp := tempDir(t)
 			defer cleanUp()
 
 			out := getTempOrReferenceFile(t, *update,
 				filepath.Join(testDir, "grubmenu"),
 				filepath.Join(tc.path, "grubmenu"))
-			path := fmt.Sprintf("PATH=%s/grub-probe:%s/awk:%s", mockDir, mockDir, os.Getenv("PATH"))
+			path := hermeticPath(t, hostBinDir(testDir), []string{"grub-probe", "awk"})
 			grubProbeDir, err := filepath.Abs(filepath.Join(mockDir, "grub-probe"))
 			if err != nil {
 				t.Fatal("couldn't get absolute path for mock directory", err)
 			}
 			env := append(os.Environ(),
 				path,
+				tc.awkEnv(),
 				"grub_probe="+grubProbeDir,
 				"LC_ALL=C",
 				"GRUB_LINUX_ZFS_TEST=grubmenu",
-				"GRUB_LINUX_ZFS_TEST_INPUT="+filepath.Join(tc.path, "metamenu"),
+				"GRUB_LINUX_ZFS_TEST_INPUT="+input,
 				"GRUB_LINUX_ZFS_TEST_OUTPUT="+out)
 
-			if err := runGrubMkConfig(t, env, testDir); err != nil {
+			if _, err := runGrubMkConfig(t, env, testDir); err != nil {
 				t.Fatal("got error, expected none", err)
 			}
+			if *review {
+				writeCandidate(t, out, filepath.Join(tc.path, "grubmenu"))
+			}
 
-			assertFileContentAlmostEquals(t, out, filepath.Join(tc.path, "grubmenu"), "generated and reference files are different.")
+			assertGrubMenuEquals(t, out, filepath.Join(tc.path, "grubmenu"))
+			tc.assertSameAwkOutputs(t, out)
 		})
 	}
 }
@@ -234,43 +256,35 @@ func TestGrubMenu(t *testing.T) {
 func TestGrubMkConfig(t *testing.T) {
 	t.Parallel()
 	defer registerTest(t)()
-	skipOnZFSPermissionDenied(t)
+	if *kernelZFS {
+		skipOnZFSPermissionDenied(t)
+	}
 	waitForTest(t, "TestBootlist")
 	waitForTest(t, "TestGrubMenu")
 
 	ensureBinaryMocks(t)
 
-	testCases := newTestCases(t)
+	testCases := withAwks(t, withEnvironments(t, newTestCases(t)))
 	for name, tc := range testCases {
 		tc := tc
 		t.Run(name, func(t *testing.T) {
-			secureBootState := filepath.Base(filepath.Dir(tc.path))
-			if secureBootState == "no-mokutil" {
-				if !*dangerous {
-					t.Skipf("don't run %q: dangerous is not set", name)
-				}
-
-				// remove mokutil from PATH
-				if _, err := os.Stat("/usr/bin/mokutil"); os.IsExist(err) {
-					if err := os.Rename("/usr/bin/mokutil", "/usr/bin/mokutil.bak"); err != nil {
-						t.Fatal("couldn't rename mokutil to its backup", err)
-					}
-					defer os.Rename("/usr/bin/mokutil.bak", "/usr/bin/mokutil")
-				}
-			}
+			devices := newFakeDevices(t, filepath.Join(tc.path, "testcase.yaml"))
+			secureBootState := devices.Mokutil.secureBootState(t)
 
 			testDir, cleanUp := tempDir(t)
 			defer cleanUp()
 
-			devices := newFakeDevices(t, filepath.Join(tc.path, "testcase.yaml"))
 			systemRootDataset := devices.create(testDir)
 
-			path := fmt.Sprintf("PATH=%s/zpool:%s/zfs:%s/date:%s/grub-probe:%s/awk:%s", mockDir, mockDir, mockDir, mockDir, mockDir, os.Getenv("PATH"))
-			var securebootEnv string
-			if secureBootState != "no-mokutil" {
-				path = fmt.Sprintf("PATH=%s/mokutil:%s/zpool:%s/zfs:%s/date:%s/grub-probe:%s/awk:%s", mockDir, mockDir, mockDir, mockDir, mockDir, mockDir, os.Getenv("PATH"))
-				securebootEnv = "TEST_MOKUTIL_SECUREBOOT=" + secureBootState
+			mocks := []string{"zpool", "zfs", "date", "grub-probe", "awk"}
+			// mokutil isn't reachable at all on systems without it
+			var hidden []string
+			if secureBootState == noMokutil {
+				hidden = append(hidden, "mokutil")
+			} else {
+				mocks = append([]string{"mokutil"}, mocks...)
 			}
+			path := hermeticPath(t, hostBinDir(testDir), append(mocks, devices.backend.mocks()...), hidden...)
 
 			var mockZFSDatasetEnv string
 			if systemRootDataset != "" {
@@ -283,21 +297,60 @@ func TestGrubMkConfig(t *testing.T) {
 			}
 			env := append(os.Environ(),
 				path,
-				"LC_ALL=C",
-				"TZ=Europe/Paris", // we want to ensure user's timezone is taken into account
+				tc.awkEnv(),
 				"grub_probe="+filepath.Join(cwd, "mock/grub-probe"),
 				"TEST_POOL_DIR="+testDir,
-				securebootEnv,
+				grubprobe.DevicesEnv+"="+grubProbeDevicesFile(testDir),
+				devices.clockEnv(),
+				faults.Env+"="+faultsFile(testDir),
 				mockZFSDatasetEnv)
-
-			if err := runGrubMkConfig(t, env, testDir); err != nil {
-				t.Fatal("got error, expected none", err)
+			env = append(env, tc.env.vars()...)
+			env = append(env, devices.Mokutil.env(secureBootState)...)
+			env = append(env, devices.backend.env()...)
+
+			output, err := runGrubMkConfig(t, env, testDir)
+			devices.assertFaultsFired(output.trace)
+			devices.Expect.assertTrace(t, output.trace)
+			if devices.Expect.assertRun(t, output, err) {
+				fileteredFPath := filepath.Join(testDir, "grub_10_linux_zfs")
+				filterNonLinuxZfsContent(t, filepath.Join(testDir, "grub.cfg"), fileteredFPath)
+
+				// Reference grub menus of the default environment are updated by TestGrubMenu
+				if tc.env != defaultEnvironment {
+					if *update && hasReference(tc.reference("grubmenu"), devices.Expect) {
+						if err := ioutil.WriteFile(tc.reference("grubmenu"), []byte(anonymizeTempDirNames(t, fileteredFPath)), 0644); err != nil {
+							t.Fatal("couldn't update reference file", err)
+						}
+					}
+					if *review {
+						writeCandidate(t, fileteredFPath, tc.reference("grubmenu"))
+					}
+				}
+				if hasReference(filepath.Join(tc.path, "grubmenu"), devices.Expect) {
+					tc.assertEquals(t, fileteredFPath, "grubmenu", assertGrubMenuEquals)
+				}
+				devices.Expect.assertGrubMenu(t, fileteredFPath)
+				tc.assertSameAwkOutputs(t, fileteredFPath)
 			}
 
-			fileteredFPath := filepath.Join(testDir, "grub_10_linux_zfs")
-			filterNonLinuxZfsContent(t, filepath.Join(testDir, "grub.cfg"), fileteredFPath)
-
-			assertFileContentAlmostEquals(t, fileteredFPath, filepath.Join(tc.path, "grubmenu"), "generated and reference files are different.")
+			// External commands don't depend on the environment: all environments share the default one reference
+			// file. -update and -review write it like other reference files, but it is only compared once it exists.
+			reference := filepath.Join(tc.path, "commands")
+			commands := filepath.Join(testDir, "commands")
+			writeCommands(t, output.trace, testDir, commands)
+			if tc.env == defaultEnvironment && hasReference(reference, devices.Expect) {
+				if *update {
+					if err := ioutil.WriteFile(reference, []byte(anonymizeTempDirNames(t, commands)), 0644); err != nil {
+						t.Fatal("couldn't update reference file", err)
+					}
+				}
+				if *review {
+					writeCandidate(t, commands, reference)
+				}
+			}
+			if _, err := os.Stat(reference); err == nil {
+				assertCommandsEquals(t, commands, reference)
+			}
 			devices.assertExistingPoolsAndCleanup()
 
 			if *slow {
@@ -307,8 +360,77 @@ func TestGrubMkConfig(t *testing.T) {
 	}
 }
 
+// TestReplayTraces generates the grub menu of a test case, then generates it again once its pools are destroyed,
+// with all mock invocations answered from the recorded trace, and checks that both menus are identical.
+func TestReplayTraces(t *testing.T) {
+	t.Parallel()
+	defer registerTest(t)()
+	if *kernelZFS {
+		skipOnZFSPermissionDenied(t)
+	}
+	if *replayTraces != "" {
+		t.Skip("mock invocations are already answered from saved traces")
+	}
+	waitForTest(t, "TestGrubMkConfig")
+
+	ensureBinaryMocks(t)
+
+	tc := TestCase{
+		path: filepath.Join(testDataDir, "definitions", "efi-nosb", "snapshot-one"),
+		env:  defaultEnvironment,
+	}
+	devices := newFakeDevices(t, filepath.Join(tc.path, "testcase.yaml"))
+	secureBootState := devices.Mokutil.secureBootState(t)
+
+	recordDir, cleanUpRecord := tempDir(t)
+	defer cleanUpRecord()
+	replayDir, cleanUpReplay := tempDir(t)
+	defer cleanUpReplay()
+
+	// generate runs grub-mkconfig in testDir and returns the path of the generated 10_linux_zfs menu and of the
+	// trace of the mocks
+	generate := func(testDir string, env ...string) (string, string) {
+		t.Helper()
+
+		mocks := append([]string{"mokutil", "zpool", "zfs", "date", "grub-probe", "awk"}, devices.backend.mocks()...)
+		env = append(append(os.Environ(),
+			hermeticPath(t, hostBinDir(testDir), mocks),
+			tc.awkEnv(),
+			"TEST_POOL_DIR="+testDir,
+			grubprobe.DevicesEnv+"="+grubProbeDevicesFile(testDir),
+			devices.clockEnv()), env...)
+		env = append(env, tc.env.vars()...)
+		env = append(env, devices.Mokutil.env(secureBootState)...)
+
+		output, err := runGrubMkConfig(t, env, testDir)
+		if err != nil {
+			t.Fatal("got error, expected none", err)
+		}
+		menu := filepath.Join(testDir, "grub_10_linux_zfs")
+		filterNonLinuxZfsContent(t, filepath.Join(testDir, "grub.cfg"), menu)
+		return menu, output.trace
+	}
+
+	systemRootDataset := devices.create(recordDir)
+	var mockZFSDatasetEnv string
+	if systemRootDataset != "" {
+		mockZFSDatasetEnv = "TEST_MOCKZFS_CURRENT_ROOT_DATASET=" + systemRootDataset
+	}
+	recorded, recordedTrace := generate(recordDir, append(devices.backend.env(), mockZFSDatasetEnv)...)
+	devices.assertExistingPoolsAndCleanup()
+
+	// the pools don't exist anymore: mocks can only answer from the trace
+	replayed, _ := generate(replayDir, trace.ReplayEnv+"="+recordedTrace)
+
+	assertGrubMenuEquals(t, replayed, recorded)
+}
+
 type TestCase struct {
 	path string
+	// env is the timezone and locale the test case runs in.
+	env environment
+	// awk is the awk implementation the test case runs with.
+	awk string
 }
 
 func newTestCases(t *testing.T) map[string]TestCase {
@@ -334,6 +456,7 @@ func newTestCases(t *testing.T) map[string]TestCase {
 
 			testCases[tcName] = TestCase{
 				path: tcPath,
+				env:  defaultEnvironment,
 			}
 		}
 	}
@@ -362,5 +485,19 @@ func TestMain(m *testing.M) {
 	if ok {
 		*linuxZFS = linuxZFSOverride
 	}
-	os.Exit(m.Run())
+	if *accept != "" || *reject != "" {
+		os.Exit(runReview())
+	}
+	if *update && *review {
+		log.Fatal("-update and -review can't be used together")
+	}
+	if *update && len(awkImplementations()) > 1 {
+		log.Fatal("-update can't be used with multiple awk implementations")
+	}
+
+	r := m.Run()
+	if *review {
+		printReviewSummary()
+	}
+	os.Exit(r)
 }
@@ -0,0 +1,243 @@
+package main_test
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	timezones = flag.String("timezones", "", "comma separated timezones to rerun TestMetaMenu and TestGrubMkConfig in, in addition to the default one")
+	locales   = flag.String("locales", "", "comma separated locales to rerun TestMetaMenu and TestGrubMkConfig in, in addition to the default one")
+)
+
+// environment is the timezone and locale dates of history entries are rendered in.
+type environment struct {
+	timezone string
+	locale   string
+}
+
+// defaultEnvironment is the environment whose reference files don't have any suffix.
+// We want to ensure user's timezone is taken into account.
+var defaultEnvironment = environment{timezone: "Europe/Paris", locale: "C"}
+
+// vars returns the environment variables setting the timezone and locale.
+func (e environment) vars() []string {
+	return []string{"LC_ALL=" + e.locale, "TZ=" + e.timezone}
+}
+
+// name identifies the environment in test and reference file names.
+func (e environment) name() string {
+	return strings.Replace(e.timezone, "/", "-", -1) + "." + e.locale
+}
+
+// withEnvironments returns the test cases to run in each combination of the timezones and locales set on the
+// command line. Test cases in other environments than the default one are named after it.
+func withEnvironments(t *testing.T, testCases map[string]TestCase) map[string]TestCase {
+	t.Helper()
+
+	tzs := []string{defaultEnvironment.timezone}
+	for _, tz := range splitList(*timezones) {
+		if _, err := time.LoadLocation(tz); err != nil {
+			t.Fatalf("invalid timezone %q: %v", tz, err)
+		}
+		tzs = append(tzs, tz)
+	}
+	locs := []string{defaultEnvironment.locale}
+	if requested := splitList(*locales); len(requested) > 0 {
+		installed := installedLocales(t)
+		for _, loc := range requested {
+			if !installed[normalizeLocale(loc)] {
+				t.Fatalf("locale %q isn't installed on this system", loc)
+			}
+			locs = append(locs, loc)
+		}
+	}
+
+	r := make(map[string]TestCase)
+	for name, tc := range testCases {
+		for _, tz := range tzs {
+			for _, loc := range locs {
+				tc.env = environment{timezone: tz, locale: loc}
+				n := name
+				if tc.env != defaultEnvironment {
+					n = name + "/" + tc.env.name()
+				}
+				r[n] = tc
+			}
+		}
+	}
+	return r
+}
+
+// splitList returns the non empty elements of a comma separated list.
+func splitList(s string) []string {
+	var elems []string
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			elems = append(elems, e)
+		}
+	}
+	return elems
+}
+
+// installedLocales returns the locales listed by locale -a, normalized.
+func installedLocales(t *testing.T) map[string]bool {
+	t.Helper()
+
+	out, err := exec.Command("locale", "-a").Output()
+	if err != nil {
+		t.Fatalf("couldn't list installed locales: %v", err)
+	}
+	installed := make(map[string]bool)
+	for _, l := range strings.Fields(string(out)) {
+		installed[normalizeLocale(l)] = true
+	}
+	return installed
+}
+
+// normalizeLocale returns the name of locale with its codeset normalized as glibc does, so that fr_FR.UTF-8 and
+// fr_FR.utf8 are the same locale.
+func normalizeLocale(locale string) string {
+	parts := strings.SplitN(locale, ".", 2)
+	if len(parts) == 1 {
+		return locale
+	}
+	codeset, modifier := parts[1], ""
+	if i := strings.Index(codeset, "@"); i >= 0 {
+		codeset, modifier = codeset[:i], codeset[i:]
+	}
+	codeset = strings.ToLower(strings.NewReplacer("-", "", "_", "").Replace(codeset))
+	return parts[0] + "." + codeset + modifier
+}
+
+func TestNormalizeLocale(t *testing.T) {
+	t.Parallel()
+
+	testCases := map[string]struct {
+		locale string
+		want   string
+	}{
+		"no codeset":            {locale: "C", want: "C"},
+		"normalized codeset":    {locale: "fr_FR.utf8", want: "fr_FR.utf8"},
+		"upper case codeset":    {locale: "ja_JP.UTF-8", want: "ja_JP.utf8"},
+		"codeset with modifier": {locale: "ca_ES.UTF-8@valencia", want: "ca_ES.utf8@valencia"},
+		"other codeset":         {locale: "en_US.ISO-8859-1", want: "en_US.iso88591"},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			assert.Equal(t, tc.want, normalizeLocale(tc.locale))
+		})
+	}
+}
+
+// reference returns the path of the reference file name for the test case environment.
+func (tc TestCase) reference(name string) string {
+	if tc.env != defaultEnvironment {
+		name = name + "." + tc.env.name()
+	}
+	return filepath.Join(tc.path, name)
+}
+
+// historyDateRe matches the date of history entry titles, like "snap1 on 05/08/20 @ 00:01".
+var historyDateRe = regexp.MustCompile(` on [^'\t\n]* @ [^'\t\n]*`)
+
+// historyDateFormat is the date format of history entry titles, and historyDateLayout its rendering in the C locale
+// of the default environment.
+const (
+	historyDateFormat = "+%x @ %H:%M"
+	historyDateLayout = "01/02/06 @ 15:04"
+)
+
+// assertEquals compares generatedF with the reference file name of the test case environment with assertEquals.
+// If this environment doesn't have its own reference file, the default environment one is compared instead, with
+// the dates of history entries rendered in this environment.
+func (tc TestCase) assertEquals(t *testing.T, generatedF, name string, assertEquals func(*testing.T, string, string)) {
+	t.Helper()
+
+	reference := tc.reference(name)
+	if _, err := os.Stat(reference); err == nil || tc.env == defaultEnvironment {
+		assertEquals(t, generatedF, reference)
+		return
+	}
+
+	generated, expected, ok := readGeneratedAndReference(t, generatedF, filepath.Join(tc.path, name))
+	if !ok {
+		return
+	}
+	assert.Equal(t, localizeHistoryDates(t, expected, tc.env), generated,
+		"generated and reference files are different, with reference history dates in %s.", tc.env.name())
+}
+
+// localizeHistoryDates returns content of the default environment with the dates of its history entries rendered by
+// date in env, as 10_linux_zfs does.
+// Dates in the repeated hour of a daylight saving time change are ambiguous: test cases having some need their own
+// reference files.
+func localizeHistoryDates(t *testing.T, content string, env environment) string {
+	t.Helper()
+
+	loc, err := time.LoadLocation(defaultEnvironment.timezone)
+	if err != nil {
+		t.Fatalf("couldn't load default timezone: %v", err)
+	}
+	localized := make(map[string]string)
+	return historyDateRe.ReplaceAllStringFunc(content, func(m string) string {
+		if r, ok := localized[m]; ok {
+			return r
+		}
+		d, err := time.ParseInLocation(historyDateLayout, strings.TrimPrefix(m, " on "), loc)
+		if err != nil {
+			t.Fatalf("couldn't parse history date %q: %v", m, err)
+		}
+		cmd := exec.Command("date", "-d", fmt.Sprintf("@%d", d.Unix()), historyDateFormat)
+		cmd.Env = append(os.Environ(), env.vars()...)
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("couldn't render history date %q in %s: %v", m, env.name(), err)
+		}
+		localized[m] = " on " + strings.TrimSpace(string(out))
+		return localized[m]
+	})
+}
+
+func TestLocalizeHistoryDates(t *testing.T) {
+	t.Parallel()
+
+	content := "menuentry 'snap2 on 12/31/19 @ 08:36' --class ubuntu {\n" +
+		"11111111111111111111111111111111\t-\thistory\tsnap1 on 12/10/18 @ 13:20\trpool/ROOT/ubuntu@snap1\n"
+
+	testCases := map[string]struct {
+		env  environment
+		want string
+	}{
+		"utc": {env: environment{timezone: "UTC", locale: "C"},
+			want: "menuentry 'snap2 on 12/31/19 @ 07:36' --class ubuntu {\n" +
+				"11111111111111111111111111111111\t-\thistory\tsnap1 on 12/10/18 @ 12:20\trpool/ROOT/ubuntu@snap1\n"},
+		"midnight rollover": {env: environment{timezone: "America/Los_Angeles", locale: "C"},
+			want: "menuentry 'snap2 on 12/30/19 @ 23:36' --class ubuntu {\n" +
+				"11111111111111111111111111111111\t-\thistory\tsnap1 on 12/10/18 @ 04:20\trpool/ROOT/ubuntu@snap1\n"},
+		"offset not in whole hours": {env: environment{timezone: "Asia/Kathmandu", locale: "C"},
+			want: "menuentry 'snap2 on 12/31/19 @ 13:21' --class ubuntu {\n" +
+				"11111111111111111111111111111111\t-\thistory\tsnap1 on 12/10/18 @ 18:05\trpool/ROOT/ubuntu@snap1\n"},
+		"default environment": {env: defaultEnvironment, want: content},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			assert.Equal(t, tc.want, localizeHistoryDates(t, content, tc.env))
+		})
+	}
+}
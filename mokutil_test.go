@@ -0,0 +1,68 @@
+package main_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// noMokutil is the secure boot state of systems where mokutil isn't installed.
+const noMokutil = "no-mokutil"
+
+// mokutilStates are the secure boot states the mokutil mock can report, in addition to noMokutil.
+var mokutilStates = map[string]bool{
+	"efi-sb":     true,
+	"efi-nosb":   true,
+	"setup-mode": true,
+	"legacy":     true,
+	"no-efivars": true,
+	"crash":      true,
+	"timeout":    true,
+}
+
+// defaultMokutilTimeout is how long mokutil runs before timing out, when the test case doesn't set it.
+const defaultMokutilTimeout = "2s"
+
+// MokutilScenario is what mokutil reports, declared in the mokutil section of a test case definition.
+type MokutilScenario struct {
+	// State is the secure boot state.
+	State string
+	// EnrolledKeys are the subjects of the keys listed as enrolled.
+	EnrolledKeys []string `yaml:"enrolled_keys"`
+	// Timeout is how long mokutil runs in the timeout state, like 500ms.
+	Timeout string
+}
+
+// secureBootState returns the secure boot state of the test case.
+func (m MokutilScenario) secureBootState(t *testing.T) string {
+	t.Helper()
+
+	if m.State == "" {
+		t.Fatal("missing secure boot state in mokutil section")
+	}
+	if m.State != noMokutil && !mokutilStates[m.State] {
+		t.Fatalf("unknown secure boot state: %q", m.State)
+	}
+	if m.Timeout != "" {
+		if _, err := time.ParseDuration(m.Timeout); err != nil {
+			t.Fatalf("invalid mokutil timeout %q: %v", m.Timeout, err)
+		}
+	}
+	return m.State
+}
+
+// env returns the environment variables for the mokutil mock to report state.
+func (m MokutilScenario) env(state string) []string {
+	if state == noMokutil {
+		return nil
+	}
+	timeout := m.Timeout
+	if timeout == "" {
+		timeout = defaultMokutilTimeout
+	}
+	return []string{
+		"TEST_MOKUTIL_SECUREBOOT=" + state,
+		"TEST_MOKUTIL_ENROLLED_KEYS=" + strings.Join(m.EnrolledKeys, "\n"),
+		"TEST_MOKUTIL_TIMEOUT=" + timeout,
+	}
+}
@@ -0,0 +1,184 @@
+package main_test
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+var (
+	review = flag.Bool("review", false, "write candidate reference files next to the golden ones instead of updating them")
+	accept = flag.String("accept", "", "promote candidate reference files of test cases matching this glob (eg efi-nosb/clone-*), without running tests")
+	reject = flag.String("reject", "", "remove candidate reference files of test cases matching this glob, without running tests")
+)
+
+// candidateSuffix is appended to the reference file name for candidates.
+const candidateSuffix = ".candidate"
+
+// Status of a candidate compared to its reference file.
+const (
+	candidateNew       = "new"
+	candidateChanged   = "changed"
+	candidateUnchanged = "unchanged"
+)
+
+var reviewSummary = struct {
+	mu sync.Mutex
+	// files are the status of each reference file, per test case name.
+	files map[string]map[string]string
+}{
+	files: make(map[string]map[string]string),
+}
+
+// writeCandidate writes the anonymized generated file next to the reference one, for later review.
+// No candidate is kept if the reference file already has the same content.
+func writeCandidate(t *testing.T, generatedF, referenceF string) {
+	t.Helper()
+
+	var generated string
+	if _, err := os.Stat(generatedF); err == nil {
+		generated = anonymizeTempDirNames(t, generatedF)
+	}
+
+	candidateF := referenceF + candidateSuffix
+	status := candidateChanged
+	b, err := ioutil.ReadFile(referenceF)
+	switch {
+	case os.IsNotExist(err):
+		status = candidateNew
+	case err != nil:
+		t.Fatal("couldn't read reference file", err)
+	case string(b) == generated:
+		status = candidateUnchanged
+	}
+
+	if status == candidateUnchanged {
+		if err := os.Remove(candidateF); err != nil && !os.IsNotExist(err) {
+			t.Fatal("couldn't remove outdated candidate file", err)
+		}
+	} else if err := ioutil.WriteFile(candidateF, []byte(generated), 0644); err != nil {
+		t.Fatal("couldn't write candidate file", err)
+	}
+
+	tcName, err := filepath.Rel(filepath.Join(testDataDir, "definitions"), filepath.Dir(referenceF))
+	if err != nil {
+		t.Fatal("couldn't get test case name", err)
+	}
+	reviewSummary.mu.Lock()
+	defer reviewSummary.mu.Unlock()
+	if reviewSummary.files[tcName] == nil {
+		reviewSummary.files[tcName] = make(map[string]string)
+	}
+	reviewSummary.files[tcName][filepath.Base(referenceF)] = status
+}
+
+// printReviewSummary prints the status of each reference file per test case, with changed and new ones first.
+func printReviewSummary() {
+	reviewSummary.mu.Lock()
+	defer reviewSummary.mu.Unlock()
+
+	var names []string
+	for n := range reviewSummary.files {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	var changed, unchanged []string
+	for _, n := range names {
+		var files []string
+		var modified bool
+		for f, status := range reviewSummary.files[n] {
+			files = append(files, fmt.Sprintf("%s %s", f, status))
+			if status != candidateUnchanged {
+				modified = true
+			}
+		}
+		sort.Strings(files)
+		line := fmt.Sprintf("  %s: %s", n, strings.Join(files, ", "))
+		if modified {
+			changed = append(changed, line)
+			continue
+		}
+		unchanged = append(unchanged, line)
+	}
+
+	fmt.Printf("Candidate reference files to review (%d test cases):\n", len(changed))
+	for _, l := range changed {
+		fmt.Println(l)
+	}
+	fmt.Printf("Unchanged reference files (%d test cases):\n", len(unchanged))
+	for _, l := range unchanged {
+		fmt.Println(l)
+	}
+	if len(changed) > 0 {
+		fmt.Println("Promote candidates with -accept=<test case glob> or drop them with -reject=<test case glob>.")
+	}
+}
+
+// reviewCandidates promotes (if accepted) or removes all candidates files of test cases matching pattern.
+// It returns the list of reviewed reference files.
+func reviewCandidates(pattern string, accepted bool) ([]string, error) {
+	definitionsDir := filepath.Join(testDataDir, "definitions")
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid test case glob %q: %v", pattern, err)
+	}
+
+	candidates, err := filepath.Glob(filepath.Join(definitionsDir, "*", "*", "*"+candidateSuffix))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't list candidate files: %v", err)
+	}
+
+	var reviewed []string
+	for _, c := range candidates {
+		tcName, err := filepath.Rel(definitionsDir, filepath.Dir(c))
+		if err != nil {
+			return nil, fmt.Errorf("couldn't get test case name of %q: %v", c, err)
+		}
+		if match, _ := filepath.Match(pattern, tcName); !match {
+			continue
+		}
+
+		reference := strings.TrimSuffix(c, candidateSuffix)
+		if accepted {
+			if err := os.Rename(c, reference); err != nil {
+				return nil, fmt.Errorf("couldn't promote candidate file: %v", err)
+			}
+		} else if err := os.Remove(c); err != nil {
+			return nil, fmt.Errorf("couldn't remove candidate file: %v", err)
+		}
+		reviewed = append(reviewed, reference)
+	}
+	if len(reviewed) == 0 {
+		return nil, errors.New("no candidate file found for test cases matching " + pattern)
+	}
+	return reviewed, nil
+}
+
+// runReview executes the accept or reject pass requested on the command line, instead of running tests.
+func runReview() int {
+	if *accept != "" && *reject != "" {
+		fmt.Fprintln(os.Stderr, "-accept and -reject can't be used together")
+		return 2
+	}
+
+	pattern, accepted, action := *accept, true, "accepted"
+	if *reject != "" {
+		pattern, accepted, action = *reject, false, "rejected"
+	}
+	reviewed, err := reviewCandidates(pattern, accepted)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	for _, f := range reviewed {
+		fmt.Printf("%s: %s\n", action, f)
+	}
+	return 0
+}
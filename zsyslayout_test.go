@@ -0,0 +1,278 @@
+package main_test
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// ZsysMachine is a machine installed by zsys, declared by its history and users rather than dataset by dataset.
+type ZsysMachine struct {
+	// Machine is the suffix of its system datasets, like ROOT/ubuntu_<machine>.
+	Machine string
+	// States is the number of history states of the machine, saved as snapshots of all its system and user
+	// datasets, one day apart before LastUsed.
+	States int
+	// Users have their own USERDATA/<user>_<id> dataset, linked to the machine. root always has one.
+	Users []string
+	// Content is the content of the system dataset and of all its states. It defaults to an Ubuntu 19.04 system
+	// with one kernel.
+	Content             map[string]string
+	LastUsed            time.Time `yaml:"last_used"`
+	LastBootedKernel    string    `yaml:"last_booted_kernel"`
+	IsCurrentSystemRoot bool      `yaml:"is_current_system_root"`
+}
+
+// zsysSystemChildren are the datasets zsys creates under each system dataset, with their canmount property.
+// Others inherit their mountpoint and canmount from the system dataset.
+var zsysSystemChildren = []struct{ name, canmount string }{
+	{"srv", ""},
+	{"usr", "off"},
+	{"usr/local", ""},
+	{"var", "off"},
+	{"var/games", ""},
+	{"var/lib", ""},
+	{"var/lib/AccountsService", ""},
+	{"var/lib/NetworkManager", ""},
+	{"var/lib/apt", ""},
+	{"var/lib/dpkg", ""},
+	{"var/log", ""},
+	{"var/mail", ""},
+	{"var/snap", ""},
+	{"var/spool", ""},
+	{"var/www", ""},
+}
+
+// zsysLayout returns the datasets of a pool, followed by the dataset trees of its zsys machines. The ROOT and
+// USERDATA containers are added if they aren't declared.
+func zsysLayout(pool string, declared []FakeDataset, machines []ZsysMachine, now time.Time) []FakeDataset {
+	if len(machines) == 0 {
+		return declared
+	}
+
+	datasets := append([]FakeDataset{}, declared...)
+	isDeclared := make(map[string]bool)
+	for _, d := range declared {
+		isDeclared[d.Name] = true
+	}
+	if !isDeclared["ROOT"] {
+		datasets = append(datasets, FakeDataset{Name: "ROOT", Mountpoint: "none", CanMount: "off"})
+	}
+	if !isDeclared["USERDATA"] {
+		datasets = append(datasets, FakeDataset{Name: "USERDATA", Mountpoint: "/", CanMount: "off"})
+	}
+
+	for _, m := range machines {
+		datasets = append(datasets, m.datasets(pool, now)...)
+	}
+	return datasets
+}
+
+// datasets returns the system dataset of the machine, its children and its user datasets, all snapshotted for
+// each state.
+func (m ZsysMachine) datasets(pool string, now time.Time) []FakeDataset {
+	content := m.Content
+	if content == nil {
+		content = map[string]string{"/boot": "boot/one-kernel", "/etc": "etc/machine1-19.04"}
+	}
+	kernel := m.LastBootedKernel
+	if kernel == "" {
+		kernel = "vmlinuz-5.0.0-13-generic"
+	}
+	lastUsed := m.LastUsed
+	if lastUsed.IsZero() {
+		lastUsed = now
+	}
+
+	// states are named after the machine, and shared by all its datasets as zsys snapshots them together
+	states := make([]FakeSnapshot, m.States)
+	for i := range states {
+		states[i] = FakeSnapshot{
+			Name:         "autozsys_" + zsysID(m.Machine, strconv.Itoa(i)),
+			CreationDate: lastUsed.Add(-time.Duration(m.States-i) * 24 * time.Hour),
+		}
+	}
+
+	systemName := "ROOT/ubuntu_" + m.Machine
+	system := FakeDataset{
+		Name:                systemName,
+		Content:             content,
+		IsCurrentSystemRoot: m.IsCurrentSystemRoot,
+		ZsysBootfs:          true,
+		LastUsed:            lastUsed,
+		LastBootedKernel:    kernel,
+		Mountpoint:          "/",
+		CanMount:            "noauto",
+	}
+	for _, s := range states {
+		s.Content, s.LastBootedKernel = content, kernel
+		system.Snapshots = append(system.Snapshots, s)
+	}
+	datasets := []FakeDataset{system}
+
+	for _, c := range zsysSystemChildren {
+		datasets = append(datasets, FakeDataset{
+			Name:      systemName + "/" + c.name,
+			CanMount:  c.canmount,
+			Snapshots: states,
+		})
+	}
+
+	// user datasets are linked to the system datasets they were used with
+	for _, user := range append([]string{"root"}, m.Users...) {
+		mountpoint := "/home/" + user
+		if user == "root" {
+			mountpoint = "/root"
+		}
+		datasets = append(datasets, FakeDataset{
+			Name:           fmt.Sprintf("USERDATA/%s_%s", user, zsysID(m.Machine, user)),
+			Mountpoint:     mountpoint,
+			UserProperties: map[string]string{"com.ubuntu.zsys:bootfs-datasets": pool + "/" + systemName},
+			Snapshots:      states,
+		})
+	}
+	return datasets
+}
+
+// zsysID returns a stable identifier, in the format of zsys generated ones, for the given seeds.
+func zsysID(seeds ...string) string {
+	h := fnv.New64a()
+	for _, s := range seeds {
+		h.Write([]byte(s + "\x00"))
+	}
+	// the high bit keeps enough digits to take the last ones
+	id := strconv.FormatUint(h.Sum64()|1<<63, 36)
+	return id[len(id)-6:]
+}
+
+func TestZsysLayout(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2020, 9, 13, 12, 26, 39, 0, time.UTC)
+	testCases := map[string]struct {
+		declared []FakeDataset
+		machines []ZsysMachine
+
+		wantContainers []FakeDataset
+		wantLen        int
+	}{
+		"no machine": {
+			declared:       []FakeDataset{{Name: "ROOT", Mountpoint: "/"}, {Name: "data"}},
+			wantContainers: []FakeDataset{{Name: "ROOT", Mountpoint: "/"}},
+			wantLen:        2,
+		},
+		"containers are added": {
+			machines: []ZsysMachine{{Machine: "abcd"}},
+			wantContainers: []FakeDataset{
+				{Name: "ROOT", Mountpoint: "none", CanMount: "off"},
+				{Name: "USERDATA", Mountpoint: "/", CanMount: "off"},
+			},
+			wantLen: 2 + 1 + len(zsysSystemChildren) + 1,
+		},
+		"declared containers are kept": {
+			declared: []FakeDataset{{Name: "ROOT", Mountpoint: "none"}, {Name: "USERDATA", Mountpoint: "/home"}},
+			machines: []ZsysMachine{{Machine: "abcd", Users: []string{"alice"}}, {Machine: "efgh"}},
+			wantContainers: []FakeDataset{
+				{Name: "ROOT", Mountpoint: "none"},
+				{Name: "USERDATA", Mountpoint: "/home"},
+			},
+			wantLen: 2 + 2*(1+len(zsysSystemChildren)) + 3,
+		},
+	}
+
+	for name, tc := range testCases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			datasets := zsysLayout("rpool", tc.declared, tc.machines, now)
+
+			assert.Len(t, datasets, tc.wantLen, "unexpected number of datasets")
+			for _, want := range tc.wantContainers {
+				var found []FakeDataset
+				for _, d := range datasets {
+					if d.Name == want.Name {
+						found = append(found, d)
+					}
+				}
+				require.Len(t, found, 1, "%s should be created once", want.Name)
+				assert.Equal(t, want, found[0], "unexpected %s container", want.Name)
+			}
+		})
+	}
+}
+
+func TestZsysMachineDatasets(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2020, 9, 13, 12, 26, 39, 0, time.UTC)
+	m := ZsysMachine{Machine: "abcd", States: 3, Users: []string{"alice"}}
+	datasets := m.datasets("rpool", now)
+
+	system := datasets[0]
+	assert.Equal(t, "ROOT/ubuntu_abcd", system.Name, "the system dataset should come first")
+	assert.Equal(t, "/", system.Mountpoint, "unexpected system mountpoint")
+	assert.Equal(t, "noauto", system.CanMount, "unexpected system canmount")
+	assert.True(t, system.ZsysBootfs, "the system dataset should be a zsys bootfs")
+	assert.Equal(t, now, system.LastUsed, "last used should default to now")
+	assert.Equal(t, "vmlinuz-5.0.0-13-generic", system.LastBootedKernel, "unexpected default last booted kernel")
+	require.Len(t, system.Snapshots, m.States, "each state should be a snapshot of the system dataset")
+	for i, s := range system.Snapshots {
+		assert.Equal(t, system.Content, s.Content, "states should have the content of the system")
+		assert.True(t, s.CreationDate.Before(now), "states should be taken before the last use")
+		if i > 0 {
+			assert.True(t, s.CreationDate.After(system.Snapshots[i-1].CreationDate), "states should be ordered by creation date")
+		}
+	}
+
+	var children, users []FakeDataset
+	for _, d := range datasets[1:] {
+		switch {
+		case strings.HasPrefix(d.Name, system.Name+"/"):
+			children = append(children, d)
+		case strings.HasPrefix(d.Name, "USERDATA/"):
+			users = append(users, d)
+		default:
+			t.Errorf("unexpected dataset %s", d.Name)
+		}
+	}
+
+	require.Len(t, children, len(zsysSystemChildren), "unexpected number of system children")
+	for i, c := range children {
+		assert.Equal(t, system.Name+"/"+zsysSystemChildren[i].name, c.Name, "unexpected child name")
+		assert.Empty(t, c.Mountpoint, "children should inherit their mountpoint")
+		assert.Equal(t, zsysSystemChildren[i].canmount, c.CanMount, "unexpected child canmount")
+		assert.Nil(t, c.Content, "children should have no content of their own")
+		assert.Len(t, c.Snapshots, m.States, "children should be snapshotted with the system")
+		for j, s := range c.Snapshots {
+			assert.Equal(t, system.Snapshots[j].Name, s.Name, "children should share the system states")
+			assert.Equal(t, system.Snapshots[j].CreationDate, s.CreationDate, "children should share the system states")
+		}
+	}
+
+	require.Len(t, users, 2, "root should have a user dataset in addition to declared users")
+	for i, want := range []struct{ user, mountpoint string }{{"root", "/root"}, {"alice", "/home/alice"}} {
+		u := users[i]
+		assert.Equal(t, "USERDATA/"+want.user+"_"+zsysID("abcd", want.user), u.Name, "unexpected user dataset name")
+		assert.Equal(t, want.mountpoint, u.Mountpoint, "unexpected user dataset mountpoint")
+		assert.Equal(t, map[string]string{"com.ubuntu.zsys:bootfs-datasets": "rpool/ROOT/ubuntu_abcd"}, u.UserProperties,
+			"user datasets should be linked to the system dataset")
+		assert.Len(t, u.Snapshots, m.States, "user datasets should be snapshotted with the system")
+	}
+}
+
+func TestZsysID(t *testing.T) {
+	t.Parallel()
+
+	id := zsysID("abcd", "alice")
+	assert.Regexp(t, "^[0-9a-z]{6}$", id, "ids should be 6 lower case alphanumeric characters")
+	assert.Equal(t, id, zsysID("abcd", "alice"), "ids should be stable")
+	assert.NotEqual(t, id, zsysID("abcd", "bob"), "ids should differ between seeds")
+	assert.NotEqual(t, zsysID("ab", "cd"), zsysID("a", "bcd"), "seeds shouldn't be concatenated")
+}